@@ -0,0 +1,224 @@
+package macaroon_pass
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Algorithm identifies the scheme which signs a macaroon. It is
+// recorded in the macaroon, so that a verifier does not need to guess
+// the scheme from the macaroon id. Public-key signatures cover the
+// algorithm; MAC chains do not, so verifiers of MAC macaroons must take
+// the algorithm from the key rather than from the macaroon.
+type Algorithm string
+
+const (
+	// AlgorithmUnknown is reported for macaroons which record no
+	// algorithm. HmacSha256Signer leaves the algorithm out to stay
+	// compatible with libmacaroons, and so do payment cards and
+	// earlier versions of this package whatever their algorithm, so
+	// the verifier must decide how to verify such macaroons.
+	AlgorithmUnknown Algorithm = "unknown"
+
+	// AlgorithmHmacSha256 is the HMAC-SHA256 chain of HmacSha256Signer.
+	// It is never recorded in macaroons; verifiers learn it from the
+	// algorithm of the key.
+	AlgorithmHmacSha256 Algorithm = "hmac-sha256"
+
+	// AlgorithmEcdsa is a secp256k1 ECDSA signature made by EcdsaSigner
+	// or ThresholdSigner.
+	AlgorithmEcdsa Algorithm = "ecdsa-secp256k1"
+
+	// AlgorithmCompactEcdsa is a recoverable compact secp256k1 ECDSA
+	// signature made by CompactEcdsaSigner.
+	AlgorithmCompactEcdsa Algorithm = "ecdsa-secp256k1-recoverable"
+
+	// AlgorithmEd25519 is an Ed25519 signature made by Ed25519Signer.
+	AlgorithmEd25519 Algorithm = "ed25519"
+
+	// AlgorithmSchnorr is a BIP-340 Schnorr signature made by
+	// SchnorrSigner.
+	AlgorithmSchnorr Algorithm = "schnorr-bip340"
+
+	// AlgorithmSlhDsa is an SLH-DSA-SHAKE-128s signature made by
+	// SlhDsaSigner.
+	AlgorithmSlhDsa Algorithm = "slh-dsa-shake-128s"
+
+	// AlgorithmMultiIssuer is a set of signatures of several issuers
+	// made by CoSigner.
+	AlgorithmMultiIssuer Algorithm = "multi-issuer"
+
+	// AlgorithmChainedEcdsa is a chain of secp256k1 ECDSA signatures
+	// made by ChainedEcdsaSigner.
+	AlgorithmChainedEcdsa Algorithm = "chained-ecdsa-secp256k1"
+
+	// AlgorithmHybrid is an ECDSA-signed root with an HMAC-SHA256 chain
+	// made by HybridSigner.
+	AlgorithmHybrid Algorithm = "hybrid-ecdsa-hmac-sha256"
+
+	// AlgorithmHmacSha512_256, AlgorithmHmacSha3_256 and
+	// AlgorithmBlake2b256 are MAC chains made by MacSigner with
+	// HMAC-SHA512/256, HMAC-SHA3-256 and keyed BLAKE2b-256.
+	AlgorithmHmacSha512_256 Algorithm = "hmac-sha512-256"
+	AlgorithmHmacSha3_256   Algorithm = "hmac-sha3-256"
+	AlgorithmBlake2b256     Algorithm = "blake2b-256"
+)
+
+// Algorithm returns the algorithm recorded in the macaroon, or
+// AlgorithmUnknown if none is recorded.
+func (m *Macaroon) Algorithm() Algorithm {
+	if m.algorithm == "" {
+		return AlgorithmUnknown
+	}
+	return m.algorithm
+}
+
+// chainAlgorithm returns the algorithm recorded in the macaroon, taking
+// a macaroon which records none for an HMAC-SHA256 one. It is used where
+// the algorithm is known from elsewhere, such as when adding caveats or
+// checking a macaroon against the algorithm of a key.
+func (m *Macaroon) chainAlgorithm() Algorithm {
+	if m.algorithm == "" {
+		return AlgorithmHmacSha256
+	}
+	return m.algorithm
+}
+
+// setAlgorithm records the signing algorithm in the macaroon.
+// HMAC-SHA256 is recorded by leaving the algorithm out, which keeps
+// such macaroons compatible with libmacaroons.
+func (m *Macaroon) setAlgorithm(alg Algorithm) {
+	if alg == AlgorithmHmacSha256 || alg == AlgorithmUnknown {
+		alg = ""
+	}
+	m.algorithm = alg
+}
+
+// isRecordableAlgorithm reports whether the algorithm may be recorded in
+// a macaroon.
+func isRecordableAlgorithm(alg Algorithm) bool {
+	return alg != "" && alg != AlgorithmHmacSha256 && alg != AlgorithmUnknown
+}
+
+// isMacAlgorithm reports whether the final signature of macaroons signed
+// with the algorithm is the signature of a MAC chain.
+func isMacAlgorithm(alg Algorithm) bool {
+	_, ok := macAlgorithms[alg]
+	return ok || alg == AlgorithmHybrid
+}
+
+// signatureLen returns the length of the signatures made with the
+// algorithm, or 0 if the length varies or is not known.
+func signatureLen(alg Algorithm) int {
+	switch alg {
+	case AlgorithmHmacSha256, AlgorithmHmacSha512_256, AlgorithmHmacSha3_256,
+		AlgorithmBlake2b256, AlgorithmHybrid:
+		return macSignatureLen
+	case AlgorithmEd25519, AlgorithmSchnorr:
+		return 64
+	case AlgorithmCompactEcdsa:
+		return compactEcdsaSignatureLen
+	case AlgorithmSlhDsa:
+		return slhDsaShake128s.signatureLen()
+	}
+	return 0
+}
+
+// SignatureVerifier verifies the signature of a macaroon signed with
+// one particular algorithm. It is responsible for finding the key for
+// the macaroon.
+type SignatureVerifier func(m *Macaroon) error
+
+// VerifierRegistry dispatches signature verification by the algorithm
+// recorded in the macaroon. Only registered algorithms are accepted.
+//
+// MAC chains do not cover the recorded algorithm, so macaroons which
+// record a MAC algorithm or none at all are dispatched by the algorithm
+// of the keys a KeyResolver finds for them. Without such keys,
+// macaroons which record no algorithm are dispatched to the verifier of
+// AlgorithmUnknown, and the others are rejected.
+//
+// VerifySignature has the same signature as Context.VerifySignature,
+// so a Context can delegate to the registry.
+type VerifierRegistry struct {
+	verifiers map[Algorithm]SignatureVerifier
+	resolver  KeyResolver
+	now       func() time.Time
+}
+
+func NewVerifierRegistry() *VerifierRegistry {
+	return &VerifierRegistry{
+		verifiers: make(map[Algorithm]SignatureVerifier),
+		now:       time.Now,
+	}
+}
+
+// Register allows the given algorithm and sets its verifier.
+func (r *VerifierRegistry) Register(alg Algorithm, verifier SignatureVerifier) {
+	r.verifiers[alg] = verifier
+}
+
+// Unregister disallows the given algorithm.
+func (r *VerifierRegistry) Unregister(alg Algorithm) {
+	delete(r.verifiers, alg)
+}
+
+// SetKeyResolver sets the resolver of the keys which decide the
+// algorithm of MAC macaroons.
+func (r *VerifierRegistry) SetKeyResolver(resolver KeyResolver) {
+	r.resolver = resolver
+}
+
+// VerifySignature verifies the macaroon signature with the verifier
+// registered for its algorithm.
+func (r *VerifierRegistry) VerifySignature(m *Macaroon) error {
+	alg := m.Algorithm()
+	if _, ok := macAlgorithms[m.algorithm]; ok || m.algorithm == "" {
+		keyAlg, err := r.macKeyAlgorithm(m)
+		if err != nil {
+			return err
+		}
+		switch {
+		case keyAlg != "":
+			alg = keyAlg
+		case m.algorithm != "":
+			return fmt.Errorf("no key for macaroon %q", m.Id())
+		}
+	}
+	verifier, ok := r.verifiers[alg]
+	if !ok {
+		return fmt.Errorf("algorithm %q is not allowed", alg)
+	}
+	return verifier(m)
+}
+
+// macKeyAlgorithm returns the MAC algorithm of the keys resolved for
+// the macaroon, or "" if there are none.
+func (r *VerifierRegistry) macKeyAlgorithm(m *Macaroon) (Algorithm, error) {
+	if r.resolver == nil {
+		return "", nil
+	}
+	algs := make([]Algorithm, 0, len(macAlgorithms))
+	for alg := range macAlgorithms {
+		algs = append(algs, alg)
+	}
+	sort.Slice(algs, func(i, j int) bool {
+		return algs[i] < algs[j]
+	})
+	var res Algorithm
+	for _, alg := range algs {
+		keys, err := r.resolver.ResolveKeys(m.Id(), alg, r.now())
+		if err != nil {
+			return "", fmt.Errorf("cannot resolve key: %v", err)
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		if res != "" {
+			return "", fmt.Errorf("macaroon %q has keys of both %q and %q", m.Id(), res, alg)
+		}
+		res = alg
+	}
+	return res, nil
+}
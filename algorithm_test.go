@@ -0,0 +1,204 @@
+package macaroon_pass
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestAlgorithmIsRecorded(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+
+	m := MustNew([]byte("some id"), "", V2)
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmUnknown)
+
+	err = m.Sign(NewEcdsaSigner(key))
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmEcdsa)
+
+	data, err := MarshalBinary(&MacaroonSlice{[]*Macaroon{m}})
+	c.Assert(err, qt.IsNil)
+	u, err := UnmarshalBinary(data)
+	c.Assert(err, qt.IsNil)
+	m1, err := u.Get(0)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m1.Algorithm(), qt.Equals, AlgorithmEcdsa)
+	c.Assert(m1.Equal(m), qt.IsTrue)
+
+	jsonData, err := (&marshaller{m}).MarshalJSON()
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(jsonData), qt.Contains, `"a":"ecdsa-secp256k1"`)
+
+	jsonData = []byte(`{"i":"some id","s64":"` + b64str(make([]byte, 64)) + `","a":"ed25519"}`)
+	m2 := marshaller{&Macaroon{}}
+	err = m2.UnmarshalJSON(jsonData)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m2.Algorithm(), qt.Equals, AlgorithmEd25519)
+
+	m.SetVersion(V1)
+	_, err = MarshalBinary(&MacaroonSlice{[]*Macaroon{m}})
+	c.Assert(err, qt.ErrorMatches, `.*cannot record algorithm "ecdsa-secp256k1" in v1 macaroon`)
+
+	// HMAC-SHA256 macaroons stay compatible with libmacaroons.
+	hmacKey, err := DeriveKey(key)
+	c.Assert(err, qt.IsNil)
+	signer, err := NewHmacSha256Signer(hmacKey)
+	c.Assert(err, qt.IsNil)
+	m3 := MustNew([]byte("some id"), "", V2)
+	err = m3.Sign(signer)
+	c.Assert(err, qt.IsNil)
+	data, err = (&marshaller{m3}).MarshalBinary()
+	c.Assert(err, qt.IsNil)
+	c.Assert(data[:10], qt.DeepEquals, append([]byte{2, 2, 7}, "some id"...))
+	c.Assert(data[10], qt.Equals, byte(fieldEOS))
+}
+
+func TestVerifierRegistry(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	hmacKey, err := DeriveKey(key)
+	c.Assert(err, qt.IsNil)
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, qt.IsNil)
+
+	r := NewVerifierRegistry()
+	r.Register(AlgorithmUnknown, func(m *Macaroon) error {
+		return HmacSha256SignatureVerify(hmacKey, m)
+	})
+	r.Register(AlgorithmEd25519, func(m *Macaroon) error {
+		return Ed25519SignatureVerify(pub, m)
+	})
+
+	hmacSigner, err := NewHmacSha256Signer(hmacKey)
+	c.Assert(err, qt.IsNil)
+	m := MustNew([]byte("some id"), "", V2)
+	err = m.Sign(hmacSigner)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.IsNil)
+
+	edSigner, err := NewEd25519Signer(NewSecretKey(priv))
+	c.Assert(err, qt.IsNil)
+	m = MustNew([]byte("some id"), "", V2)
+	err = m.Sign(edSigner)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.IsNil)
+
+	// The algorithm is signed, so relabeling the macaroon fails.
+	m.setAlgorithm(AlgorithmSchnorr)
+	r.Register(AlgorithmSchnorr, func(m *Macaroon) error {
+		return Ed25519SignatureVerify(pub, m)
+	})
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, "wrong signature")
+
+	m = MustNew([]byte("some id"), "", V2)
+	err = m.Sign(NewEcdsaSigner(key))
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `algorithm "ecdsa-secp256k1" is not allowed`)
+
+	r.Unregister(AlgorithmUnknown)
+	hmacSigner, err = NewHmacSha256Signer(hmacKey)
+	c.Assert(err, qt.IsNil)
+	m = MustNew([]byte("some id"), "", V2)
+	err = m.Sign(hmacSigner)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `algorithm "unknown" is not allowed`)
+
+	// Legacy ECDSA macaroons record no algorithm either, so they are not
+	// taken for ECDSA macaroons, and the verifier decides how to verify
+	// them.
+	ecdsaKey, pubKey := secp256k1.PrivKeyFromBytes(key.bytes())
+	m = MustNew([]byte("legacy"), "", V2)
+	legacyHash := calcLegacyMacaroonHash(m)
+	sig, err := ecdsaKey.Sign(legacyHash[:])
+	c.Assert(err, qt.IsNil)
+	m.SetSignature(sig.Serialize())
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmUnknown)
+	r.Register(AlgorithmEcdsa, func(m *Macaroon) error {
+		return EcdsaSignatureVerifyLegacy(pubKey.SerializeCompressed(), m)
+	})
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `algorithm "unknown" is not allowed`)
+	r.Register(AlgorithmUnknown, func(m *Macaroon) error {
+		return EcdsaSignatureVerifyLegacy(pubKey.SerializeCompressed(), m)
+	})
+	c.Assert(r.VerifySignature(m), qt.IsNil)
+}
+
+func TestVerifierRegistryMacKeys(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("some key"))
+	keyring := NewKeyring()
+	err := keyring.Add(&Key{
+		Id:        "sha3",
+		Selector:  []byte("some id"),
+		Algorithm: AlgorithmHmacSha3_256,
+		Material:  key.bytes(),
+	})
+	c.Assert(err, qt.IsNil)
+	verify := NewResolverContext(keyring, nil).VerifySignature
+
+	r := NewVerifierRegistry()
+	r.SetKeyResolver(keyring)
+	r.Register(AlgorithmHmacSha3_256, verify)
+
+	signer, err := NewMacSigner(AlgorithmHmacSha3_256, key)
+	c.Assert(err, qt.IsNil)
+	m := MustNew([]byte("some id"), "", V2)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.IsNil)
+
+	// The recorded algorithm is not covered by the MAC, so the registry
+	// dispatches by the algorithm of the key, whatever is recorded.
+	r.Register(AlgorithmBlake2b256, func(m *Macaroon) error {
+		return nil
+	})
+	m.setAlgorithm(AlgorithmBlake2b256)
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `no key for macaroon "some id"`)
+	m.setAlgorithm(AlgorithmHmacSha256)
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmUnknown)
+	r.Register(AlgorithmUnknown, func(m *Macaroon) error {
+		return nil
+	})
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `no key for macaroon "some id"`)
+
+	// HMAC-SHA256 macaroons are told apart from other macaroons which
+	// record no algorithm by their key.
+	err = keyring.Add(&Key{
+		Id:        "hmac",
+		Selector:  []byte("hmac id"),
+		Algorithm: AlgorithmHmacSha256,
+		Material:  key.bytes(),
+	})
+	c.Assert(err, qt.IsNil)
+	hmacSigner, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	m = MustNew([]byte("hmac id"), "", V2)
+	c.Assert(m.Sign(hmacSigner), qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `algorithm "hmac-sha256" is not allowed`)
+	r.Register(AlgorithmHmacSha256, verify)
+	c.Assert(r.VerifySignature(m), qt.IsNil)
+
+	signer, err = NewMacSigner(AlgorithmHmacSha3_256, key)
+	c.Assert(err, qt.IsNil)
+	m = MustNew([]byte("other id"), "", V2)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `no key for macaroon "other id"`)
+
+	err = keyring.Add(&Key{
+		Id:        "blake2b",
+		Selector:  []byte("some id"),
+		Algorithm: AlgorithmBlake2b256,
+		Material:  key.bytes(),
+	})
+	c.Assert(err, qt.IsNil)
+	signer, err = NewMacSigner(AlgorithmHmacSha3_256, key)
+	c.Assert(err, qt.IsNil)
+	m = MustNew([]byte("some id"), "", V2)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, `macaroon "some id" has keys of both "blake2b-256" and "hmac-sha3-256"`)
+}
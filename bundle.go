@@ -0,0 +1,173 @@
+package macaroon_pass
+
+import (
+	"fmt"
+)
+
+// Bundle holds a primary macaroon together with the discharge macaroons
+// supplied with it, indexed by the ids of the third-party caveats they
+// discharge. By convention the first macaroon of a MacaroonSlice is the
+// primary one and the rest are its discharges.
+type Bundle struct {
+	primary    *Macaroon
+	discharges []*Macaroon
+	byId       map[string]*Macaroon
+}
+
+// NewBundle creates a bundle of the primary macaroon and its discharge
+// macaroons. Two discharge macaroons may not have the same id.
+func NewBundle(primary *Macaroon, discharges ...*Macaroon) (*Bundle, error) {
+	if primary == nil {
+		return nil, fmt.Errorf("no primary macaroon was passed when create bundle")
+	}
+	b := &Bundle{
+		primary: primary,
+		byId:    make(map[string]*Macaroon),
+	}
+	for _, d := range discharges {
+		if d == nil {
+			return nil, fmt.Errorf("no discharge macaroon was passed when create bundle")
+		}
+		if _, ok := b.byId[string(d.Id())]; ok {
+			return nil, fmt.Errorf("duplicate discharge macaroon %q", d.Id())
+		}
+		b.byId[string(d.Id())] = d
+		b.discharges = append(b.discharges, d)
+	}
+	return b, nil
+}
+
+// NewBundleFromSlice creates a bundle from macaroons as returned by
+// UnmarshalBinary, the first of which is the primary one.
+func NewBundleFromSlice(s *MacaroonSlice) (*Bundle, error) {
+	if s == nil || len(s.macaroons) == 0 {
+		return nil, fmt.Errorf("no macaroons were passed when create bundle")
+	}
+	return NewBundle(s.macaroons[0], s.macaroons[1:]...)
+}
+
+// Primary returns the primary macaroon.
+func (b *Bundle) Primary() *Macaroon {
+	return b.primary
+}
+
+// Discharges returns the discharge macaroons in the order they were
+// supplied.
+func (b *Bundle) Discharges() []*Macaroon {
+	return append([]*Macaroon(nil), b.discharges...)
+}
+
+// Discharge returns the discharge macaroon of the third-party caveat
+// with the given id.
+func (b *Bundle) Discharge(caveatId []byte) (*Macaroon, bool) {
+	d, ok := b.byId[string(caveatId)]
+	return d, ok
+}
+
+// Slice returns the macaroons of the bundle, the primary one first, so
+// that they can be encoded with MarshalBinary.
+func (b *Bundle) Slice() *MacaroonSlice {
+	return &MacaroonSlice{append([]*Macaroon{b.primary}, b.discharges...)}
+}
+
+// MissingDischarges returns the third-party caveats of the primary
+// macaroon and of the discharge macaroons reachable from it which have
+// no discharge macaroon in the bundle.
+func (b *Bundle) MissingDischarges() []Caveat {
+	missing, _ := b.walk()
+	return missing
+}
+
+// UnusedDischarges returns the discharge macaroons which discharge no
+// third-party caveat reachable from the primary macaroon.
+func (b *Bundle) UnusedDischarges() []*Macaroon {
+	_, reached := b.walk()
+	var unused []*Macaroon
+	for _, d := range b.discharges {
+		if !reached[string(d.Id())] {
+			unused = append(unused, d)
+		}
+	}
+	return unused
+}
+
+// walk follows the third-party caveats from the primary macaroon. It
+// returns the caveats without discharge and the ids of the discharge
+// macaroons reached. Every discharge macaroon is visited once, so
+// cyclic bundles are walked in bounded time.
+func (b *Bundle) walk() ([]Caveat, map[string]bool) {
+	var missing []Caveat
+	reached := make(map[string]bool)
+	queue := []*Macaroon{b.primary}
+	for len(queue) > 0 {
+		m := queue[0]
+		queue = queue[1:]
+		for _, cav := range m.caveats {
+			if !cav.IsThirdParty() {
+				continue
+			}
+			d, ok := b.byId[string(cav.Id)]
+			if !ok {
+				missing = append(missing, cav)
+				continue
+			}
+			if !reached[string(cav.Id)] {
+				reached[string(cav.Id)] = true
+				queue = append(queue, d)
+			}
+		}
+	}
+	return missing, reached
+}
+
+// OperationChecker checks a caveat condition as Context.ProcessOperation
+// does.
+type OperationChecker func(op []byte) error
+
+// Context returns a Context which verifies the bundle. Signatures are
+// verified by verify, which may be the VerifySignature method of a
+// VerifierRegistry or a ResolverContext, and caveat conditions are
+// checked by check. A nil check rejects every condition.
+func (b *Bundle) Context(verify SignatureVerifier, check OperationChecker) *BundleContext {
+	return &BundleContext{
+		bundle: b,
+		verify: verify,
+		check:  check,
+	}
+}
+
+// BundleContext is a Context which looks discharge macaroons up in a
+// Bundle. It implements DischargeSupplier, so verification fails if any
+// discharge macaroon of the bundle is not used.
+type BundleContext struct {
+	bundle *Bundle
+	verify SignatureVerifier
+	check  OperationChecker
+}
+
+func (c *BundleContext) VerifySignature(m *Macaroon) error {
+	if c.verify == nil {
+		return fmt.Errorf("no signature verifier")
+	}
+	return c.verify(m)
+}
+
+func (c *BundleContext) GetDischargeMacaroon(caveat *Caveat) (*Macaroon, error) {
+	d, ok := c.bundle.Discharge(caveat.Id)
+	if !ok {
+		return nil, fmt.Errorf("no discharge macaroon for caveat %q", caveat.Id)
+	}
+	return d, nil
+}
+
+func (c *BundleContext) ProcessOperation(op []byte) error {
+	if c.check == nil {
+		return fmt.Errorf("condition %q is not checked", op)
+	}
+	return c.check(op)
+}
+
+// SuppliedDischarges implements DischargeSupplier.
+func (c *BundleContext) SuppliedDischarges() []*Macaroon {
+	return c.bundle.discharges
+}
@@ -0,0 +1,145 @@
+package macaroon_pass
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func checkOperations(ops ...string) OperationChecker {
+	return func(op []byte) error {
+		for _, o := range ops {
+			if o == string(op) {
+				return nil
+			}
+		}
+		return fmt.Errorf("operation %q is not allowed", op)
+	}
+}
+
+func TestBundleVerify(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	data, err := MarshalBinary(&MacaroonSlice{[]*Macaroon{m, d}})
+	c.Assert(err, qt.IsNil)
+
+	s, err := UnmarshalBinary(data)
+	c.Assert(err, qt.IsNil)
+	b, err := NewBundleFromSlice(s)
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.Primary().Equal(m), qt.IsTrue)
+	c.Assert(b.Discharges(), qt.HasLen, 1)
+	dm, ok := b.Discharge([]byte("das ok"))
+	c.Assert(ok, qt.IsTrue)
+	c.Assert(dm.Equal(d), qt.IsTrue)
+	c.Assert(b.MissingDischarges(), qt.HasLen, 0)
+	c.Assert(b.UnusedDischarges(), qt.HasLen, 0)
+
+	data1, err := MarshalBinary(b.Slice())
+	c.Assert(err, qt.IsNil)
+	c.Assert(data1, qt.DeepEquals, data)
+
+	verify := NewResolverContext(r, nil).VerifySignature
+	ctx := b.Context(verify, checkOperations("amount 100", "das ok", "merchant 4711"))
+	c.Assert(VerifyMacaroon(b.Primary(), ctx, [][]byte{[]byte("invoice 1")}), qt.IsNil)
+
+	ctx = b.Context(verify, checkOperations("amount 100", "das ok"))
+	err = VerifyMacaroon(b.Primary(), ctx, [][]byte{[]byte("invoice 1")})
+	c.Assert(err, qt.ErrorMatches, `condition is not met merchant 4711: operation "merchant 4711" is not allowed`)
+
+	ctx = b.Context(verify, nil)
+	err = VerifyMacaroon(b.Primary(), ctx, [][]byte{[]byte("invoice 1")})
+	c.Assert(err, qt.ErrorMatches, `condition is not met amount 100: condition "amount 100" is not checked`)
+
+	// A registry can verify the signatures as well.
+	registry := NewVerifierRegistry()
+	registry.Register(AlgorithmUnknown, verify)
+	ctx = b.Context(registry.VerifySignature, checkOperations("amount 100", "das ok", "merchant 4711"))
+	c.Assert(VerifyMacaroon(b.Primary(), ctx, [][]byte{[]byte("invoice 1")}), qt.IsNil)
+}
+
+func TestBundleMissingAndUnusedDischarges(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	verify := NewResolverContext(r, nil).VerifySignature
+	check := checkOperations("amount 100", "das ok", "merchant 4711")
+
+	b, err := NewBundle(m)
+	c.Assert(err, qt.IsNil)
+	missing := b.MissingDischarges()
+	c.Assert(missing, qt.HasLen, 1)
+	c.Assert(string(missing[0].Id), qt.Equals, "das ok")
+	c.Assert(missing[0].Location, qt.Equals, "das")
+	err = VerifyMacaroon(b.Primary(), b.Context(verify, check), nil)
+	c.Assert(err, qt.ErrorMatches, `macaroon verification error: no discharge macaroon for caveat "das ok"`)
+	c.Assert(errors.Is(err, ErrDischarge), qt.IsTrue)
+
+	extra := emitHmacMacaroon(c, MakeKey([]byte("other key")), []byte("other"), "merchant 4711")
+	b, err = NewBundle(m, extra, d)
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.MissingDischarges(), qt.HasLen, 0)
+	unused := b.UnusedDischarges()
+	c.Assert(unused, qt.HasLen, 1)
+	c.Assert(unused[0], qt.Equals, extra)
+	err = VerifyMacaroon(b.Primary(), b.Context(verify, check), nil)
+	c.Assert(err, qt.ErrorMatches, `macaroon verification error: discharge macaroon "other" was not used`)
+	c.Assert(errors.Is(err, ErrDischarge), qt.IsTrue)
+}
+
+func TestBundleContextWrapped(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	verify := NewResolverContext(r, nil).VerifySignature
+	check := checkOperations("amount 100", "das ok", "merchant 4711")
+	extra := emitHmacMacaroon(c, MakeKey([]byte("other key")), []byte("other"), "merchant 4711")
+	b, err := NewBundle(m, extra, d)
+	c.Assert(err, qt.IsNil)
+
+	// Unused discharges are found behind wrapping contexts too.
+	for _, ctx := range []Context{
+		NewDisclosureContext(b.Context(verify, check), nil),
+		NewHolderContext(b.Context(verify, check), nil, nil),
+		NewDisclosureContext(NewHolderContext(b.Context(verify, check), nil, nil), nil),
+	} {
+		err = VerifyMacaroon(m, ctx, nil)
+		c.Assert(err, qt.ErrorMatches, `macaroon verification error: discharge macaroon "other" was not used`)
+	}
+}
+
+func TestBundleCycle(t *testing.T) {
+	c := qt.New(t)
+	m, _, r := newCheckerTest(c)
+	signer, err := NewHmacSha256Signer(MakeKey([]byte("das key")))
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, []byte("das ok"))
+	c.Assert(emt.DelegateAuthorization([]byte("das ok"), "das", []byte("nonce")), qt.IsNil)
+	self, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	self.Bind(m.Signature())
+
+	b, err := NewBundle(m, self)
+	c.Assert(err, qt.IsNil)
+	c.Assert(b.MissingDischarges(), qt.HasLen, 0)
+	c.Assert(b.UnusedDischarges(), qt.HasLen, 0)
+	ctx := b.Context(NewResolverContext(r, nil).VerifySignature, checkOperations("amount 100", "das ok"))
+	err = VerifyMacaroon(b.Primary(), ctx, nil)
+	c.Assert(err, qt.ErrorMatches, "macaroon verification error: discharge macaroon forms a cycle")
+}
+
+func TestNewBundleErrors(t *testing.T) {
+	c := qt.New(t)
+	m, d, _ := newCheckerTest(c)
+
+	_, err := NewBundle(nil)
+	c.Assert(err, qt.ErrorMatches, "no primary macaroon was passed when create bundle")
+	_, err = NewBundle(m, d, d.Clone())
+	c.Assert(err, qt.ErrorMatches, `duplicate discharge macaroon "das ok"`)
+	_, err = NewBundleFromSlice(&MacaroonSlice{})
+	c.Assert(err, qt.ErrorMatches, "no macaroons were passed when create bundle")
+	s, err := UnmarshalBinary(nil)
+	c.Assert(err, qt.IsNil)
+	_, err = NewBundleFromSlice(s)
+	c.Assert(err, qt.ErrorMatches, "no macaroons were passed when create bundle")
+}
@@ -0,0 +1,217 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Payment cards compute the HMAC SHA256 chain of a macaroon on-chip, so
+// that the card key never leaves the card. CardSigner drives such a card
+// with APDU-style commands and CardSimulator implements the same command
+// set in software.
+//
+// Command APDUs have the form CLA INS P1 P2 Lc data, with P1 and P2 set
+// to zero and at most 255 bytes of data. Longer data is split over
+// several commands, all but the last with the chaining bit set in CLA.
+// Responses hold the response data followed by the status word SW1 SW2.
+//
+//  - GET ID returns the card id, which is the macaroon id.
+//  - INIT starts a macaroon with the id in the data and returns the base
+//    signature HMAC(key, id).
+//  - CAVEAT adds a caveat, whose verification id and caveat id are
+//    concatenated in the data, and returns the new signature.
+//  - SIGN DATA returns HMAC(sig, data) for the current signature sig, as
+//    used for the verification id of a third-party caveat.
+
+const (
+	cardCla         = 0x80
+	cardClaChaining = 0x10
+
+	cardInsGetId    = 0x10
+	cardInsInit     = 0x20
+	cardInsCaveat   = 0x22
+	cardInsSignData = 0x24
+
+	cardMaxData = 255
+)
+
+// Status words as used in card responses.
+const (
+	cardSwOk              = 0x9000
+	cardSwWrongLength     = 0x6700
+	cardSwNotSatisfied    = 0x6985
+	cardSwWrongP1P2       = 0x6a86
+	cardSwInsNotSupported = 0x6d00
+	cardSwClaNotSupported = 0x6e00
+)
+
+// CardTransport exchanges APDUs with a card.
+type CardTransport interface {
+	// Transmit sends a command APDU and returns the response APDU.
+	Transmit(command []byte) ([]byte, error)
+}
+
+// CardSigner signs macaroons with the HMAC SHA256 chain computed by a
+// card. Like HmacSha256Signer it signs only one macaroon, and only adds
+// the caveats which were not signed yet.
+type CardSigner struct {
+	card     CardTransport
+	macaroon *Macaroon
+	nextStep int
+}
+
+func NewCardSigner(card CardTransport) *CardSigner {
+	return &CardSigner{card: card}
+}
+
+// CardId returns the id of the card, which is the id of the macaroons
+// it signs.
+func (s *CardSigner) CardId() ([]byte, error) {
+	return s.command(cardInsGetId, nil)
+}
+
+func (s *CardSigner) SignMacaroon(m *Macaroon) error {
+	if s.macaroon != nil && s.macaroon != m {
+		return fmt.Errorf("can not sign another macaroon")
+	}
+	step := s.nextStep
+	if step == 0 {
+		m.setAlgorithm(AlgorithmHmacSha256)
+		sig, err := s.command(cardInsInit, m.id)
+		if err != nil {
+			return err
+		}
+		m.sig = sig
+		step++
+	}
+	for i := step - 1; i < len(m.caveats); i++ {
+		cav := m.caveats[i]
+		data := append(append([]byte(nil), cav.VerificationId...), cav.Id...)
+		sig, err := s.command(cardInsCaveat, data)
+		if err != nil {
+			return err
+		}
+		m.sig = sig
+	}
+	s.macaroon = m
+	s.nextStep = len(m.caveats) + 1
+	return nil
+}
+
+func (s *CardSigner) SignData(data []byte) ([]byte, error) {
+	if s.macaroon == nil || s.macaroon.sig == nil {
+		return nil, fmt.Errorf("there is still no incremental signature available")
+	}
+	return s.command(cardInsSignData, data)
+}
+
+// command sends a command to the card, chaining it if needed, and
+// returns the response data.
+func (s *CardSigner) command(ins byte, data []byte) ([]byte, error) {
+	for {
+		n := len(data)
+		cla := byte(cardCla)
+		if n > cardMaxData {
+			n = cardMaxData
+			cla |= cardClaChaining
+		}
+		apdu := append([]byte{cla, ins, 0, 0, byte(n)}, data[:n]...)
+		data = data[n:]
+		resp, err := s.card.Transmit(apdu)
+		if err != nil {
+			return nil, fmt.Errorf("cannot transmit command to card: %v", err)
+		}
+		if len(resp) < 2 {
+			return nil, fmt.Errorf("card response too short")
+		}
+		sw := int(resp[len(resp)-2])<<8 | int(resp[len(resp)-1])
+		if sw != cardSwOk {
+			return nil, fmt.Errorf("card returned status %04X", sw)
+		}
+		if cla&cardClaChaining == 0 {
+			return resp[:len(resp)-2], nil
+		}
+	}
+}
+
+// CardSimulator is a software card which implements the command set
+// used by CardSigner.
+type CardSimulator struct {
+	id      []byte
+	key     *SecretKey
+	sig     []byte
+	ins     byte
+	chained []byte
+}
+
+func NewCardSimulator(id []byte, key *SecretKey) (*CardSimulator, error) {
+	if len(key.bytes()) == 0 {
+		return nil, fmt.Errorf("no key was passed when create card simulator")
+	}
+	return &CardSimulator{
+		id:  append([]byte(nil), id...),
+		key: key,
+	}, nil
+}
+
+func (c *CardSimulator) Transmit(command []byte) ([]byte, error) {
+	return c.process(command), nil
+}
+
+func cardResponse(data []byte, sw int) []byte {
+	return append(append([]byte(nil), data...), byte(sw>>8), byte(sw))
+}
+
+func (c *CardSimulator) process(command []byte) []byte {
+	if len(command) < 5 || len(command) != 5+int(command[4]) {
+		c.chained = nil
+		return cardResponse(nil, cardSwWrongLength)
+	}
+	cla, ins := command[0], command[1]
+	if cla&^cardClaChaining != cardCla {
+		c.chained = nil
+		return cardResponse(nil, cardSwClaNotSupported)
+	}
+	if command[2] != 0 || command[3] != 0 {
+		c.chained = nil
+		return cardResponse(nil, cardSwWrongP1P2)
+	}
+	if c.chained != nil && ins != c.ins {
+		c.chained = nil
+		return cardResponse(nil, cardSwNotSatisfied)
+	}
+	data := append(c.chained, command[5:]...)
+	if cla&cardClaChaining != 0 {
+		c.ins = ins
+		c.chained = data
+		if c.chained == nil {
+			c.chained = []byte{}
+		}
+		return cardResponse(nil, cardSwOk)
+	}
+	c.chained = nil
+
+	switch ins {
+	case cardInsGetId:
+		return cardResponse(c.id, cardSwOk)
+	case cardInsInit:
+		if !bytes.Equal(data, c.id) || c.key.isDestroyed() {
+			return cardResponse(nil, cardSwNotSatisfied)
+		}
+		c.sig = HmacSha256KeyedHash(c.key.bytes(), data)
+		return cardResponse(c.sig, cardSwOk)
+	case cardInsCaveat:
+		if c.sig == nil {
+			return cardResponse(nil, cardSwNotSatisfied)
+		}
+		c.sig = HmacSha256KeyedHash(c.sig, data)
+		return cardResponse(c.sig, cardSwOk)
+	case cardInsSignData:
+		if c.sig == nil {
+			return cardResponse(nil, cardSwNotSatisfied)
+		}
+		return cardResponse(HmacSha256KeyedHash(c.sig, data), cardSwOk)
+	default:
+		return cardResponse(nil, cardSwInsNotSupported)
+	}
+}
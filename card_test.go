@@ -0,0 +1,119 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// recordingCard records the commands sent to a card.
+type recordingCard struct {
+	card     CardTransport
+	commands [][]byte
+}
+
+func (r *recordingCard) Transmit(command []byte) ([]byte, error) {
+	r.commands = append(r.commands, command)
+	return r.card.Transmit(command)
+}
+
+func TestCardSignerChainsLongCommands(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("card key"))
+	card, err := NewCardSimulator([]byte("card 0001"), key)
+	c.Assert(err, qt.IsNil)
+	rec := &recordingCard{card: card}
+	signer := NewCardSigner(rec)
+
+	emt := NewEmitter(signer, []byte("card 0001"))
+	c.Assert(emt.AuthorizeOperation(bytes.Repeat([]byte("x"), 600)), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	c.Assert(HmacSha256SignatureVerify(key, m), qt.IsNil)
+
+	// INIT followed by the caveat in three chained commands.
+	c.Assert(rec.commands, qt.HasLen, 4)
+	c.Assert(rec.commands[1][:5], qt.DeepEquals, []byte{0x90, cardInsCaveat, 0, 0, 255})
+	c.Assert(rec.commands[2][:5], qt.DeepEquals, []byte{0x90, cardInsCaveat, 0, 0, 255})
+	c.Assert(rec.commands[3][:5], qt.DeepEquals, []byte{0x80, cardInsCaveat, 0, 0, 90})
+
+	// A holder adds a caveat with the HMAC chain; the card is not needed.
+	holder, err := DeriveHmacSha256Signer(m)
+	c.Assert(err, qt.IsNil)
+	emt = RecreateEmitter(holder, m)
+	c.Assert(emt.AuthorizeOperation([]byte("amount 12000")), qt.IsNil)
+	m, err = emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	c.Assert(HmacSha256SignatureVerify(key, m), qt.IsNil)
+}
+
+var cardSimulatorErrorTests = []struct {
+	about    string
+	commands [][]byte
+	sw       []byte
+}{{
+	about:    "wrong length",
+	commands: [][]byte{{0x80, cardInsGetId, 0, 0, 2, 0}},
+	sw:       []byte{0x67, 0x00},
+}, {
+	about:    "unknown class",
+	commands: [][]byte{{0x00, cardInsGetId, 0, 0, 0}},
+	sw:       []byte{0x6e, 0x00},
+}, {
+	about:    "unknown instruction",
+	commands: [][]byte{{0x80, 0x42, 0, 0, 0}},
+	sw:       []byte{0x6d, 0x00},
+}, {
+	about:    "wrong P1",
+	commands: [][]byte{{0x80, cardInsGetId, 1, 0, 0}},
+	sw:       []byte{0x6a, 0x86},
+}, {
+	about:    "caveat before init",
+	commands: [][]byte{{0x80, cardInsCaveat, 0, 0, 1, 'x'}},
+	sw:       []byte{0x69, 0x85},
+}, {
+	about:    "init with another id",
+	commands: [][]byte{{0x80, cardInsInit, 0, 0, 1, 'x'}},
+	sw:       []byte{0x69, 0x85},
+}, {
+	about: "instruction changed while chaining",
+	commands: [][]byte{
+		{0x90, cardInsSignData, 0, 0, 1, 'x'},
+		{0x80, cardInsGetId, 0, 0, 0},
+	},
+	sw: []byte{0x69, 0x85},
+}}
+
+func TestCardSimulatorErrors(t *testing.T) {
+	c := qt.New(t)
+	for i, test := range cardSimulatorErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		card, err := NewCardSimulator([]byte("card 0001"), MakeKey([]byte("card key")))
+		c.Assert(err, qt.IsNil)
+		var resp []byte
+		for _, command := range test.commands {
+			resp, err = card.Transmit(command)
+			c.Assert(err, qt.IsNil)
+		}
+		c.Assert(resp, qt.DeepEquals, test.sw)
+	}
+}
+
+func TestCardSignerErrors(t *testing.T) {
+	c := qt.New(t)
+	card, err := NewCardSimulator([]byte("card 0001"), MakeKey([]byte("card key")))
+	c.Assert(err, qt.IsNil)
+	signer := NewCardSigner(card)
+
+	_, err = signer.SignData([]byte("data"))
+	c.Assert(err, qt.ErrorMatches, "there is still no incremental signature available")
+
+	err = MustNew([]byte("card 0002"), "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, "card returned status 6985")
+
+	m := MustNew([]byte("card 0001"), "", V2)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	err = MustNew([]byte("card 0001"), "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, "can not sign another macaroon")
+}
@@ -0,0 +1,341 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+)
+
+// Chained signatures let any holder attenuate a macaroon signed with
+// an ECDSA issuer key, while verifiers only need the issuer public key.
+//
+// The issuer signs the macaroon together with the public key of a
+// fresh link key pair, and hands the link private key over inside the
+// signature. A holder adds caveats by signing them, together with the
+// previous signature and the public key of a new link key pair, with
+// the current link private key, and then replaces the link private key
+// with the new one. The link private key of a macaroon therefore only
+// allows adding caveats, while removing any of them requires a private
+// key that is no longer present in the macaroon.
+//
+// The signature field of a chained macaroon holds the following data.
+// All entries other than the version are packets as parsed by
+// parsePacketV2.
+//
+// version [1 byte]
+// (
+//	caveat count
+//	link public key
+//	signature
+//	eos
+// )+
+// link private key
+// eos
+
+const chainVersion = 1
+
+// Field constants as used in the chained signature encoding.
+const (
+	chainFieldCount     fieldType = 1
+	chainFieldPublicKey fieldType = 2
+	chainFieldSignature fieldType = 3
+	chainFieldSecret    fieldType = 4
+)
+
+var (
+	chainRootTag = []byte("macaroon-pass/chain/v1/root")
+	chainLinkTag = []byte("macaroon-pass/chain/v1/link")
+)
+
+// chainLink holds one link of a signature chain.
+type chainLink struct {
+	// count holds the number of caveats signed by the link.
+	count int
+
+	// pubKey holds the public key which signs the next link.
+	pubKey []byte
+
+	// sig holds the signature of the link.
+	sig []byte
+}
+
+type signatureChain struct {
+	links  []chainLink
+	secret []byte
+}
+
+// caveatCount returns the number of caveats signed by the chain.
+func (c *signatureChain) caveatCount() int {
+	n := 0
+	for _, link := range c.links {
+		n += link.count
+	}
+	return n
+}
+
+func (c *signatureChain) marshal() []byte {
+	data := []byte{chainVersion}
+	for _, link := range c.links {
+		data = appendPacketV2(data, packetV2{
+			fieldType: chainFieldCount,
+			data:      appendVarint(nil, link.count),
+		})
+		data = appendPacketV2(data, packetV2{
+			fieldType: chainFieldPublicKey,
+			data:      link.pubKey,
+		})
+		data = appendPacketV2(data, packetV2{
+			fieldType: chainFieldSignature,
+			data:      link.sig,
+		})
+		data = appendEOSV2(data)
+	}
+	data = appendPacketV2(data, packetV2{
+		fieldType: chainFieldSecret,
+		data:      c.secret,
+	})
+	return appendEOSV2(data)
+}
+
+func parseSignatureChain(data []byte) (*signatureChain, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("signature is nil")
+	}
+	if data[0] != chainVersion {
+		return nil, fmt.Errorf("unknown signature chain version %d", data[0])
+	}
+	data = data[1:]
+	var c signatureChain
+	for len(data) > 0 {
+		rest, section, err := parseSectionV2(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse signature chain: %v", err)
+		}
+		data = rest
+		if len(section) == 1 && section[0].fieldType == chainFieldSecret {
+			if len(data) > 0 {
+				return nil, fmt.Errorf("cannot parse signature chain: trailing data")
+			}
+			c.secret = section[0].data
+			break
+		}
+		if len(section) != 3 ||
+			section[0].fieldType != chainFieldCount ||
+			section[1].fieldType != chainFieldPublicKey ||
+			section[2].fieldType != chainFieldSignature {
+			return nil, fmt.Errorf("cannot parse signature chain: invalid link")
+		}
+		rest, count, err := parseVarint(section[0].data)
+		if err != nil || len(rest) > 0 {
+			return nil, fmt.Errorf("cannot parse signature chain: invalid caveat count")
+		}
+		c.links = append(c.links, chainLink{
+			count:  count,
+			pubKey: section[1].data,
+			sig:    section[2].data,
+		})
+	}
+	if len(c.links) == 0 || c.secret == nil {
+		return nil, fmt.Errorf("cannot parse signature chain: incomplete chain")
+	}
+	return &c, nil
+}
+
+// chainRootHash returns the digest signed by the issuer: the macaroon id,
+// the first count caveats and the public key of the first link.
+func chainRootHash(m *Macaroon, count int, pubKey []byte) []byte {
+	prefix := Macaroon{id: m.id, caveats: m.caveats[:count], algorithm: m.algorithm, boundTo: m.boundTo}
+	hash := calcMacaroonHash(&prefix)
+	return taggedHash(chainRootTag, hash[:], pubKey)
+}
+
+// chainLinkHash returns the digest signed by a link private key: the
+// previous signature, the caveats added by the holder and the public
+// key of the next link.
+func chainLinkHash(prevSig []byte, caveats []Caveat, pubKey []byte) []byte {
+	data := appendPacketV2(nil, packetV2{
+		fieldType: chainFieldSignature,
+		data:      prevSig,
+	})
+	data = appendEOSV2(data)
+	data = appendCaveatsDigestData(data, caveats)
+	data = appendEOSV2(data)
+	data = appendPacketV2(data, packetV2{
+		fieldType: chainFieldPublicKey,
+		data:      pubKey,
+	})
+	return taggedHash(chainLinkTag, data)
+}
+
+// ChainedEcdsaSigner signs macaroons with chained signatures. Created by
+// NewChainedEcdsaSigner it acts as the issuer; created by
+// DeriveChainedEcdsaSigner it lets a holder add caveats to a macaroon.
+type ChainedEcdsaSigner struct {
+	key      *SecretKey
+	macaroon *Macaroon
+}
+
+func NewChainedEcdsaSigner(key *SecretKey) *ChainedEcdsaSigner {
+	return &ChainedEcdsaSigner{key: key}
+}
+
+func DeriveChainedEcdsaSigner(m *Macaroon) (*ChainedEcdsaSigner, error) {
+	if m == nil {
+		return nil, fmt.Errorf("no macaroon was passed when derive chained ECDSA signer")
+	}
+	if len(m.sig) == 0 {
+		return nil, fmt.Errorf("can not use unsigned macaroon to derive chained ECDSA signer")
+	}
+	if _, err := parseSignatureChain(m.sig); err != nil {
+		return nil, err
+	}
+	return &ChainedEcdsaSigner{macaroon: m}, nil
+}
+
+func (s *ChainedEcdsaSigner) SignMacaroon(m *Macaroon) error {
+	if s.key != nil {
+		return s.signRoot(m)
+	}
+	if s.macaroon != m {
+		return fmt.Errorf("can not sign another macaroon")
+	}
+	return s.attenuate(m)
+}
+
+// SignData signs data with the issuer key or, for a holder,
+// with the current link private key.
+func (s *ChainedEcdsaSigner) SignData(data []byte) ([]byte, error) {
+	var priv *secp256k1.PrivateKey
+	if s.key != nil {
+		if s.key.isDestroyed() {
+			return nil, fmt.Errorf("key was destroyed")
+		}
+		priv, _ = secp256k1.PrivKeyFromBytes(s.key.bytes())
+	} else {
+		c, err := parseSignatureChain(s.macaroon.sig)
+		if err != nil {
+			return nil, err
+		}
+		priv, _ = secp256k1.PrivKeyFromBytes(c.secret)
+	}
+	hash := sha256.Sum256(data)
+	sig, err := priv.Sign(hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot make ECDSA signature: %v", err)
+	}
+	return sig.Serialize(), nil
+}
+
+func (s *ChainedEcdsaSigner) signRoot(m *Macaroon) error {
+	if s.key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	priv, _ := secp256k1.PrivKeyFromBytes(s.key.bytes())
+	m.setAlgorithm(AlgorithmChainedEcdsa)
+	next, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return fmt.Errorf("cannot generate link key: %v", err)
+	}
+	pubKey := next.PubKey().SerializeCompressed()
+	sig, err := priv.Sign(chainRootHash(m, len(m.caveats), pubKey))
+	if err != nil {
+		return fmt.Errorf("cannot make ECDSA signature: %v", err)
+	}
+	c := signatureChain{
+		links: []chainLink{{
+			count:  len(m.caveats),
+			pubKey: pubKey,
+			sig:    sig.Serialize(),
+		}},
+		secret: next.Serialize(),
+	}
+	m.sig = c.marshal()
+	return nil
+}
+
+func (s *ChainedEcdsaSigner) attenuate(m *Macaroon) error {
+	c, err := parseSignatureChain(m.sig)
+	if err != nil {
+		return err
+	}
+	signed := c.caveatCount()
+	if signed > len(m.caveats) {
+		return fmt.Errorf("wrong chained ECDSA signer state")
+	}
+	if signed == len(m.caveats) {
+		return nil
+	}
+	next, err := secp256k1.GeneratePrivateKey()
+	if err != nil {
+		return fmt.Errorf("cannot generate link key: %v", err)
+	}
+	pubKey := next.PubKey().SerializeCompressed()
+	prev := c.links[len(c.links)-1]
+	priv, _ := secp256k1.PrivKeyFromBytes(c.secret)
+	sig, err := priv.Sign(chainLinkHash(prev.sig, m.caveats[signed:], pubKey))
+	if err != nil {
+		return fmt.Errorf("cannot make ECDSA signature: %v", err)
+	}
+	c.links = append(c.links, chainLink{
+		count:  len(m.caveats) - signed,
+		pubKey: pubKey,
+		sig:    sig.Serialize(),
+	})
+	c.secret = next.Serialize()
+	m.sig = c.marshal()
+	return nil
+}
+
+// ChainedEcdsaSignatureVerify verifies a macaroon signed by
+// ChainedEcdsaSigner against the issuer public key, including all
+// caveats added by holders.
+func ChainedEcdsaSignatureVerify(pubKey []byte, m *Macaroon) error {
+	c, err := parseSignatureChain(m.sig)
+	if err != nil {
+		return err
+	}
+	key, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return fmt.Errorf("cannot parse public key: %v", err)
+	}
+
+	signed := 0
+	var prevSig []byte
+	for i, link := range c.links {
+		if link.count > len(m.caveats)-signed {
+			return fmt.Errorf("signature chain covers more caveats than the macaroon has")
+		}
+		var hash []byte
+		if i == 0 {
+			hash = chainRootHash(m, link.count, link.pubKey)
+		} else {
+			hash = chainLinkHash(prevSig, m.caveats[signed:signed+link.count], link.pubKey)
+		}
+		sig, err := secp256k1.ParseSignature(link.sig)
+		if err != nil {
+			return fmt.Errorf("cannot parse signature: %v", err)
+		}
+		if !sig.Verify(hash, key) {
+			return fmt.Errorf("wrong signature")
+		}
+		key, err = secp256k1.ParsePubKey(link.pubKey)
+		if err != nil {
+			return fmt.Errorf("cannot parse public key: %v", err)
+		}
+		signed += link.count
+		prevSig = link.sig
+	}
+	if signed != len(m.caveats) {
+		return fmt.Errorf("wrong signature")
+	}
+
+	// The link private key must match the last link, otherwise
+	// the chain might have been truncated.
+	_, pub := secp256k1.PrivKeyFromBytes(c.secret)
+	if len(c.secret) != 32 || !bytes.Equal(pub.SerializeCompressed(), key.SerializeCompressed()) {
+		return fmt.Errorf("wrong signature")
+	}
+	return nil
+}
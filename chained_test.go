@@ -0,0 +1,120 @@
+package macaroon_pass
+
+import (
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+func newChainedTestMacaroon(c *qt.C) (*Macaroon, []byte) {
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+
+	emt := NewEmitter(NewChainedEcdsaSigner(key), []byte("Chained ECDSA"))
+	err = emt.AuthorizeOperation([]byte("payment"))
+	c.Assert(err, qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	return m, pub.SerializeCompressed()
+}
+
+func TestChainedEcdsaAttenuation(t *testing.T) {
+	c := qt.New(t)
+	m, pub := newChainedTestMacaroon(c)
+
+	err := ChainedEcdsaSignatureVerify(pub, m)
+	c.Assert(err, qt.IsNil)
+
+	// The holder adds caveats without the issuer key.
+	signer, err := DeriveChainedEcdsaSigner(m)
+	c.Assert(err, qt.IsNil)
+	emt := RecreateEmitter(signer, m)
+	err = emt.AuthorizeOperation([]byte("amount 12000"))
+	c.Assert(err, qt.IsNil)
+	m1, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	c.Assert(m1.Caveats(), qt.HasLen, 2)
+
+	data, err := MarshalBinary(&MacaroonSlice{[]*Macaroon{m1}})
+	c.Assert(err, qt.IsNil)
+	u, err := UnmarshalBinary(data)
+	c.Assert(err, qt.IsNil)
+	m2, err := u.Get(0)
+	c.Assert(err, qt.IsNil)
+
+	err = ChainedEcdsaSignatureVerify(pub, m2)
+	c.Assert(err, qt.IsNil)
+
+	// And the next holder attenuates it again.
+	signer, err = DeriveChainedEcdsaSigner(m2)
+	c.Assert(err, qt.IsNil)
+	err = m2.AddFirstPartyCaveat([]byte("merchant 42"))
+	c.Assert(err, qt.IsNil)
+	err = m2.Sign(signer)
+	c.Assert(err, qt.IsNil)
+	err = ChainedEcdsaSignatureVerify(pub, m2)
+	c.Assert(err, qt.IsNil)
+
+	chain, err := parseSignatureChain(m2.Signature())
+	c.Assert(err, qt.IsNil)
+	c.Assert(chain.links, qt.HasLen, 3)
+}
+
+func TestChainedEcdsaRejectsRemovedCaveats(t *testing.T) {
+	c := qt.New(t)
+	m, pub := newChainedTestMacaroon(c)
+	root := m.Clone()
+
+	signer, err := DeriveChainedEcdsaSigner(m)
+	c.Assert(err, qt.IsNil)
+	err = m.AddFirstPartyCaveat([]byte("amount 12000"))
+	c.Assert(err, qt.IsNil)
+	err = m.Sign(signer)
+	c.Assert(err, qt.IsNil)
+
+	// Dropping the holder's caveat without its link.
+	m1 := m.Clone()
+	m1.caveats = m1.caveats[:1]
+	err = ChainedEcdsaSignatureVerify(pub, m1)
+	c.Assert(err, qt.ErrorMatches, "signature chain covers more caveats than the macaroon has")
+
+	// Dropping the holder's caveat together with its link, but
+	// keeping the new link private key.
+	chain, err := parseSignatureChain(m.Signature())
+	c.Assert(err, qt.IsNil)
+	chain.links = chain.links[:1]
+	m1.SetSignature(chain.marshal())
+	err = ChainedEcdsaSignatureVerify(pub, m1)
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+
+	// Changing a caveat signed by a holder.
+	m2 := m.Clone()
+	m2.caveats = append([]Caveat{m2.caveats[0]}, Caveat{Id: []byte("amount 99999")})
+	err = ChainedEcdsaSignatureVerify(pub, m2)
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+
+	// The untouched issuer macaroon still verifies.
+	err = ChainedEcdsaSignatureVerify(pub, root)
+	c.Assert(err, qt.IsNil)
+
+	// A different issuer key is rejected.
+	_, other := newChainedTestMacaroon(c)
+	err = ChainedEcdsaSignatureVerify(other, m)
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+}
+
+func TestDeriveChainedEcdsaSigner(t *testing.T) {
+	c := qt.New(t)
+	_, err := DeriveChainedEcdsaSigner(nil)
+	c.Assert(err, qt.ErrorMatches, "no macaroon was passed when derive chained ECDSA signer")
+
+	m := MustNew([]byte("Chained ECDSA"), "", V2)
+	_, err = DeriveChainedEcdsaSigner(m)
+	c.Assert(err, qt.ErrorMatches, "can not use unsigned macaroon to derive chained ECDSA signer")
+
+	m.SetSignature([]byte{0, 1, 2})
+	_, err = DeriveChainedEcdsaSigner(m)
+	c.Assert(err, qt.ErrorMatches, "unknown signature chain version 0")
+}
@@ -2,9 +2,20 @@ package macaroon_pass
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 )
 
+// Context verifies the signatures and the caveats of a macaroon. The
+// discharge macaroons returned by GetDischargeMacaroon are passed to
+// VerifySignature bound to the signature of the primary macaroon, as
+// reported by Macaroon.BoundTo, so that discharges signed for another
+// macaroon are rejected. A discharge macaroon whose signature also
+// verifies unbound is rejected as well.
+//
+// A Context which wraps another one should have an Unwrap method which
+// returns it, as HolderContext does, so that the optional interfaces of
+// the wrapped Context are still found.
 type Context interface {
 	VerifySignature (macaroon *Macaroon) error
 	GetDischargeMacaroon (caveat *Caveat) (*Macaroon, error)
@@ -14,66 +25,347 @@ type Context interface {
 type Operation struct {
 	Value      []byte
 	Authorized bool
+
+	// MacaroonId and CaveatIndex locate the caveat the operation
+	// comes from.
+	MacaroonId  []byte
+	CaveatIndex int
+}
+
+// Kinds of verification failures, as reported by VerificationError.
+// Use errors.Is to test for them.
+var (
+	// ErrSignature means that the signature of a macaroon is wrong.
+	ErrSignature = errors.New("wrong macaroon signature")
+
+	// ErrDischarge means that no discharge macaroon was found for a
+	// third-party caveat.
+	ErrDischarge = errors.New("missing discharge macaroon")
+
+	// ErrOperation means that a requested operation is not granted by
+	// any caveat.
+	ErrOperation = errors.New("operation not granted")
+
+	// ErrCondition means that the Context rejected a caveat condition.
+	ErrCondition = errors.New("condition not met")
+)
+
+// VerificationError describes why VerifyMacaroon failed.
+type VerificationError struct {
+	// Kind is one of ErrSignature, ErrDischarge, ErrOperation and
+	// ErrCondition.
+	Kind error
+
+	// MacaroonId holds the id of the failing macaroon, which may be a
+	// discharge macaroon. It is nil for ErrOperation.
+	MacaroonId []byte
+
+	// CaveatIndex holds the index of the failing caveat in the failing
+	// macaroon, or -1 if the failure is not about a caveat.
+	CaveatIndex int
+
+	// Operation holds the failing caveat condition or requested
+	// operation, if any.
+	Operation []byte
+
+	// Err holds the underlying error, if any.
+	Err error
+}
+
+func (e *VerificationError) Error() string {
+	switch e.Kind {
+	case ErrCondition:
+		return fmt.Sprintf("condition is not met %s: %v", string(e.Operation), e.Err)
+	case ErrOperation:
+		return fmt.Sprintf("macaroon verification error: %s", string(e.Operation))
+	}
+	return fmt.Sprintf("macaroon verification error: %v", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *VerificationError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the kind of the error.
+func (e *VerificationError) Is(target error) bool {
+	return e.Kind == target
+}
+
+// VerificationResult describes a successful verification.
+type VerificationResult struct {
+	// Granted holds the caveats which granted the requested
+	// operations.
+	Granted []Operation
+
+	// Checked holds the caveat conditions accepted by the Context.
+	Checked []Operation
+}
+
+// DefaultMaxDelegationDepth is the deepest nesting of discharge
+// macaroons accepted by VerifyMacaroon and CheckMacaroon.
+const DefaultMaxDelegationDepth = 8
+
+// DischargeSupplier is implemented by contexts which know all the
+// discharge macaroons supplied with the primary macaroon. Verification
+// then fails if any of them is not used.
+type DischargeSupplier interface {
+	// SuppliedDischarges returns the supplied discharge macaroons.
+	SuppliedDischarges() []*Macaroon
+}
+
+// contextWrapper is implemented by contexts which wrap another Context,
+// such as HolderContext. The optional interfaces of a Context, like
+// DischargeSupplier and Discloser, are looked up along the chain of
+// wrapped contexts, so that wrapping does not hide them.
+type contextWrapper interface {
+	Unwrap() Context
+}
+
+// findDischargeSupplier returns the first context of the chain of
+// wrapped contexts which implements DischargeSupplier, if any.
+func findDischargeSupplier(ctx Context) (DischargeSupplier, bool) {
+	for ctx != nil {
+		if s, ok := ctx.(DischargeSupplier); ok {
+			return s, true
+		}
+		w, ok := ctx.(contextWrapper)
+		if !ok {
+			break
+		}
+		ctx = w.Unwrap()
+	}
+	return nil, false
+}
+
+// findDiscloser returns the first context of the chain of wrapped
+// contexts which implements Discloser, if any.
+func findDiscloser(ctx Context) (Discloser, bool) {
+	for ctx != nil {
+		if d, ok := ctx.(Discloser); ok {
+			return d, true
+		}
+		w, ok := ctx.(contextWrapper)
+		if !ok {
+			break
+		}
+		ctx = w.Unwrap()
+	}
+	return nil, false
+}
+
+// Checker verifies macaroons with configurable limits. The zero Checker
+// verifies like VerifyMacaroon.
+//
+// Every discharge macaroon must have the id of the third-party caveat it
+// discharges and may be used for one caveat only, so a discharge which
+// refers back to itself or to the primary macaroon is rejected.
+type Checker struct {
+	// MaxDelegationDepth limits the nesting of discharge macaroons.
+	// Discharges of the primary macaroon are at depth 1, their
+	// discharges at depth 2 and so on. Zero means
+	// DefaultMaxDelegationDepth.
+	MaxDelegationDepth int
 }
 
 func VerifyMacaroon(macaroon *Macaroon, context Context, rawOperations [][]byte) error {
-	mOps, err := processMacaroon(macaroon, context)
+	return (&Checker{}).VerifyMacaroon(macaroon, context, rawOperations)
+}
+
+// CheckMacaroon verifies the macaroon like VerifyMacaroon, and returns
+// which caveats granted the requested operations and which conditions
+// were checked. Errors are of type *VerificationError.
+func CheckMacaroon(macaroon *Macaroon, context Context, rawOperations [][]byte) (*VerificationResult, error) {
+	return (&Checker{}).CheckMacaroon(macaroon, context, rawOperations)
+}
+
+// VerifyMacaroon verifies the macaroon like the VerifyMacaroon function,
+// with the limits of the checker.
+func (ch *Checker) VerifyMacaroon(macaroon *Macaroon, context Context, rawOperations [][]byte) error {
+	_, err := ch.CheckMacaroon(macaroon, context, rawOperations)
+	return err
+}
+
+// CheckMacaroon verifies the macaroon like the CheckMacaroon function,
+// with the limits of the checker.
+func (ch *Checker) CheckMacaroon(macaroon *Macaroon, context Context, rawOperations [][]byte) (*VerificationResult, error) {
+	v := &verification{
+		context:  context,
+		maxDepth: ch.MaxDelegationDepth,
+		path:     make(map[string]bool),
+		used:     make(map[string]bool),
+	}
+	if v.maxDepth <= 0 {
+		v.maxDepth = DefaultMaxDelegationDepth
+	}
+	mOps, err := v.processMacaroon(macaroon, 0)
 	if err != nil {
-		return fmt.Errorf("macaroon verification error: %v", err)
+		return nil, err
+	}
+	if supplier, ok := findDischargeSupplier(context); ok {
+		for _, d := range supplier.SuppliedDischarges() {
+			if !v.used[string(d.Id())] {
+				return nil, &VerificationError{
+					Kind:        ErrDischarge,
+					MacaroonId:  d.Id(),
+					CaveatIndex: -1,
+					Err:         fmt.Errorf("discharge macaroon %q was not used", d.Id()),
+				}
+			}
+			// A second discharge with the same id is not used either.
+			delete(v.used, string(d.Id()))
+		}
 	}
+	var result VerificationResult
 	for _, rawOp := range rawOperations {
 		found := false
 		for i, _ := range mOps {
 			if bytes.Equal(mOps[i].Value, rawOp) {
 				found = true
 				mOps[i].Authorized = true
+				result.Granted = append(result.Granted, mOps[i])
 				break
 			}
 		}
 		if !found {
-			return fmt.Errorf("macaroon verification error: %s" , string(rawOp))
+			return nil, &VerificationError{
+				Kind:        ErrOperation,
+				CaveatIndex: -1,
+				Operation:   rawOp,
+			}
 		}
 		
 	}
 	for _, op := range mOps {
-		if !op.Authorized {
+		// Holder key caveats are never satisfied by the requested
+		// operations, as the holder must prove possession of the key.
+		if !op.Authorized || isHolderKeyCaveat(op.Value) {
 			err = context.ProcessOperation(op.Value)
 			if err != nil {
-				return fmt.Errorf("condition is not met %s: %v", string(op.Value), err)
+				return nil, &VerificationError{
+					Kind:        ErrCondition,
+					MacaroonId:  op.MacaroonId,
+					CaveatIndex: op.CaveatIndex,
+					Operation:   op.Value,
+					Err:         err,
+				}
 			}
+			result.Checked = append(result.Checked, op)
 		}
 	}
-	return nil
+	return &result, nil
+}
+
+// signatureError reports a wrong signature of the macaroon.
+func signatureError(m *Macaroon, err error) error {
+	return &VerificationError{
+		Kind:        ErrSignature,
+		MacaroonId:  m.Id(),
+		CaveatIndex: -1,
+		Err:         err,
+	}
 }
 
-func processMacaroon(macaroon *Macaroon, context Context) ([]Operation, error) {
+// verification holds the state of a single verification.
+type verification struct {
+	context  Context
+	maxDepth int
+
+	// rootSig holds the signature of the primary macaroon, which the
+	// discharge macaroons must be bound to.
+	rootSig []byte
+
+	// path holds the ids of the macaroons being processed and used the
+	// ids of the discharge macaroons used so far.
+	path map[string]bool
+	used map[string]bool
+}
+
+// processMacaroon verifies the macaroon and, recursively, its discharges.
+// depth is 0 for the primary macaroon.
+func (v *verification) processMacaroon(macaroon *Macaroon, depth int) ([]Operation, error) {
+	context := v.context
 	err := context.VerifySignature(macaroon)
 	if err != nil {
-		return nil, err
+		return nil, signatureError(macaroon, err)
 	}
-	
+	if macaroon.boundTo != nil {
+		// A Context which ignores the binding would accept a discharge
+		// macaroon signed for any primary macaroon.
+		unbound := macaroon.Clone()
+		unbound.boundTo = nil
+		if context.VerifySignature(unbound) == nil {
+			return nil, signatureError(macaroon, fmt.Errorf("discharge macaroon is not bound to the primary macaroon"))
+		}
+	}
+	if depth == 0 {
+		v.rootSig = macaroon.Signature()
+	}
+	v.path[string(macaroon.Id())] = true
+	defer delete(v.path, string(macaroon.Id()))
+
 	var operations []Operation
 	
-	for _, caveat := range macaroon.Caveats() {
-		operations = append(operations, Operation{Value: caveat.Id})
+	discloser, _ := findDiscloser(context)
+	for i, caveat := range macaroon.Caveats() {
+		value := caveat.Id
+		if discloser != nil && !caveat.IsThirdParty() && IsCaveatCommitment(value) {
+			if cond, ok := discloser.DiscloseCaveat(value); ok {
+				value = cond
+			}
+		}
+		operations = append(operations, Operation{
+			Value:       value,
+			MacaroonId:  macaroon.Id(),
+			CaveatIndex: i,
+		})
 		if caveat.IsThirdParty() {
-			dMacaroon, err := context.GetDischargeMacaroon(&caveat)
+			dMacaroon, err := v.getDischargeMacaroon(&caveat, depth+1)
 			if err == nil {
-				err = context.VerifySignature(dMacaroon)
-				if err != nil {
-					return nil, err
-				}
+				bound := dMacaroon.Clone()
+				bound.boundTo = v.rootSig
 				var addOps []Operation
-				addOps, err = processMacaroon(dMacaroon, context)
+				addOps, err = v.processMacaroon(bound, depth+1)
 				if err != nil {
 					return nil, err
 				}
 				operations = append(operations, addOps...)
 			} else {
-				return nil, err
+				return nil, &VerificationError{
+					Kind:        ErrDischarge,
+					MacaroonId:  macaroon.Id(),
+					CaveatIndex: i,
+					Operation:   caveat.Id,
+					Err:         err,
+				}
 			}
 		}
 	}
 	return operations, nil
 }
 
+// getDischargeMacaroon returns the discharge macaroon of the caveat,
+// which is used at the given depth, and records its use.
+func (v *verification) getDischargeMacaroon(caveat *Caveat, depth int) (*Macaroon, error) {
+	if depth > v.maxDepth {
+		return nil, fmt.Errorf("delegation depth exceeds %d", v.maxDepth)
+	}
+	if v.path[string(caveat.Id)] {
+		return nil, fmt.Errorf("discharge macaroon forms a cycle")
+	}
+	if v.used[string(caveat.Id)] {
+		return nil, fmt.Errorf("discharge macaroon is used more than once")
+	}
+	dMacaroon, err := v.context.GetDischargeMacaroon(caveat)
+	if err != nil {
+		return nil, err
+	}
+	if dMacaroon == nil {
+		return nil, fmt.Errorf("no discharge macaroon was returned")
+	}
+	if !bytes.Equal(dMacaroon.Id(), caveat.Id) {
+		return nil, fmt.Errorf("discharge macaroon id %q does not match caveat id", dMacaroon.Id())
+	}
+	v.used[string(caveat.Id)] = true
+	return dMacaroon, nil
+}
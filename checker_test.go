@@ -1,5 +1,13 @@
 package macaroon_pass
 
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
 //type CheckerTestSuite struct {
 //	Env Environment
 //}
@@ -12,3 +20,374 @@ package macaroon_pass
 //	c.Assert(err, check.IsNil)
 //
 //}
+
+// dischargeContext returns the discharge macaroons it holds by caveat id.
+type dischargeContext struct {
+	Context
+	discharges map[string]*Macaroon
+}
+
+func (c dischargeContext) GetDischargeMacaroon(caveat *Caveat) (*Macaroon, error) {
+	d, ok := c.discharges[string(caveat.Id)]
+	if !ok {
+		return nil, fmt.Errorf("no discharge macaroon for %q", caveat.Id)
+	}
+	return d, nil
+}
+
+func newCheckerTest(c *qt.C) (*Macaroon, *Macaroon, *Keyring) {
+	key := MakeKey([]byte("card key"))
+	dasKey := MakeKey([]byte("das key"))
+	r := NewKeyring()
+	c.Assert(r.Add(&Key{Id: "card", Selector: []byte("card 0001"), Algorithm: AlgorithmHmacSha256, Material: key.bytes()}), qt.IsNil)
+	c.Assert(r.Add(&Key{Id: "das", Selector: []byte("das ok"), Algorithm: AlgorithmHmacSha256, Material: dasKey.bytes()}), qt.IsNil)
+
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, []byte("card 0001"))
+	c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+	c.Assert(emt.AuthorizeOperation([]byte("invoice 1")), qt.IsNil)
+	c.Assert(emt.DelegateAuthorization([]byte("das ok"), "das", []byte("nonce")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	d := emitHmacMacaroon(c, dasKey, []byte("das ok"), "merchant 4711")
+	d.Bind(m.Signature())
+	return m, d, r
+}
+
+func TestCheckMacaroonResult(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	ops := operationContext{map[string]bool{"amount 100": true, "das ok": true, "merchant 4711": true}}
+	ctx := dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}
+
+	result, err := CheckMacaroon(m, ctx, [][]byte{[]byte("invoice 1")})
+	c.Assert(err, qt.IsNil)
+	c.Assert(result.Granted, qt.DeepEquals, []Operation{
+		{Value: []byte("invoice 1"), Authorized: true, MacaroonId: []byte("card 0001"), CaveatIndex: 1},
+	})
+	c.Assert(result.Checked, qt.DeepEquals, []Operation{
+		{Value: []byte("amount 100"), MacaroonId: []byte("card 0001"), CaveatIndex: 0},
+		{Value: []byte("das ok"), MacaroonId: []byte("card 0001"), CaveatIndex: 2},
+		{Value: []byte("merchant 4711"), MacaroonId: []byte("das ok"), CaveatIndex: 0},
+	})
+}
+
+func TestVerificationErrors(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	ops := operationContext{map[string]bool{"amount 100": true, "invoice 1": true, "das ok": true}}
+	ctx := dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}
+
+	tests := []struct {
+		about       string
+		m           *Macaroon
+		ctx         Context
+		ops         [][]byte
+		kind        error
+		macaroonId  string
+		caveatIndex int
+		message     string
+	}{{
+		about:       "failed caveat of a discharge macaroon",
+		m:           m,
+		ctx:         ctx,
+		kind:        ErrCondition,
+		macaroonId:  "das ok",
+		caveatIndex: 0,
+		message:     `condition is not met merchant 4711: operation "merchant 4711" is not allowed`,
+	}, {
+		about:       "missing discharge macaroon",
+		m:           m,
+		ctx:         dischargeContext{ctx.Context, nil},
+		kind:        ErrDischarge,
+		macaroonId:  "card 0001",
+		caveatIndex: 2,
+		message:     `macaroon verification error: no discharge macaroon for "das ok"`,
+	}, {
+		about:       "operation not granted",
+		m:           m,
+		ctx:         ctx,
+		ops:         [][]byte{[]byte("amount 1000")},
+		kind:        ErrOperation,
+		caveatIndex: -1,
+		message:     `macaroon verification error: amount 1000`,
+	}, {
+		about:       "wrong signature",
+		m:           emitHmacMacaroon(c, MakeKey([]byte("other key")), []byte("card 0001"), "amount 100"),
+		ctx:         ctx,
+		kind:        ErrSignature,
+		macaroonId:  "card 0001",
+		caveatIndex: -1,
+		message:     `macaroon verification error: wrong signature`,
+	}}
+	for _, test := range tests {
+		c.Logf("test %q", test.about)
+		err := VerifyMacaroon(test.m, test.ctx, test.ops)
+		c.Assert(err, qt.ErrorMatches, test.message)
+		c.Assert(errors.Is(err, test.kind), qt.IsTrue)
+		var verr *VerificationError
+		c.Assert(errors.As(err, &verr), qt.IsTrue)
+		if test.macaroonId == "" {
+			c.Assert(verr.MacaroonId, qt.IsNil)
+		} else {
+			c.Assert(string(verr.MacaroonId), qt.Equals, test.macaroonId)
+		}
+		c.Assert(verr.CaveatIndex, qt.Equals, test.caveatIndex)
+	}
+
+	// The underlying error of the Context is kept.
+	err := VerifyMacaroon(m, dischargeContext{ctx.Context, nil}, nil)
+	c.Assert(errors.Unwrap(err), qt.ErrorMatches, `no discharge macaroon for "das ok"`)
+}
+
+func TestDischargeBinding(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	ops := operationContext{map[string]bool{"amount 100": true, "invoice 1": true, "das ok": true, "merchant 4711": true}}
+	verify := func(d *Macaroon) error {
+		return VerifyMacaroon(m, dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}, nil)
+	}
+	c.Assert(verify(d), qt.IsNil)
+
+	// Verification leaves the discharge macaroon unchanged.
+	c.Assert(d.boundTo, qt.IsNil)
+
+	unbound := emitHmacMacaroon(c, MakeKey([]byte("das key")), []byte("das ok"), "merchant 4711")
+	err := verify(unbound)
+	c.Assert(err, qt.ErrorMatches, "macaroon verification error: wrong signature")
+	c.Assert(errors.Is(err, ErrSignature), qt.IsTrue)
+	var verr *VerificationError
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(string(verr.MacaroonId), qt.Equals, "das ok")
+
+	// A discharge bound to another macaroon is rejected.
+	other := unbound.Clone()
+	other.Bind(emitHmacMacaroon(c, MakeKey([]byte("card key")), []byte("card 0001"), "amount 1").Signature())
+	c.Assert(verify(other), qt.ErrorMatches, "macaroon verification error: wrong signature")
+
+	// SignBound binds MAC discharges like Bind.
+	signer, err := NewHmacSha256Signer(MakeKey([]byte("das key")))
+	c.Assert(err, qt.IsNil)
+	d1 := MustNew([]byte("das ok"), "", V2)
+	c.Assert(d1.AddFirstPartyCaveat([]byte("merchant 4711")), qt.IsNil)
+	c.Assert(d1.SignBound(signer, m.Signature()), qt.IsNil)
+	c.Assert(d1.Signature(), qt.DeepEquals, d.Signature())
+	c.Assert(verify(d1), qt.IsNil)
+}
+
+// unboundContext verifies discharge macaroons while ignoring
+// Macaroon.BoundTo, as a careless Context outside the package might.
+type unboundContext struct {
+	*ResolverContext
+	discharges map[string]*Macaroon
+}
+
+func (c unboundContext) VerifySignature(m *Macaroon) error {
+	m = m.Clone()
+	m.boundTo = nil
+	return c.ResolverContext.VerifySignature(m)
+}
+
+func (c unboundContext) GetDischargeMacaroon(caveat *Caveat) (*Macaroon, error) {
+	return dischargeContext{nil, c.discharges}.GetDischargeMacaroon(caveat)
+}
+
+func TestDischargeBindingRequired(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	ops := operationContext{map[string]bool{"amount 100": true, "invoice 1": true, "das ok": true, "merchant 4711": true}}
+
+	// The bound discharge verifies as usual.
+	ctx := dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}
+	c.Assert(VerifyMacaroon(m, ctx, nil), qt.IsNil)
+
+	// The unbound one is rejected even though the Context accepts it.
+	unbound := emitHmacMacaroon(c, MakeKey([]byte("das key")), []byte("das ok"), "merchant 4711")
+	uctx := unboundContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": unbound}}
+	c.Assert(uctx.VerifySignature(unbound), qt.IsNil)
+	err := VerifyMacaroon(m, uctx, nil)
+	c.Assert(err, qt.ErrorMatches, "macaroon verification error: discharge macaroon is not bound to the primary macaroon")
+	c.Assert(errors.Is(err, ErrSignature), qt.IsTrue)
+}
+
+func TestEcdsaDischargeBinding(t *testing.T) {
+	c := qt.New(t)
+	m, _, r := newCheckerTest(c)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	signer := NewEcdsaSigner(key)
+	c.Assert(r.Remove("das"), qt.IsNil)
+	c.Assert(r.Add(&Key{Id: "das", Selector: []byte("das ok"), Algorithm: AlgorithmEcdsa, Material: signer.PublicKey()}), qt.IsNil)
+	ops := operationContext{map[string]bool{"amount 100": true, "invoice 1": true, "das ok": true, "merchant 4711": true}}
+	verify := func(d *Macaroon) error {
+		return VerifyMacaroon(m, dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}, nil)
+	}
+
+	d := MustNew([]byte("das ok"), "", V2)
+	c.Assert(d.AddFirstPartyCaveat([]byte("merchant 4711")), qt.IsNil)
+	c.Assert(d.SignBound(signer, m.Signature()), qt.IsNil)
+	c.Assert(d.Algorithm(), qt.Equals, AlgorithmEcdsa)
+	c.Assert(verify(d), qt.IsNil)
+
+	// The signature covers the primary signature, so the discharge
+	// does not verify on its own, nor when bound to another macaroon.
+	c.Assert(EcdsaSignatureVerify(signer.PublicKey(), d), qt.ErrorMatches, "wrong signature")
+	other := MustNew([]byte("das ok"), "", V2)
+	c.Assert(other.AddFirstPartyCaveat([]byte("merchant 4711")), qt.IsNil)
+	c.Assert(other.SignBound(signer, []byte("another signature")), qt.IsNil)
+	c.Assert(verify(other), qt.ErrorMatches, "macaroon verification error: wrong signature")
+
+	unbound := MustNew([]byte("das ok"), "", V2)
+	c.Assert(unbound.AddFirstPartyCaveat([]byte("merchant 4711")), qt.IsNil)
+	c.Assert(unbound.Sign(signer), qt.IsNil)
+	c.Assert(verify(unbound), qt.ErrorMatches, "macaroon verification error: wrong signature")
+}
+
+// suppliedContext reports the discharge macaroons it holds as supplied.
+type suppliedContext struct {
+	dischargeContext
+	supplied []*Macaroon
+}
+
+func (c suppliedContext) SuppliedDischarges() []*Macaroon {
+	return c.supplied
+}
+
+// newDelegationChain returns a primary macaroon whose discharge
+// macaroons are nested depth deep, and a context holding them.
+func newDelegationChain(c *qt.C, depth int) (*Macaroon, dischargeContext) {
+	r := NewKeyring()
+	ops := operationContext{make(map[string]bool)}
+	ctx := dischargeContext{NewResolverContext(r, ops), make(map[string]*Macaroon)}
+	var primary *Macaroon
+	for i := 0; i <= depth; i++ {
+		id := fmt.Sprintf("level %d", i)
+		key := MakeKey([]byte("key " + id))
+		c.Assert(r.Add(&Key{Id: id, Selector: []byte(id), Algorithm: AlgorithmHmacSha256, Material: key.bytes()}), qt.IsNil)
+		ops.ops[id] = true
+
+		signer, err := NewHmacSha256Signer(key)
+		c.Assert(err, qt.IsNil)
+		emt := NewEmitter(signer, []byte(id))
+		if i < depth {
+			next := fmt.Sprintf("level %d", i+1)
+			c.Assert(emt.DelegateAuthorization([]byte(next), "das", []byte("nonce")), qt.IsNil)
+		}
+		m, err := emt.EmitMacaroon()
+		c.Assert(err, qt.IsNil)
+		if i == 0 {
+			primary = m
+		} else {
+			m.Bind(primary.Signature())
+			ctx.discharges[id] = m
+		}
+	}
+	return primary, ctx
+}
+
+func TestDelegationDepth(t *testing.T) {
+	c := qt.New(t)
+	m, ctx := newDelegationChain(c, DefaultMaxDelegationDepth)
+	c.Assert(VerifyMacaroon(m, ctx, nil), qt.IsNil)
+
+	m, ctx = newDelegationChain(c, DefaultMaxDelegationDepth+1)
+	err := VerifyMacaroon(m, ctx, nil)
+	c.Assert(err, qt.ErrorMatches, "macaroon verification error: delegation depth exceeds 8")
+	c.Assert(errors.Is(err, ErrDischarge), qt.IsTrue)
+	var verr *VerificationError
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(string(verr.MacaroonId), qt.Equals, "level 8")
+	c.Assert(verr.CaveatIndex, qt.Equals, 0)
+
+	ch := &Checker{MaxDelegationDepth: 2}
+	m, ctx = newDelegationChain(c, 2)
+	c.Assert(ch.VerifyMacaroon(m, ctx, nil), qt.IsNil)
+	m, ctx = newDelegationChain(c, 3)
+	c.Assert(ch.VerifyMacaroon(m, ctx, nil), qt.ErrorMatches, "macaroon verification error: delegation depth exceeds 2")
+}
+
+func TestDischargeCycle(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	ops := operationContext{map[string]bool{"amount 100": true, "invoice 1": true, "das ok": true, "merchant 4711": true}}
+
+	// The discharge macaroon delegates to itself.
+	signer, err := NewHmacSha256Signer(MakeKey([]byte("das key")))
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, []byte("das ok"))
+	c.Assert(emt.DelegateAuthorization([]byte("das ok"), "das", []byte("nonce")), qt.IsNil)
+	self, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	self.Bind(m.Signature())
+	err = VerifyMacaroon(m, dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": self}}, nil)
+	c.Assert(err, qt.ErrorMatches, "macaroon verification error: discharge macaroon forms a cycle")
+	c.Assert(errors.Is(err, ErrDischarge), qt.IsTrue)
+	var verr *VerificationError
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(string(verr.MacaroonId), qt.Equals, "das ok")
+
+	// The discharge macaroon delegates back to the primary macaroon.
+	signer, err = NewHmacSha256Signer(MakeKey([]byte("das key")))
+	c.Assert(err, qt.IsNil)
+	emt = NewEmitter(signer, []byte("das ok"))
+	c.Assert(emt.DelegateAuthorization([]byte("card 0001"), "das", []byte("nonce")), qt.IsNil)
+	back, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	back.Bind(m.Signature())
+	ctx := dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": back, "card 0001": m}}
+	c.Assert(VerifyMacaroon(m, ctx, nil), qt.ErrorMatches, "macaroon verification error: discharge macaroon forms a cycle")
+
+	// The discharge macaroon must have the id of the caveat.
+	ctx = dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": m}}
+	c.Assert(VerifyMacaroon(m, ctx, nil), qt.ErrorMatches, `macaroon verification error: discharge macaroon id "card 0001" does not match caveat id`)
+
+	c.Assert(VerifyMacaroon(m, dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}, nil), qt.IsNil)
+}
+
+func TestDischargeUsedOnce(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("card key"))
+	r := NewKeyring()
+	c.Assert(r.Add(&Key{Id: "card", Selector: []byte("card 0001"), Algorithm: AlgorithmHmacSha256, Material: key.bytes()}), qt.IsNil)
+	c.Assert(r.Add(&Key{Id: "das", Selector: []byte("das ok"), Algorithm: AlgorithmHmacSha256, Material: MakeKey([]byte("das key")).bytes()}), qt.IsNil)
+	ops := operationContext{map[string]bool{"das ok": true, "merchant 4711": true}}
+
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, []byte("card 0001"))
+	c.Assert(emt.DelegateAuthorization([]byte("das ok"), "das", []byte("nonce 1")), qt.IsNil)
+	c.Assert(emt.DelegateAuthorization([]byte("das ok"), "das", []byte("nonce 2")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	d := emitHmacMacaroon(c, MakeKey([]byte("das key")), []byte("das ok"), "merchant 4711")
+	d.Bind(m.Signature())
+
+	err = VerifyMacaroon(m, dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}, nil)
+	c.Assert(err, qt.ErrorMatches, "macaroon verification error: discharge macaroon is used more than once")
+	var verr *VerificationError
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(verr.CaveatIndex, qt.Equals, 1)
+}
+
+func TestUnusedDischarge(t *testing.T) {
+	c := qt.New(t)
+	m, d, r := newCheckerTest(c)
+	ops := operationContext{map[string]bool{"amount 100": true, "invoice 1": true, "das ok": true, "merchant 4711": true}}
+	ctx := dischargeContext{NewResolverContext(r, ops), map[string]*Macaroon{"das ok": d}}
+
+	c.Assert(VerifyMacaroon(m, suppliedContext{ctx, []*Macaroon{d}}, nil), qt.IsNil)
+
+	extra := emitHmacMacaroon(c, MakeKey([]byte("other key")), []byte("other"), "merchant 4711")
+	err := VerifyMacaroon(m, suppliedContext{ctx, []*Macaroon{d, extra}}, nil)
+	c.Assert(err, qt.ErrorMatches, `macaroon verification error: discharge macaroon "other" was not used`)
+	c.Assert(errors.Is(err, ErrDischarge), qt.IsTrue)
+	var verr *VerificationError
+	c.Assert(errors.As(err, &verr), qt.IsTrue)
+	c.Assert(string(verr.MacaroonId), qt.Equals, "other")
+	c.Assert(verr.CaveatIndex, qt.Equals, -1)
+
+	// A discharge macaroon supplied twice is used once only.
+	err = VerifyMacaroon(m, suppliedContext{ctx, []*Macaroon{d, d}}, nil)
+	c.Assert(err, qt.ErrorMatches, `macaroon verification error: discharge macaroon "das ok" was not used`)
+}
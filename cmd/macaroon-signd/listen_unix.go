@@ -0,0 +1,18 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"syscall"
+)
+
+// listenUnix listens on a Unix socket which only the user and the
+// group of the daemon may connect to. The socket is created with these
+// permissions, so that no other user can connect before they are set.
+func listenUnix(path string) (net.Listener, error) {
+	old := syscall.Umask(0117)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
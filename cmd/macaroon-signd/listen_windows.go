@@ -0,0 +1,11 @@
+package main
+
+import (
+	"net"
+)
+
+// listenUnix listens on a Unix socket. Windows has no umask; access to
+// the socket is controlled by the permissions of its directory.
+func listenUnix(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,181 @@
+// The macaroon-signd command is the reference signing daemon for
+// RemoteSigner. It holds the issuing keys listed in its configuration
+// file and signs macaroons for the clients allowed there.
+//
+// The configuration file holds JSON in the following format, where all
+// binary values are base64url encoded without padding:
+//
+//	{
+//		"keys": [
+//			{"selector64": "...", "algorithm": "hmac-sha256", "key64": "..."},
+//			{"selector64": "...", "algorithm": "ecdsa-secp256k1", "key64": "..."}
+//		],
+//		"clients": [
+//			{"id": "pos-1", "key64": "...", "selectors64": ["..."]}
+//		]
+//	}
+//
+// The daemon listens on a Unix socket, given as unix:PATH, or on a TCP
+// address, given as tcp:ADDR, which should be a loopback address. Only
+// the user and the group of the daemon may connect to the Unix socket.
+// On SIGINT or SIGTERM the daemon overwrites its keys and exits.
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	macaroon "github.com/dcpn-io/macaroon-pass"
+)
+
+type config struct {
+	Keys []struct {
+		Selector  string             `json:"selector64"`
+		Algorithm macaroon.Algorithm `json:"algorithm"`
+		Key       string             `json:"key64"`
+	} `json:"keys"`
+	Clients []struct {
+		Id        string   `json:"id"`
+		Key       string   `json:"key64"`
+		Selectors []string `json:"selectors64"`
+	} `json:"clients"`
+}
+
+var (
+	configPath = flag.String("config", "/etc/macaroon-signd.json", "configuration file")
+	listenAddr = flag.String("listen", "unix:/run/macaroon-signd.sock", "unix:PATH or tcp:ADDR to listen on")
+)
+
+func main() {
+	flag.Parse()
+	d, keys, err := loadDaemon(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	l, err := listen(*listenAddr)
+	if err != nil {
+		destroyKeys(keys)
+		log.Fatal(err)
+	}
+	stop := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		close(stop)
+		l.Close()
+	}()
+	log.Printf("listening on %s", *listenAddr)
+	err = http.Serve(l, d)
+	destroyKeys(keys)
+	select {
+	case <-stop:
+		log.Printf("stopped")
+	default:
+		log.Fatal(err)
+	}
+}
+
+// destroyKeys overwrites the keys of the daemon, so that they do not
+// outlive it in memory.
+func destroyKeys(keys []*macaroon.SecretKey) {
+	for _, key := range keys {
+		key.Destroy()
+	}
+}
+
+// zero overwrites a decoded key once it is held in a SecretKey.
+func zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// loadDaemon creates the daemon described by the configuration file. It
+// returns the keys the daemon holds as well, so that they can be
+// destroyed on shutdown.
+func loadDaemon(path string) (_ *macaroon.SigningDaemon, keys []*macaroon.SecretKey, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read configuration: %v", err)
+	}
+	defer zero(data)
+	var conf config
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("cannot parse configuration: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			destroyKeys(keys)
+		}
+	}()
+	d := macaroon.NewSigningDaemon()
+	for _, k := range conf.Keys {
+		selector, err := base64.RawURLEncoding.DecodeString(k.Selector)
+		if err != nil {
+			return nil, keys, fmt.Errorf("invalid selector %q: %v", k.Selector, err)
+		}
+		key, err := decodeKey(k.Key)
+		if err != nil {
+			return nil, keys, fmt.Errorf("invalid key for selector %q: %v", k.Selector, err)
+		}
+		keys = append(keys, key)
+		if err := d.AddKey(selector, k.Algorithm, key); err != nil {
+			return nil, keys, err
+		}
+	}
+	for _, c := range conf.Clients {
+		key, err := decodeKey(c.Key)
+		if err != nil {
+			return nil, keys, fmt.Errorf("invalid key for client %q: %v", c.Id, err)
+		}
+		keys = append(keys, key)
+		var selectors [][]byte
+		for _, s := range c.Selectors {
+			selector, err := base64.RawURLEncoding.DecodeString(s)
+			if err != nil {
+				return nil, keys, fmt.Errorf("invalid selector %q for client %q: %v", s, c.Id, err)
+			}
+			selectors = append(selectors, selector)
+		}
+		if err := d.AddClient(c.Id, key, selectors...); err != nil {
+			return nil, keys, err
+		}
+	}
+	return d, keys, nil
+}
+
+// decodeKey decodes a key of the configuration file into a SecretKey.
+func decodeKey(s string) (*macaroon.SecretKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	defer zero(b)
+	return macaroon.NewSecretKey(b), nil
+}
+
+func listen(addr string) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, "unix:"):
+		path := strings.TrimPrefix(addr, "unix:")
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("cannot remove stale socket: %v", err)
+		}
+		return listenUnix(path)
+	case strings.HasPrefix(addr, "tcp:"):
+		return net.Listen("tcp", strings.TrimPrefix(addr, "tcp:"))
+	default:
+		return nil, fmt.Errorf("invalid listen address %q", addr)
+	}
+}
@@ -1,6 +1,8 @@
 package macaroon_pass
 
 import (
+	"bytes"
+	"crypto/ed25519"
 	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
@@ -15,17 +17,94 @@ import (
 )
 
 
-func RandomKey(size int) ([]byte, error) {
+func RandomKey(size int) (*SecretKey, error) {
 	buf := make([]byte, size)
 	_, e := rand.Read(buf)
 	if e != nil {
 		return nil, fmt.Errorf("cannot generate random key: %v", e);
 	}
-	return buf, nil
+	return &SecretKey{key: buf}, nil
 }
 
 
+// macaroonDigestTag separates the digest signed by public-key signers
+// from any other use of SHA-256. It changes with every new digest
+// version.
+var macaroonDigestTag = []byte("macaroon-pass/digest/v1")
+
+// macaroonBindTag separates the digest of a discharge macaroon bound to
+// a primary signature.
+var macaroonBindTag = []byte("macaroon-pass/digest/v1/bound")
+
+// calcMacaroonHash returns the digest which public-key signers sign.
+// Every field is prefixed with its type and length as in the V2
+// binary format, so that no two different macaroons share an
+// encoding. The algorithm is signed too, so that a macaroon can not be
+// passed off as one signed with another algorithm. This holds for
+// public-key signers only, as MAC chains do not cover the algorithm.
+// Locations are not signed and are left out.
+//
+// The digest of a discharge macaroon bound to a primary macaroon covers
+// the primary signature too.
 func calcMacaroonHash(m *Macaroon) [sha256.Size]byte {
+	data := appendPacketV2(nil, packetV2{
+		fieldType: fieldIdentifier,
+		data:      m.id,
+	})
+	if m.algorithm != "" {
+		data = appendPacketV2(data, packetV2{
+			fieldType: fieldAlgorithm,
+			data:      []byte(m.algorithm),
+		})
+	}
+	data = appendEOSV2(data)
+	data = appendCaveatsDigestData(data, m.caveats)
+
+	var hash [sha256.Size]byte
+	copy(hash[:], taggedHash(macaroonDigestTag, data))
+	if m.boundTo != nil {
+		copy(hash[:], taggedHash(macaroonBindTag, hash[:], m.boundTo))
+	}
+	return hash
+}
+
+// appendCaveatsDigestData appends the encoding of the caveats
+// used by calcMacaroonHash to data.
+func appendCaveatsDigestData(data []byte, caveats []Caveat) []byte {
+	for _, cav := range caveats {
+		data = appendPacketV2(data, packetV2{
+			fieldType: fieldIdentifier,
+			data:      cav.Id,
+		})
+		if cav.IsThirdParty() {
+			data = appendPacketV2(data, packetV2{
+				fieldType: fieldVerificationId,
+				data:      cav.VerificationId,
+			})
+		}
+		data = appendEOSV2(data)
+	}
+	return data
+}
+
+// taggedHash computes the tagged hash, as defined in BIP-340, of the concatenated
+// data under the given tag.
+func taggedHash(tag []byte, data ...[]byte) []byte {
+	tagHash := sha256.Sum256(tag)
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+// calcLegacyMacaroonHash returns the digest signed by earlier versions
+// of this package. It simply concatenates the fields, so different
+// macaroons may share it; it is only used to verify such macaroons
+// during a migration.
+func calcLegacyMacaroonHash(m *Macaroon) [sha256.Size]byte {
 	msg := m.Id()
 
 	for _, cav := range m.Caveats() {
@@ -45,35 +124,67 @@ type Signer interface {
 }
 
 type EcdsaSigner struct {
-	priv *secp256k1.PrivateKey
+	key *SecretKey
+	pub []byte
 }
 
-func NewEcdsaSigner(key []byte) *EcdsaSigner {
-	priv, _ := secp256k1.PrivKeyFromBytes(key)
-	return &EcdsaSigner{priv:priv}
+func NewEcdsaSigner(key *SecretKey) *EcdsaSigner {
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+	return &EcdsaSigner{key: key, pub: pub.SerializeCompressed()}
+}
+
+// PublicKey returns the compressed public key which verifies signatures
+// of the signer.
+func (s *EcdsaSigner) PublicKey() []byte {
+	return append([]byte(nil), s.pub...)
 }
 
 func (s *EcdsaSigner) SignData(data []byte) ([]byte, error) {
 	hash := sha256.Sum256(data)
-	sig, err := s.priv.Sign(hash[:])
-	if err != nil {
-		return nil, fmt.Errorf("cannot make ECDSA signature: %v", err)
-	}
-	return sig.Serialize(), nil
+	return s.sign(hash[:])
 }
 
 func (s *EcdsaSigner) SignMacaroon (m *Macaroon) error {
+	if s.key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	m.setAlgorithm(AlgorithmEcdsa)
 	hash := calcMacaroonHash(m)
 
-	sig, err := s.priv.Sign(hash[:])
+	sig, err := s.sign(hash[:])
 	if err != nil {
-		return fmt.Errorf("cannot make ECDSA signature: %v", err)
+		return err
 	}
-	m.sig = sig.Serialize()
+	m.sig = sig
 	return nil
 }
 
+// sign signs the hash with the private key, which is parsed again on
+// every call so that destroying the key disables the signer.
+func (s *EcdsaSigner) sign(hash []byte) ([]byte, error) {
+	if s.key.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	priv, _ := secp256k1.PrivKeyFromBytes(s.key.bytes())
+	sig, err := priv.Sign(hash)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make ECDSA signature: %v", err)
+	}
+	return sig.Serialize(), nil
+}
+
 func EcdsaSignatureVerify(pubKey []byte, m *Macaroon) error {
+	return ecdsaSignatureVerify(pubKey, m, false)
+}
+
+// EcdsaSignatureVerifyLegacy is like EcdsaSignatureVerify, but also
+// accepts signatures made over the legacy digest. It should only be
+// used while macaroons issued by earlier versions are still in use.
+func EcdsaSignatureVerifyLegacy(pubKey []byte, m *Macaroon) error {
+	return ecdsaSignatureVerify(pubKey, m, true)
+}
+
+func ecdsaSignatureVerify(pubKey []byte, m *Macaroon, acceptLegacy bool) error {
 	s := m.Signature()
 	if s == nil {
 		return fmt.Errorf("signature is nil")
@@ -92,18 +203,96 @@ func EcdsaSignatureVerify(pubKey []byte, m *Macaroon) error {
 
 	if sig.Verify(hash[:], key) {
 		return nil
+	}
+	// The legacy digest does not cover the primary signature, so bound
+	// discharge macaroons must carry a signature over the new digest.
+	if acceptLegacy && m.boundTo == nil {
+		legacyHash := calcLegacyMacaroonHash(m)
+		if sig.Verify(legacyHash[:], key) {
+			return nil
+		}
+	}
+	return fmt.Errorf("wrong signature")
+}
+
+type Ed25519Signer struct {
+	key *SecretKey
+	pub ed25519.PublicKey
+}
+
+// NewEd25519Signer creates a signer from either a 32-byte Ed25519 seed
+// or a 64-byte Ed25519 private key.
+func NewEd25519Signer(key *SecretKey) (*Ed25519Signer, error) {
+	switch n := len(key.bytes()); n {
+	case ed25519.SeedSize, ed25519.PrivateKeySize:
+	default:
+		return nil, fmt.Errorf("wrong Ed25519 key length %d", n)
+	}
+	s := &Ed25519Signer{key: key}
+	s.pub = s.privateKey().Public().(ed25519.PublicKey)
+	return s, nil
+}
+
+// privateKey returns the private key, which is expanded from the seed on
+// every call so that destroying the key disables the signer.
+func (s *Ed25519Signer) privateKey() ed25519.PrivateKey {
+	key := s.key.bytes()
+	if len(key) == ed25519.SeedSize {
+		return ed25519.NewKeyFromSeed(key)
+	}
+	return ed25519.PrivateKey(key)
+}
+
+// PublicKey returns the public key which verifies signatures of the signer.
+func (s *Ed25519Signer) PublicKey() []byte {
+	return append([]byte(nil), s.pub...)
+}
+
+func (s *Ed25519Signer) SignData(data []byte) ([]byte, error) {
+	if s.key.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	return ed25519.Sign(s.privateKey(), data), nil
+}
+
+func (s *Ed25519Signer) SignMacaroon(m *Macaroon) error {
+	if s.key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	m.setAlgorithm(AlgorithmEd25519)
+	hash := calcMacaroonHash(m)
+	m.sig = ed25519.Sign(s.privateKey(), hash[:])
+	return nil
+}
+
+func Ed25519SignatureVerify(pubKey []byte, m *Macaroon) error {
+	s := m.Signature()
+	if s == nil {
+		return fmt.Errorf("signature is nil")
+	}
+	if len(s) != ed25519.SignatureSize {
+		return fmt.Errorf("signature has unexpected length %d", len(s))
+	}
+	if len(pubKey) != ed25519.PublicKeySize {
+		return fmt.Errorf("cannot parse public key: wrong length %d", len(pubKey))
+	}
+
+	hash := calcMacaroonHash(m)
+	if ed25519.Verify(ed25519.PublicKey(pubKey), hash[:], s) {
+		return nil
 	} else {
 		return fmt.Errorf("wrong signature")
 	}
 }
+
 type HmacSha256Signer struct {
-	key      []byte
+	key      *SecretKey
 	macaroon *Macaroon
 	nextStep int
 }
 
-func NewHmacSha256Signer(key []byte) (*HmacSha256Signer, error) {
-	if len(key) == 0 {
+func NewHmacSha256Signer(key *SecretKey) (*HmacSha256Signer, error) {
+	if len(key.bytes()) == 0 {
 		return nil, fmt.Errorf("no key was passed when create HMAC SHA256 signer")
 	}
 	return &HmacSha256Signer{key: key}, nil
@@ -116,6 +305,9 @@ func DeriveHmacSha256Signer(m *Macaroon) (*HmacSha256Signer, error) {
 	if len(m.sig) == 0 {
 		return nil, fmt.Errorf("can not use unsigned macaroon to derive HMAC SHA256 signer")
 	}
+	if alg := m.chainAlgorithm(); alg != AlgorithmHmacSha256 && alg != AlgorithmHybrid {
+		return nil, fmt.Errorf("can not derive HMAC SHA256 signer for %s macaroon", alg)
+	}
 
 	return &HmacSha256Signer{
 		key:      nil,
@@ -125,16 +317,27 @@ func DeriveHmacSha256Signer(m *Macaroon) (*HmacSha256Signer, error) {
 }
 
 func makeHmacSha256Signature(key []byte, m *Macaroon, step int) ([][]byte, error) {
+	return makeMacSignature(hmacSha256Mac, key, m, step)
+}
+
+// makeMacSignature computes the MAC chain of the macaroon with the given
+// keyed hash, starting at the given step. Step 0 starts from the key;
+// otherwise the chain continues from the signature of the macaroon.
+func makeMacSignature(mac macFunc, key []byte, m *Macaroon, step int) ([][]byte, error) {
 
 	signatures := [][]byte(nil)
 
 	if step == 0 {
-		signatures = append(signatures, HmacSha256KeyedHash(key, m.Id()))
+		sig, err := mac(key, m.Id())
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, sig)
 		step++
 	} else if m.sig != nil {
 		signatures = append(signatures, m.sig)
 	} else {
-		return nil, fmt.Errorf("wrong HMAC SHA256 signer state")
+		return nil, fmt.Errorf("wrong MAC signer state")
 	}
 
 	var i int
@@ -148,7 +351,11 @@ func makeHmacSha256Signature(key []byte, m *Macaroon, step int) ([][]byte, error
 
 		log.Printf("====== Data to sign: " + hex.EncodeToString(data))
 
-		signatures = append(signatures, HmacSha256KeyedHash(signatures[len(signatures) - 1], data))
+		sig, err := mac(signatures[len(signatures) - 1], data)
+		if err != nil {
+			return nil, err
+		}
+		signatures = append(signatures, sig)
 	}
 	return signatures, nil
 }
@@ -161,7 +368,13 @@ func (s* HmacSha256Signer) SignMacaroon(m *Macaroon) error {
 		return fmt.Errorf("wrong HMAC SHA256 signer state")
 	}
 
-	signatures, err := makeHmacSha256Signature(s.key, m, s.nextStep)
+	if s.nextStep == 0 {
+		if s.key.isDestroyed() {
+			return fmt.Errorf("key was destroyed")
+		}
+		m.setAlgorithm(AlgorithmHmacSha256)
+	}
+	signatures, err := makeHmacSha256Signature(s.key.bytes(), m, s.nextStep)
 	if err != nil {
 		return err
 	}
@@ -183,18 +396,106 @@ func (s* HmacSha256Signer) SignData(data []byte) ([]byte, error) {
 	return HmacSha256KeyedHash(s.macaroon.sig , data), nil
 }
 
-func HmacSha256SignatureVerify(key []byte, m *Macaroon) error {
+func HmacSha256SignatureVerify(key *SecretKey, m *Macaroon) error {
+	if key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	return hmacSha256SignatureVerify(key.bytes(), m)
+}
+
+func hmacSha256SignatureVerify(key []byte, m *Macaroon) error {
 	sig, err := makeHmacSha256Signature(key, m, 0)
 	if err != nil {
 		return fmt.Errorf("signature error: %v", err)
 	}
-	if hmac.Equal(sig[len(sig) - 1], m.sig) {
+	if hmac.Equal(m.macSignature(sig[len(sig) - 1]), m.sig) {
 		return nil
 	} else {
 		return fmt.Errorf("wrong signature")
 	}
 }
 
+// HmacSha256DischargeVerify verifies a macaroon signed with an HMAC
+// SHA256 chain together with the discharge macaroons of the third-party
+// caveats added by AddThirdPartyCaveat. As in libmacaroons, the root key
+// of each third-party caveat is decrypted from its verification id with
+// the chain signature preceding the caveat; the discharge macaroon with
+// the caveat id must be signed with that key and bound to m. Every
+// discharge macaroon must be used exactly once.
+func HmacSha256DischargeVerify(key *SecretKey, m *Macaroon, discharges []*Macaroon) error {
+	if key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	return dischargeVerify(makeHmacSha256Signature, key.bytes(), m, discharges)
+}
+
+// macChainFunc computes the signatures of a MAC chain as
+// makeHmacSha256Signature does.
+type macChainFunc func(key []byte, m *Macaroon, step int) ([][]byte, error)
+
+// dischargeVerify verifies m and its discharge macaroons with the given
+// chain, checking that every discharge macaroon is used exactly once.
+func dischargeVerify(chain macChainFunc, key []byte, m *Macaroon, discharges []*Macaroon) error {
+	used := make([]bool, len(discharges))
+	err := macDischargeVerify(chain, key, m, nil, discharges, used)
+	if err != nil {
+		return err
+	}
+	for i, ok := range used {
+		if !ok {
+			return fmt.Errorf("discharge macaroon %q was not used", discharges[i].id)
+		}
+	}
+	return nil
+}
+
+// macDischargeVerify verifies m and, recursively, its discharge
+// macaroons. rootSig holds the signature of the primary macaroon, which
+// discharge macaroons are bound to, and is nil when m is the primary one.
+func macDischargeVerify(chain macChainFunc, key []byte, m *Macaroon, rootSig []byte, discharges []*Macaroon, used []bool) error {
+	signatures, err := chain(key, m, 0)
+	if err != nil {
+		return fmt.Errorf("signature error: %v", err)
+	}
+	sig := signatures[len(signatures)-1]
+	if rootSig == nil {
+		rootSig = m.sig
+	} else {
+		sig = bindForRequest(rootSig, sig)
+	}
+	if !hmac.Equal(sig, m.sig) {
+		return fmt.Errorf("wrong signature")
+	}
+	for i, cav := range m.caveats {
+		if !cav.IsThirdParty() {
+			continue
+		}
+		var chainSig [keyLen]byte
+		copy(chainSig[:], signatures[i])
+		caveatKey, err := decrypt(&chainSig, cav.VerificationId)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt caveat %q signature: %v", cav.Id, err)
+		}
+		found := false
+		for j, d := range discharges {
+			if used[j] || !bytes.Equal(d.id, cav.Id) {
+				continue
+			}
+			used[j] = true
+			err = macDischargeVerify(chain, caveatKey[:], d, rootSig, discharges, used)
+			if err != nil {
+				return fmt.Errorf("discharge macaroon %q: %v", d.id, err)
+			}
+			found = true
+			break
+		}
+		if !found {
+			return fmt.Errorf("cannot find discharge macaroon for caveat %q", cav.Id)
+		}
+	}
+	return nil
+}
+
 func HmacSha256KeyedHash(key []byte, text []byte) []byte {
 	h := keyedHasher(key)
 	h.Write([]byte(text))
@@ -219,7 +520,20 @@ var keyGen = []byte("macaroons-key-generator")
 // MakeKey derives a fixed length key from a variable
 // length key. The keyGen constant is the same
 // as that used in libmacaroons.
-func MakeKey(variableKey []byte) []byte {
+func MakeKey(variableKey []byte) *SecretKey {
+	return &SecretKey{key: makeKey(variableKey)}
+}
+
+// DeriveKey is like MakeKey for a key held in a SecretKey, such as a
+// key returned by RandomKey.
+func DeriveKey(variableKey *SecretKey) (*SecretKey, error) {
+	if variableKey.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	return &SecretKey{key: makeKey(variableKey.bytes())}, nil
+}
+
+func makeKey(variableKey []byte) []byte {
 	h := hmac.New(sha256.New, keyGen)
 	h.Write(variableKey)
 	var key [keyLen]byte
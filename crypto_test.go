@@ -8,6 +8,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/decred/dcrd/dcrec/secp256k1"
 	qt "github.com/frankban/quicktest"
 	"golang.org/x/crypto/nacl/secretbox"
 )
@@ -92,6 +93,73 @@ func TestHmacSha256KeyedHash(t *testing.T) {
 	c.Assert(encodedStr, qt.DeepEquals, testResult)
 }
 
+func TestMacaroonHashIsUnambiguous(t *testing.T) {
+	c := qt.New(t)
+
+	m1 := MustNew([]byte("id"), "", V2)
+	err := m1.AddFirstPartyCaveat([]byte("abc"))
+	c.Assert(err, qt.IsNil)
+
+	// The same bytes shifted between the id and the caveat.
+	m2 := MustNew([]byte("ida"), "", V2)
+	err = m2.AddFirstPartyCaveat([]byte("bc"))
+	c.Assert(err, qt.IsNil)
+
+	// The same bytes moved from a first-party caveat
+	// to the verification id of a third-party caveat.
+	m3 := MustNew([]byte("id"), "", V2)
+	err = m3.AddCaveat([]byte("a"), []byte("bc"), "loc")
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(calcLegacyMacaroonHash(m1), qt.Equals, calcLegacyMacaroonHash(m2))
+	c.Assert(calcLegacyMacaroonHash(m1), qt.Equals, calcLegacyMacaroonHash(m3))
+
+	c.Assert(calcMacaroonHash(m1), qt.Not(qt.Equals), calcMacaroonHash(m2))
+	c.Assert(calcMacaroonHash(m1), qt.Not(qt.Equals), calcMacaroonHash(m3))
+	c.Assert(calcMacaroonHash(m2), qt.Not(qt.Equals), calcMacaroonHash(m3))
+
+	// The location is only a hint and is not signed.
+	m4 := MustNew([]byte("id"), "", V2)
+	err = m4.AddCaveat([]byte("a"), []byte("bc"), "other loc")
+	c.Assert(err, qt.IsNil)
+	c.Assert(calcMacaroonHash(m3), qt.Equals, calcMacaroonHash(m4))
+}
+
+func TestEcdsaSignatureVerifyLegacy(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	priv, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+
+	m := MustNew([]byte("ECDSA"), "", V2)
+	err = m.AddFirstPartyCaveat([]byte("payment"))
+	c.Assert(err, qt.IsNil)
+
+	legacyHash := calcLegacyMacaroonHash(m)
+	sig, err := priv.Sign(legacyHash[:])
+	c.Assert(err, qt.IsNil)
+	m.SetSignature(sig.Serialize())
+
+	err = EcdsaSignatureVerify(pub.SerializeCompressed(), m)
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+	err = EcdsaSignatureVerifyLegacy(pub.SerializeCompressed(), m)
+	c.Assert(err, qt.IsNil)
+
+	// The legacy digest does not cover the primary signature, so legacy
+	// signatures do not verify bound discharge macaroons.
+	m.boundTo = []byte("primary signature")
+	err = EcdsaSignatureVerifyLegacy(pub.SerializeCompressed(), m)
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+	m.boundTo = nil
+
+	err = m.Sign(NewEcdsaSigner(key))
+	c.Assert(err, qt.IsNil)
+	err = EcdsaSignatureVerify(pub.SerializeCompressed(), m)
+	c.Assert(err, qt.IsNil)
+	err = EcdsaSignatureVerifyLegacy(pub.SerializeCompressed(), m)
+	c.Assert(err, qt.IsNil)
+}
+
 func TestMakeHmacSha256Signature(t *testing.T) {
 	c := qt.New(t)
 
@@ -0,0 +1,236 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// Committed caveats hide their condition behind a salted hash, so that
+// the holder of a macaroon can show it without revealing every caveat.
+// The caveat id is
+//
+//	\x00commitment/v1 <hex-encoded hash of salt and condition>
+//
+// or, if the issuer allows the holder to keep the condition hidden,
+//
+//	\x00commitment/v1 hideable <hex-encoded hash of salt and condition>
+//
+// The leading zero byte keeps plain text conditions from being taken
+// for commitments, and only ids with exactly this shape are.
+//
+// and the signature covers the commitment only. The holder keeps a
+// CaveatDisclosure with the salt and condition of each committed caveat
+// and hands the disclosures a verifier needs over together with the
+// macaroon.
+//
+// VerifyMacaroon checks disclosed caveats like any other caveat, if the
+// Context or a Context it wraps implements Discloser, as
+// DisclosureContext does. DisclosureContext accepts undisclosed
+// hideable commitments and rejects every other undisclosed commitment,
+// so a holder can not drop a restriction the issuer did not mark as
+// hideable. Without a Discloser, commitments reach ProcessOperation
+// unchanged; IsCaveatCommitment reports such caveats.
+
+var (
+	commitmentPrefix         = []byte("\x00commitment/v1 ")
+	hideableCommitmentPrefix = []byte("\x00commitment/v1 hideable ")
+)
+
+var commitmentTag = []byte("macaroon-pass/caveat-commitment/v1")
+
+const commitmentSaltLen = 32
+
+// Field constants as used in the disclosure encoding.
+const (
+	disclosureFieldSalt      fieldType = 1
+	disclosureFieldCondition fieldType = 2
+	disclosureFieldHideable  fieldType = 3
+)
+
+// Discloser is implemented by contexts which know the conditions of
+// committed caveats.
+type Discloser interface {
+	// DiscloseCaveat returns the condition committed to by the caveat
+	// id, if it was disclosed.
+	DiscloseCaveat(caveatId []byte) ([]byte, bool)
+}
+
+// CaveatDisclosure opens the commitment of a committed caveat.
+// Hideable reports whether the holder may keep the condition hidden.
+type CaveatDisclosure struct {
+	Salt      []byte
+	Condition []byte
+	Hideable  bool
+}
+
+// NewCaveatDisclosure commits to the condition with a random salt. If
+// hideable is set, verifiers accept the caveat without its disclosure.
+func NewCaveatDisclosure(condition []byte, hideable bool) (*CaveatDisclosure, error) {
+	salt := make([]byte, commitmentSaltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, fmt.Errorf("cannot generate random bytes: %v", err)
+	}
+	return &CaveatDisclosure{
+		Salt:      salt,
+		Condition: append([]byte(nil), condition...),
+		Hideable:  hideable,
+	}, nil
+}
+
+// Commitment returns the caveat id which commits to the condition.
+func (d *CaveatDisclosure) Commitment() []byte {
+	h := taggedHash(commitmentTag, appendPacketV2(nil, packetV2{
+		fieldType: disclosureFieldSalt,
+		data:      d.Salt,
+	}), d.Condition)
+	prefix := commitmentPrefix
+	if d.Hideable {
+		prefix = hideableCommitmentPrefix
+	}
+	return append(append([]byte(nil), prefix...), hex.EncodeToString(h)...)
+}
+
+// IsCaveatCommitment reports whether the caveat id is the commitment of
+// a committed caveat.
+func IsCaveatCommitment(caveatId []byte) bool {
+	_, ok := parseCommitment(caveatId)
+	return ok
+}
+
+func isHideableCommitment(caveatId []byte) bool {
+	hideable, ok := parseCommitment(caveatId)
+	return ok && hideable
+}
+
+// parseCommitment reports whether the caveat id is a commitment and
+// whether it is hideable.
+func parseCommitment(caveatId []byte) (hideable, ok bool) {
+	var h []byte
+	switch {
+	case bytes.HasPrefix(caveatId, hideableCommitmentPrefix):
+		hideable, h = true, caveatId[len(hideableCommitmentPrefix):]
+	case bytes.HasPrefix(caveatId, commitmentPrefix):
+		h = caveatId[len(commitmentPrefix):]
+	default:
+		return false, false
+	}
+	if len(h) != hex.EncodedLen(sha256.Size) {
+		return false, false
+	}
+	for _, c := range h {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false, false
+		}
+	}
+	return hideable, true
+}
+
+// AddCommittedCaveat adds a first-party caveat which commits to the
+// condition, and returns the disclosure which opens it. The macaroon
+// must be signed again afterwards.
+func (m *Macaroon) AddCommittedCaveat(condition []byte, hideable bool) (*CaveatDisclosure, error) {
+	d, err := NewCaveatDisclosure(condition, hideable)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.AddFirstPartyCaveat(d.Commitment()); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// MarshalDisclosures encodes disclosures for transfer to a verifier.
+func MarshalDisclosures(disclosures []*CaveatDisclosure) []byte {
+	var data []byte
+	for _, d := range disclosures {
+		data = appendPacketV2(data, packetV2{
+			fieldType: disclosureFieldSalt,
+			data:      d.Salt,
+		})
+		data = appendPacketV2(data, packetV2{
+			fieldType: disclosureFieldCondition,
+			data:      d.Condition,
+		})
+		if d.Hideable {
+			data = appendPacketV2(data, packetV2{
+				fieldType: disclosureFieldHideable,
+			})
+		}
+		data = appendEOSV2(data)
+	}
+	return data
+}
+
+// UnmarshalDisclosures decodes disclosures encoded by MarshalDisclosures.
+func UnmarshalDisclosures(data []byte) ([]*CaveatDisclosure, error) {
+	var disclosures []*CaveatDisclosure
+	for len(data) > 0 {
+		rest, section, err := parseSectionV2(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot unmarshal disclosures: %v", err)
+		}
+		data = rest
+		if len(section) < 2 || len(section) > 3 ||
+			section[0].fieldType != disclosureFieldSalt ||
+			section[1].fieldType != disclosureFieldCondition {
+			return nil, fmt.Errorf("cannot unmarshal disclosures: invalid disclosure")
+		}
+		hideable := len(section) == 3
+		if hideable && (section[2].fieldType != disclosureFieldHideable || len(section[2].data) != 0) {
+			return nil, fmt.Errorf("cannot unmarshal disclosures: invalid disclosure")
+		}
+		disclosures = append(disclosures, &CaveatDisclosure{
+			Salt:      section[0].data,
+			Condition: section[1].data,
+			Hideable:  hideable,
+		})
+	}
+	return disclosures, nil
+}
+
+// DisclosureContext is a Context which discloses committed caveats with
+// the disclosures received from the holder. Undisclosed commitments are
+// accepted if they are hideable and rejected otherwise. Everything else
+// is handled by the embedded Context.
+type DisclosureContext struct {
+	Context
+	conditions map[string][]byte
+}
+
+func NewDisclosureContext(ctx Context, disclosures []*CaveatDisclosure) *DisclosureContext {
+	c := &DisclosureContext{
+		Context:    ctx,
+		conditions: make(map[string][]byte),
+	}
+	for _, d := range disclosures {
+		c.conditions[string(d.Commitment())] = d.Condition
+	}
+	return c
+}
+
+// Unwrap returns the embedded Context.
+func (c *DisclosureContext) Unwrap() Context {
+	return c.Context
+}
+
+// DiscloseCaveat implements Discloser.
+func (c *DisclosureContext) DiscloseCaveat(caveatId []byte) ([]byte, bool) {
+	cond, ok := c.conditions[string(caveatId)]
+	return cond, ok
+}
+
+// ProcessOperation accepts undisclosed hideable commitments and rejects
+// other undisclosed commitments. Other conditions are checked by the
+// embedded Context.
+func (c *DisclosureContext) ProcessOperation(op []byte) error {
+	if isHideableCommitment(op) {
+		return nil
+	}
+	if IsCaveatCommitment(op) {
+		return fmt.Errorf("committed caveat is not disclosed")
+	}
+	return c.Context.ProcessOperation(op)
+}
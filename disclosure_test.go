@@ -0,0 +1,155 @@
+package macaroon_pass
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCommittedCaveats(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("card key"))
+	selector := []byte("card 0001")
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, selector)
+	c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+	invoice, err := emt.AuthorizeCommittedOperation([]byte("payment lnbc1000n1secret"), true)
+	c.Assert(err, qt.IsNil)
+	merchant, err := emt.AuthorizeCommittedOperation([]byte("merchant 4711"), false)
+	c.Assert(err, qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	for _, cav := range m.Caveats()[1:] {
+		c.Assert(IsCaveatCommitment(cav.Id), qt.IsTrue)
+		c.Assert(string(cav.Id), qt.Not(qt.Contains), "lnbc")
+	}
+	c.Assert(isHideableCommitment(m.Caveats()[1].Id), qt.IsTrue)
+	c.Assert(isHideableCommitment(m.Caveats()[2].Id), qt.IsFalse)
+
+	r := NewKeyring()
+	err = r.Add(&Key{Id: "card", Selector: selector, Algorithm: AlgorithmHmacSha256, Material: key.bytes()})
+	c.Assert(err, qt.IsNil)
+	ops := operationContext{map[string]bool{"amount 100": true, "merchant 4711": true}}
+	ctx := NewResolverContext(r, ops)
+
+	// The holder reveals the merchant only, and keeps the hideable
+	// invoice hidden. The disclosures survive marshaling.
+	data := MarshalDisclosures([]*CaveatDisclosure{merchant})
+	disclosures, err := UnmarshalDisclosures(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(disclosures, qt.DeepEquals, []*CaveatDisclosure{merchant})
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, disclosures), nil)
+	c.Assert(err, qt.IsNil)
+	data = MarshalDisclosures([]*CaveatDisclosure{invoice, merchant})
+	disclosures, err = UnmarshalDisclosures(data)
+	c.Assert(err, qt.IsNil)
+	c.Assert(disclosures, qt.DeepEquals, []*CaveatDisclosure{invoice, merchant})
+
+	// A commitment which is not hideable must be disclosed.
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, []*CaveatDisclosure{invoice}), [][]byte{[]byte("payment lnbc1000n1secret")})
+	c.Assert(err, qt.ErrorMatches, `condition is not met \x00commitment/v1 [0-9a-f]{64}: committed caveat is not disclosed`)
+	err = VerifyMacaroon(m, NewHolderContext(NewDisclosureContext(ctx, nil), nil, nil), nil)
+	c.Assert(err, qt.ErrorMatches, `condition is not met \x00commitment/v1 [0-9a-f]{64}: committed caveat is not disclosed`)
+
+	// Verifiers without a Discloser see the commitments themselves.
+	err = VerifyMacaroon(m, ctx, nil)
+	c.Assert(err, qt.ErrorMatches, `condition is not met \x00commitment/v1 hideable [0-9a-f]{64}: operation .* is not allowed`)
+
+	// Disclosed caveats are checked as usual, and match the requested
+	// operations.
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, []*CaveatDisclosure{merchant, invoice}), nil)
+	c.Assert(err, qt.ErrorMatches, `condition is not met payment lnbc1000n1secret: operation .* is not allowed`)
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, []*CaveatDisclosure{merchant, invoice}), [][]byte{[]byte("payment lnbc1000n1secret")})
+	c.Assert(err, qt.IsNil)
+
+	// A disclosure with another condition opens no commitment.
+	forged := &CaveatDisclosure{Salt: merchant.Salt, Condition: []byte("merchant 1")}
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, []*CaveatDisclosure{forged, invoice}), [][]byte{[]byte("payment lnbc1000n1secret")})
+	c.Assert(err, qt.ErrorMatches, `condition is not met \x00commitment/v1 [0-9a-f]{64}: committed caveat is not disclosed`)
+
+	// Nor does a disclosure which claims the merchant is hideable.
+	hidden := &CaveatDisclosure{Salt: merchant.Salt, Condition: merchant.Condition, Hideable: true}
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, []*CaveatDisclosure{hidden}), nil)
+	c.Assert(err, qt.ErrorMatches, `condition is not met \x00commitment/v1 [0-9a-f]{64}: committed caveat is not disclosed`)
+
+	// The signature covers the commitments.
+	err = m.AddFirstPartyCaveat([]byte("amount 1"))
+	c.Assert(err, qt.IsNil)
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, []*CaveatDisclosure{merchant}), nil)
+	c.Assert(err, qt.ErrorMatches, `macaroon verification error: wrong signature`)
+}
+
+func TestIsCaveatCommitment(t *testing.T) {
+	c := qt.New(t)
+	d, err := NewCaveatDisclosure([]byte("merchant 4711"), false)
+	c.Assert(err, qt.IsNil)
+	h := d.Commitment()[len(commitmentPrefix):]
+	c.Assert(IsCaveatCommitment(d.Commitment()), qt.IsTrue)
+	d.Hideable = true
+	c.Assert(IsCaveatCommitment(d.Commitment()), qt.IsTrue)
+	c.Assert(isHideableCommitment(d.Commitment()), qt.IsTrue)
+
+	// Plain conditions which merely look like commitments are not
+	// taken for them.
+	for _, id := range []string{
+		"commitment " + string(h),
+		"commitment hideable " + string(h),
+		"\x00commitment/v1 ",
+		"\x00commitment/v1 hideable ",
+		"\x00commitment/v1 " + string(h[1:]),
+		"\x00commitment/v1 " + string(h) + "0",
+		"\x00commitment/v1 hideable " + strings.ToUpper(string(h)),
+		"\x00commitment/v1 hideable  " + string(h),
+		"\x00commitment/v2 " + string(h),
+	} {
+		c.Assert(IsCaveatCommitment([]byte(id)), qt.IsFalse, qt.Commentf("id %q", id))
+		c.Assert(isHideableCommitment([]byte(id)), qt.IsFalse, qt.Commentf("id %q", id))
+	}
+}
+
+func TestCommittedHolderKeyCaveat(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("card key"))
+	selector := []byte("card 0001")
+	m := emitHmacMacaroon(c, key, selector, "amount 100")
+
+	holderPub, holderPriv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, qt.IsNil)
+	cond, err := HolderKeyCaveat(AlgorithmEd25519, holderPub)
+	c.Assert(err, qt.IsNil)
+	signer, err := DeriveHmacSha256Signer(m)
+	c.Assert(err, qt.IsNil)
+	d, err := m.AddCommittedCaveat(cond, false)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Sign(signer), qt.IsNil)
+
+	holder, err := NewEd25519Signer(NewSecretKey(holderPriv))
+	c.Assert(err, qt.IsNil)
+	challenge := []byte("challenge")
+	proof, err := SignHolderProof(holder, challenge)
+	c.Assert(err, qt.IsNil)
+
+	ctx := newHolderTestContext(c, key.bytes(), selector)
+	holderCtx := NewHolderContext(ctx, challenge, proof)
+	err = VerifyMacaroon(m, NewDisclosureContext(holderCtx, []*CaveatDisclosure{d}), nil)
+	c.Assert(err, qt.IsNil)
+
+	// A disclosed holder key caveat can not be claimed as an operation.
+	err = VerifyMacaroon(m, NewDisclosureContext(ctx, []*CaveatDisclosure{d}), [][]byte{cond})
+	c.Assert(err, qt.ErrorMatches, fmt.Sprintf(`condition is not met %s: .*`, cond))
+}
+
+func TestUnmarshalDisclosuresErrors(t *testing.T) {
+	c := qt.New(t)
+	_, err := UnmarshalDisclosures([]byte{1, 1, 'x', 0})
+	c.Assert(err, qt.ErrorMatches, "cannot unmarshal disclosures: invalid disclosure")
+	_, err = UnmarshalDisclosures([]byte{1, 1, 'x', 2, 1, 'y', 3, 1, 'z', 0})
+	c.Assert(err, qt.ErrorMatches, "cannot unmarshal disclosures: invalid disclosure")
+	_, err = UnmarshalDisclosures([]byte{1, 5, 'x'})
+	c.Assert(err, qt.ErrorMatches, "cannot unmarshal disclosures: .*")
+}
@@ -0,0 +1,75 @@
+package macaroon_pass
+
+import (
+	"crypto/aes"
+	"crypto/sha256"
+	"fmt"
+	"time"
+)
+
+// Card keys are diversified from an issuer master key in the style of
+// EMV Option A: the card id is turned into a diversification block Y
+// and the card key is AES(MK, Y) || AES(MK, Y xor FF..FF). EMV takes Y
+// from the PAN digits; since macaroon ids are arbitrary bytes, Y holds
+// the first 16 bytes of the SHA-256 hash of the card id instead.
+//
+// The issuer gives every card its own HMAC-SHA256 key, while verifiers
+// only store the master key and derive card keys on the fly.
+
+// DiversifyCardKey derives the HMAC-SHA256 key of the card with the
+// given id from the master key, which must be a 16, 24 or 32 byte AES
+// key.
+func DiversifyCardKey(masterKey *SecretKey, cardId []byte) (*SecretKey, error) {
+	if len(cardId) == 0 {
+		return nil, fmt.Errorf("no card id was passed when diversify card key")
+	}
+	if masterKey.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	block, err := aes.NewCipher(masterKey.bytes())
+	if err != nil {
+		return nil, fmt.Errorf("cannot use master key: %v", err)
+	}
+	h := sha256.Sum256(cardId)
+	var y [aes.BlockSize]byte
+	copy(y[:], h[:])
+
+	key := make([]byte, 2*aes.BlockSize)
+	block.Encrypt(key[:aes.BlockSize], y[:])
+	for i := range y {
+		y[i] ^= 0xff
+	}
+	block.Encrypt(key[aes.BlockSize:], y[:])
+	return &SecretKey{key: key}, nil
+}
+
+// CardKeyResolver is a KeyResolver which derives the HMAC-SHA256 key of
+// a card from the master key, using the macaroon id as card id.
+type CardKeyResolver struct {
+	masterKey *SecretKey
+}
+
+func NewCardKeyResolver(masterKey *SecretKey) (*CardKeyResolver, error) {
+	if _, err := aes.NewCipher(masterKey.bytes()); err != nil {
+		return nil, fmt.Errorf("cannot use master key: %v", err)
+	}
+	return &CardKeyResolver{masterKey: masterKey}, nil
+}
+
+// ResolveKeys implements KeyResolver. It returns no keys for algorithms
+// other than HMAC-SHA256.
+func (r *CardKeyResolver) ResolveKeys(selector []byte, alg Algorithm, at time.Time) ([]*Key, error) {
+	if alg != AlgorithmHmacSha256 {
+		return nil, nil
+	}
+	key, err := DiversifyCardKey(r.masterKey, selector)
+	if err != nil {
+		return nil, err
+	}
+	return []*Key{{
+		Id:        fmt.Sprintf("%x", selector),
+		Selector:  selector,
+		Algorithm: AlgorithmHmacSha256,
+		Material:  key.bytes(),
+	}}, nil
+}
@@ -0,0 +1,74 @@
+package macaroon_pass
+
+import (
+	"encoding/hex"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+var diversifyCardKeyTests = []struct {
+	masterKey string
+	cardId    string
+	cardKey   string
+}{{
+	masterKey: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+	cardId:    "3030303030303030303030303030303030303030303033334130383130303034",
+	cardKey:   "171fd7bfaa698b9c0625d777a0993d3087edd52122219d64d287413e38137c38",
+}, {
+	masterKey: "000102030405060708090a0b0c0d0e0f",
+	cardId:    "3030303030303030303030303030303030303030303033334130383130303034",
+	cardKey:   "556712c7f6d0831e468815ee6bc44b16e1d297554536d7342f7728adc1d0a810",
+}, {
+	masterKey: "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f",
+	cardId:    "636172642030303031",
+	cardKey:   "0a05884ecc7f5e7d4988c02ba6f265dcb405511e6a550dbcb137da733c3dec98",
+}, {
+	masterKey: "000102030405060708090a0b0c0d0e0f",
+	cardId:    "636172642030303031",
+	cardKey:   "34391ca7f8069146dec5e62ac60086bd20d381fc696f1cba6cb3b5be9c401868",
+}}
+
+func TestDiversifyCardKey(t *testing.T) {
+	c := qt.New(t)
+	for i, test := range diversifyCardKeyTests {
+		c.Logf("test %d", i)
+		key, err := DiversifyCardKey(NewSecretKey(mustDecodeHex(test.masterKey)), mustDecodeHex(test.cardId))
+		c.Assert(err, qt.IsNil)
+		c.Assert(hex.EncodeToString(key.bytes()), qt.Equals, test.cardKey)
+	}
+
+	_, err := DiversifyCardKey(NewSecretKey(make([]byte, 20)), []byte("card 0001"))
+	c.Assert(err, qt.ErrorMatches, "cannot use master key: .*")
+	_, err = DiversifyCardKey(NewSecretKey(make([]byte, 32)), nil)
+	c.Assert(err, qt.ErrorMatches, "no card id was passed when diversify card key")
+}
+
+func TestCardKeyResolver(t *testing.T) {
+	c := qt.New(t)
+	masterKey := mustDecodeHex(diversifyCardKeyTests[0].masterKey)
+	cardId := []byte("card 0001")
+	cardKey, err := DiversifyCardKey(NewSecretKey(masterKey), cardId)
+	c.Assert(err, qt.IsNil)
+
+	r, err := NewCardKeyResolver(NewSecretKey(masterKey))
+	c.Assert(err, qt.IsNil)
+	ctx := NewResolverContext(r, operationContext{map[string]bool{"payment": true}})
+
+	m := emitHmacMacaroon(c, cardKey, cardId, "payment")
+	c.Assert(VerifyMacaroon(m, ctx, nil), qt.IsNil)
+
+	// The key of another card does not verify.
+	otherKey, err := DiversifyCardKey(NewSecretKey(masterKey), []byte("card 0002"))
+	c.Assert(err, qt.IsNil)
+	m = emitHmacMacaroon(c, otherKey, cardId, "payment")
+	c.Assert(ctx.VerifySignature(m), qt.ErrorMatches, "wrong signature")
+
+	keys, err := r.ResolveKeys(cardId, AlgorithmEcdsa, time.Now())
+	c.Assert(err, qt.IsNil)
+	c.Assert(keys, qt.HasLen, 0)
+
+	_, err = NewCardKeyResolver(NewSecretKey([]byte("short")))
+	c.Assert(err, qt.ErrorMatches, "cannot use master key: .*")
+}
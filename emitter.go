@@ -30,6 +30,8 @@ type thirdPartyOp struct {
 	operation []byte
 	location  string
 	nonce     []byte
+	rootKey   []byte
+	publicKey *[32]byte
 }
 
 type Emitter struct {
@@ -74,6 +76,30 @@ func (emt *Emitter) AuthorizeOperation (op []byte) error {
 	return nil
 }
 
+// AuthorizeCommittedOperation adds a committed caveat for the operation
+// and returns the disclosure which opens it. Verifiers accept a hideable
+// caveat the holder does not disclose.
+func (emt *Emitter) AuthorizeCommittedOperation(op []byte, hideable bool) (*CaveatDisclosure, error) {
+	d, err := NewCaveatDisclosure(op, hideable)
+	if err != nil {
+		return nil, err
+	}
+	if err := emt.AuthorizeOperation(d.Commitment()); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// BindToHolder adds a holder key caveat, so that the macaroon is only
+// accepted together with a proof of possession of the holder key.
+func (emt *Emitter) BindToHolder(alg Algorithm, pubKey []byte) error {
+	cond, err := HolderKeyCaveat(alg, pubKey)
+	if err != nil {
+		return err
+	}
+	return emt.AuthorizeOperation(cond)
+}
+
 func (emt *Emitter) DelegateAuthorization(op []byte, location string, verificationId []byte) error {
 	d := thirdPartyOp{
 		operation: make([]byte, len(op)),
@@ -96,6 +122,50 @@ func (emt *Emitter) DelegateAuthorization(op []byte, location string, verificati
 	return nil
 }
 
+// DelegateEncryptedAuthorization adds a third-party caveat whose
+// verification id holds the given caveat root key encrypted under the
+// macaroon signature, as done by Macaroon.AddThirdPartyCaveat. It needs
+// an HMAC SHA256 signer.
+func (emt *Emitter) DelegateEncryptedAuthorization(op []byte, location string, rootKey []byte) error {
+	if len(rootKey) == 0 {
+		return fmt.Errorf("no root key was passed when delegate authorization")
+	}
+	d := thirdPartyOp{
+		operation: append([]byte(nil), op...),
+		location:  location,
+		rootKey:   append([]byte(nil), rootKey...),
+	}
+
+	log.Printf("New caveat: %v, location: %v, encrypted vid", string(op), location)
+
+	emt.delegatedOps = append(emt.delegatedOps, &d)
+
+	return nil
+}
+
+// DelegateAuthorizationToPublicKey adds a third-party caveat whose
+// caveat id holds the operation and a fresh root key sealed to the given
+// public key of the third party, as done by
+// Macaroon.AddPublicKeyThirdPartyCaveat. It needs an HMAC SHA256 or a
+// hybrid signer; EmitMacaroon fails with any other signer.
+func (emt *Emitter) DelegateAuthorizationToPublicKey(op []byte, location string, thirdPartyKey *[32]byte) error {
+	if thirdPartyKey == nil {
+		return fmt.Errorf("no public key was passed when delegate authorization")
+	}
+	key := *thirdPartyKey
+	d := thirdPartyOp{
+		operation: append([]byte(nil), op...),
+		location:  location,
+		publicKey: &key,
+	}
+
+	log.Printf("New caveat: %v, location: %v, public key: %v", string(op), location, hex.EncodeToString(key[:]))
+
+	emt.delegatedOps = append(emt.delegatedOps, &d)
+
+	return nil
+}
+
 func (emt* Emitter) EmitMacaroon () (*Macaroon, error) {
 	var err error
 	m := emt.macaroonBase
@@ -120,7 +190,13 @@ func (emt* Emitter) EmitMacaroon () (*Macaroon, error) {
 			return nil, fmt.Errorf("cannot sign macaroon: %v", err)
 		}
 
-		err = m.AddCaveat(d.operation, d.nonce, d.location)
+		if d.publicKey != nil {
+			err = m.AddPublicKeyThirdPartyCaveat(d.publicKey, d.operation, d.location)
+		} else if d.rootKey != nil {
+			err = m.AddThirdPartyCaveat(d.rootKey, d.operation, d.location)
+		} else {
+			err = m.AddCaveat(d.operation, d.nonce, d.location)
+		}
 		if err != nil {
 			return nil, fmt.Errorf("cannot add third-party caveat: %v", err)
 		}
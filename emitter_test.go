@@ -5,7 +5,7 @@ import (
 )
 
 type EmitterTestSuite struct {
-	key []byte
+	key *SecretKey
 	selector []byte
 	operations [][]byte
 }
@@ -16,7 +16,8 @@ func (suite *EmitterTestSuite) SetUpSuite(c *check.C) {
 	k, err := RandomKey(32)
 	c.Assert(err, check.IsNil)
 	
-	suite.key = MakeKey(k)
+	suite.key, err = DeriveKey(k)
+	c.Assert(err, check.IsNil)
 
 	suite.selector = []byte("123456789012")
 	suite.operations = [][]byte{[]byte("invoice12345678"), []byte("das0987654321")}
@@ -5,8 +5,8 @@ go 1.13
 require (
 	github.com/dcpn-io/threshold v0.0.0-20191016132805-6bfc8d533a76
 	github.com/decred/dcrd/dcrec/secp256k1 v1.0.3
-	github.com/frankban/quicktest v1.5.0
-	github.com/google/go-cmp v0.3.1
+	github.com/frankban/quicktest v1.10.2
+	github.com/google/go-cmp v0.5.8
 	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 	golang.org/x/sys v0.0.0-20191010194322-b09406accb47 // indirect
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15
@@ -0,0 +1,121 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+)
+
+// A holder key caveat binds a macaroon to the public key of its holder,
+// such as the key of a card or a terminal, so that a stolen macaroon can
+// not be replayed without the holder private key. The caveat condition
+// is
+//
+//	holder-key <algorithm> <hex-encoded public key>
+//
+// The holder proves possession of the key by signing a challenge, which
+// is either a fresh nonce supplied by the verifier or the digest of the
+// request, with the SignData method of an EcdsaSigner, Ed25519Signer,
+// SchnorrSigner or SlhDsaSigner. HolderContext checks the proof when
+// VerifyMacaroon processes the caveat.
+
+var holderKeyPrefix = []byte("holder-key ")
+
+var holderProofTag = []byte("macaroon-pass/holder-proof/v1")
+
+// HolderKeyCaveat returns the condition of a caveat which binds a
+// macaroon to the given holder public key.
+func HolderKeyCaveat(alg Algorithm, pubKey []byte) ([]byte, error) {
+	if _, ok := coSignatureVerifiers[alg]; !ok {
+		return nil, fmt.Errorf("algorithm %q cannot sign holder proofs", alg)
+	}
+	if alg == AlgorithmEcdsa {
+		key, err := secp256k1.ParsePubKey(pubKey)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse public key: %v", err)
+		}
+		pubKey = key.SerializeCompressed()
+	}
+	cond := append([]byte(nil), holderKeyPrefix...)
+	cond = append(cond, alg...)
+	cond = append(cond, ' ')
+	return append(cond, hex.EncodeToString(pubKey)...), nil
+}
+
+func isHolderKeyCaveat(cond []byte) bool {
+	return bytes.HasPrefix(cond, holderKeyPrefix)
+}
+
+func parseHolderKeyCaveat(cond []byte) (Algorithm, []byte, error) {
+	fields := bytes.Split(cond[len(holderKeyPrefix):], []byte(" "))
+	if len(fields) != 2 {
+		return "", nil, fmt.Errorf("invalid holder key caveat %q", cond)
+	}
+	pubKey, err := hex.DecodeString(string(fields[1]))
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid holder key caveat %q", cond)
+	}
+	return Algorithm(fields[0]), pubKey, nil
+}
+
+// holderProofDigest returns the data signed by the holder.
+func holderProofDigest(challenge []byte) []byte {
+	return taggedHash(holderProofTag, challenge)
+}
+
+// SignHolderProof signs the challenge with the holder key, proving
+// possession of the key bound by a holder key caveat.
+func SignHolderProof(signer Signer, challenge []byte) ([]byte, error) {
+	if len(challenge) == 0 {
+		return nil, fmt.Errorf("no challenge was passed when sign holder proof")
+	}
+	return signer.SignData(holderProofDigest(challenge))
+}
+
+// HolderContext is a Context which checks holder key caveats against a
+// proof made by SignHolderProof. Other caveats, signatures and discharge
+// macaroons are handled by the embedded Context.
+type HolderContext struct {
+	Context
+	challenge []byte
+	proof     []byte
+}
+
+// NewHolderContext creates a context which accepts holder key caveats
+// if proof is a signature of challenge by the holder key. The challenge
+// must be fresh for every verification.
+func NewHolderContext(ctx Context, challenge, proof []byte) *HolderContext {
+	return &HolderContext{
+		Context:   ctx,
+		challenge: challenge,
+		proof:     proof,
+	}
+}
+
+// Unwrap returns the embedded Context.
+func (c *HolderContext) Unwrap() Context {
+	return c.Context
+}
+
+func (c *HolderContext) ProcessOperation(op []byte) error {
+	if !isHolderKeyCaveat(op) {
+		return c.Context.ProcessOperation(op)
+	}
+	alg, pubKey, err := parseHolderKeyCaveat(op)
+	if err != nil {
+		return err
+	}
+	verify, ok := coSignatureVerifiers[alg]
+	if !ok {
+		return fmt.Errorf("algorithm %q cannot sign holder proofs", alg)
+	}
+	if len(c.challenge) == 0 || len(c.proof) == 0 {
+		return fmt.Errorf("no holder proof")
+	}
+	if err := verify(pubKey, holderProofDigest(c.challenge), c.proof); err != nil {
+		return fmt.Errorf("invalid holder proof: %v", err)
+	}
+	return nil
+}
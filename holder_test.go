@@ -0,0 +1,108 @@
+package macaroon_pass
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+func newHolderTestContext(c *qt.C, key, selector []byte) Context {
+	r := NewKeyring()
+	err := r.Add(&Key{
+		Id:        "card",
+		Selector:  selector,
+		Algorithm: AlgorithmHmacSha256,
+		Material:  key,
+	})
+	c.Assert(err, qt.IsNil)
+	return NewResolverContext(r, operationContext{map[string]bool{"amount 100": true}})
+}
+
+func TestHolderKeyCaveat(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("card key"))
+	selector := []byte("card 0001")
+	ctx := newHolderTestContext(c, key.bytes(), selector)
+
+	holderPub, holderPriv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, qt.IsNil)
+	holder, err := NewEd25519Signer(NewSecretKey(holderPriv))
+	c.Assert(err, qt.IsNil)
+
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, selector)
+	c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+	c.Assert(emt.BindToHolder(AlgorithmEd25519, holderPub), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	challenge := randomBytes(32)
+	proof, err := SignHolderProof(holder, challenge)
+	c.Assert(err, qt.IsNil)
+	c.Assert(VerifyMacaroon(m, NewHolderContext(ctx, challenge, proof), nil), qt.IsNil)
+
+	// Without a proof the macaroon is rejected, even if the caller
+	// claims the holder key caveat as an operation.
+	cond, err := HolderKeyCaveat(AlgorithmEd25519, holderPub)
+	c.Assert(err, qt.IsNil)
+	err = VerifyMacaroon(m, ctx, [][]byte{cond})
+	c.Assert(err, qt.ErrorMatches, `condition is not met holder-key ed25519 [0-9a-f]+: operation .* is not allowed`)
+	err = VerifyMacaroon(m, NewHolderContext(ctx, challenge, nil), [][]byte{cond})
+	c.Assert(err, qt.ErrorMatches, `condition is not met holder-key ed25519 [0-9a-f]+: no holder proof`)
+
+	// A proof over another challenge, or by another key, is rejected.
+	err = VerifyMacaroon(m, NewHolderContext(ctx, randomBytes(32), proof), nil)
+	c.Assert(err, qt.ErrorMatches, `condition is not met .*: invalid holder proof: wrong signature`)
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, qt.IsNil)
+	thief, err := NewEd25519Signer(NewSecretKey(otherPriv))
+	c.Assert(err, qt.IsNil)
+	proof, err = SignHolderProof(thief, challenge)
+	c.Assert(err, qt.IsNil)
+	err = VerifyMacaroon(m, NewHolderContext(ctx, challenge, proof), nil)
+	c.Assert(err, qt.ErrorMatches, `condition is not met .*: invalid holder proof: wrong signature`)
+
+	// Other caveats are still checked by the wrapped context.
+	ctx = NewResolverContext(ctx.(*ResolverContext).resolver, operationContext{})
+	proof, err = SignHolderProof(holder, challenge)
+	c.Assert(err, qt.IsNil)
+	err = VerifyMacaroon(m, NewHolderContext(ctx, challenge, proof), nil)
+	c.Assert(err, qt.ErrorMatches, `condition is not met amount 100: operation "amount 100" is not allowed`)
+}
+
+func TestHolderKeyCaveatEcdsa(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("card key"))
+	selector := []byte("card 0001")
+	ctx := newHolderTestContext(c, key.bytes(), selector)
+
+	// A terminal holds an ECDSA key.
+	holderKey, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, holderPub := secp256k1.PrivKeyFromBytes(holderKey.bytes())
+	holder := NewEcdsaSigner(holderKey)
+
+	m := emitHmacMacaroon(c, key, selector, "amount 100")
+	signer, err := DeriveHmacSha256Signer(m)
+	c.Assert(err, qt.IsNil)
+	cond, err := HolderKeyCaveat(AlgorithmEcdsa, holderPub.SerializeUncompressed())
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(cond), qt.Equals, "holder-key ecdsa-secp256k1 "+hex.EncodeToString(holderPub.SerializeCompressed()))
+	c.Assert(m.AddFirstPartyCaveat(cond), qt.IsNil)
+	c.Assert(m.Sign(signer), qt.IsNil)
+
+	requestDigest := []byte("digest of the payment request")
+	proof, err := SignHolderProof(holder, requestDigest)
+	c.Assert(err, qt.IsNil)
+	c.Assert(VerifyMacaroon(m, NewHolderContext(ctx, requestDigest, proof), nil), qt.IsNil)
+
+	_, err = HolderKeyCaveat(AlgorithmHmacSha256, key.bytes())
+	c.Assert(err, qt.ErrorMatches, `algorithm "hmac-sha256" cannot sign holder proofs`)
+	_, err = SignHolderProof(holder, nil)
+	c.Assert(err, qt.ErrorMatches, "no challenge was passed when sign holder proof")
+}
@@ -0,0 +1,196 @@
+package macaroon_pass
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+)
+
+// Hybrid macaroons combine a publicly verifiable root with cheap HMAC
+// attenuation.
+//
+// The issuer signs the macaroon id with its ECDSA key and embeds the
+// root signature in the id of the macaroon. The root signature then
+// keys an HMAC chain built exactly like the one of HmacSha256Signer:
+// the root key of the chain is HMAC(chainKey, rootSignature), where
+// chainKey is a secret shared by the issuer and the verifiers. Holders
+// add caveats with DeriveHmacSha256Signer as for any HMAC macaroon.
+//
+// Since the root signature is part of the macaroon, it can not be the
+// HMAC key by itself, otherwise any holder could recompute the chain
+// and remove caveats. So there are two levels of verification:
+//
+//  - HybridRootVerify needs only the issuer public key. It proves that
+//    the issuer minted the macaroon id, but caveats are not checked,
+//    so it must only be relied on for what the id grants by itself.
+//  - HybridSignatureVerify needs the issuer public key and the chain
+//    key. It checks the root signature and every caveat of the chain.
+//
+// In a multi-merchant deployment every merchant can check that a
+// macaroon was issued by the issuer, while the chain key is given only
+// to the verifiers which enforce caveats.
+//
+// The id of a hybrid macaroon has the following format. All entries
+// other than the version are packets as parsed by parsePacketV2.
+//
+// version [1 byte]
+// identifier
+// signature
+
+const hybridIdVersion = 1
+
+var hybridRootTag = []byte("macaroon-pass/hybrid/v1/root")
+
+type HybridSigner struct {
+	issuer   *EcdsaSigner
+	pubKey   []byte
+	chainKey *SecretKey
+	macaroon *Macaroon
+}
+
+// NewHybridSigner creates a signer from the ECDSA issuer key and the
+// HMAC chain key shared with the verifiers.
+func NewHybridSigner(key, chainKey *SecretKey) (*HybridSigner, error) {
+	if len(chainKey.bytes()) == 0 {
+		return nil, fmt.Errorf("no chain key was passed when create hybrid signer")
+	}
+	issuer := NewEcdsaSigner(key)
+	return &HybridSigner{
+		issuer:   issuer,
+		pubKey:   issuer.PublicKey(),
+		chainKey: chainKey,
+	}, nil
+}
+
+// SignMacaroon signs the macaroon id with the issuer key, unless the id
+// already holds a root signature, and then signs the caveats with the
+// HMAC chain. A root signature which is not of the issuer is an error.
+// Note that the first call replaces the macaroon id with the id holding
+// the root signature.
+func (s *HybridSigner) SignMacaroon(m *Macaroon) error {
+	if s.macaroon != nil && s.macaroon != m {
+		return fmt.Errorf("can not sign another macaroon")
+	}
+	if s.chainKey.isDestroyed() || s.issuer.key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	var rootSig []byte
+	var err error
+	if _, _, perr := parseHybridId(m.id); perr == nil {
+		rootSig, err = hybridRootSignature(s.pubKey, m)
+	} else {
+		rootSig, err = s.issuer.SignData(hybridRootMessage(m.id))
+		if err == nil {
+			m.id = appendHybridId(m.id, rootSig)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	m.setAlgorithm(AlgorithmHybrid)
+	signatures, err := makeHmacSha256Signature(hybridChainKey(s.chainKey.bytes(), rootSig), m, 0)
+	if err != nil {
+		return err
+	}
+	s.macaroon = m
+	m.sig = signatures[len(signatures)-1]
+	return nil
+}
+
+func (s *HybridSigner) SignData(data []byte) ([]byte, error) {
+	if s.macaroon == nil || s.macaroon.sig == nil {
+		return nil, fmt.Errorf("there is still no incremental signature available")
+	}
+	return HmacSha256KeyedHash(s.macaroon.sig, data), nil
+}
+
+// HybridMacaroonId returns the id which the issuer signed, without the
+// root signature.
+func HybridMacaroonId(m *Macaroon) ([]byte, error) {
+	id, _, err := parseHybridId(m.id)
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), id...), nil
+}
+
+// HybridRootVerify checks that the issuer with the given public key
+// minted the macaroon id. It does not check the caveats.
+func HybridRootVerify(pubKey []byte, m *Macaroon) error {
+	_, err := hybridRootSignature(pubKey, m)
+	return err
+}
+
+// HybridSignatureVerify checks the root signature of the issuer and
+// the HMAC chain over all caveats of the macaroon.
+func HybridSignatureVerify(pubKey []byte, chainKey *SecretKey, m *Macaroon) error {
+	if chainKey.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	rootSig, err := hybridRootSignature(pubKey, m)
+	if err != nil {
+		return err
+	}
+	return hmacSha256SignatureVerify(hybridChainKey(chainKey.bytes(), rootSig), m)
+}
+
+// hybridRootSignature returns the root signature held in the macaroon
+// id after checking it against the issuer public key.
+func hybridRootSignature(pubKey []byte, m *Macaroon) ([]byte, error) {
+	id, rootSig, err := parseHybridId(m.id)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := secp256k1.ParseSignature(rootSig)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse signature: %v", err)
+	}
+	key, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key: %v", err)
+	}
+	hash := sha256.Sum256(hybridRootMessage(id))
+	if !sig.Verify(hash[:], key) {
+		return nil, fmt.Errorf("wrong root signature")
+	}
+	return rootSig, nil
+}
+
+// hybridRootMessage returns the message which the issuer signs.
+func hybridRootMessage(id []byte) []byte {
+	msg := make([]byte, 0, len(hybridRootTag)+len(id))
+	msg = append(msg, hybridRootTag...)
+	return append(msg, id...)
+}
+
+func hybridChainKey(chainKey, rootSig []byte) []byte {
+	return HmacSha256KeyedHash(chainKey, rootSig)
+}
+
+func appendHybridId(id, rootSig []byte) []byte {
+	data := []byte{hybridIdVersion}
+	data = appendPacketV2(data, packetV2{
+		fieldType: fieldIdentifier,
+		data:      id,
+	})
+	return appendPacketV2(data, packetV2{
+		fieldType: fieldSignature,
+		data:      rootSig,
+	})
+}
+
+func parseHybridId(data []byte) ([]byte, []byte, error) {
+	if len(data) == 0 || data[0] != hybridIdVersion {
+		return nil, nil, fmt.Errorf("macaroon id holds no root signature")
+	}
+	data, id, err := parsePacketV2(data[1:])
+	if err != nil || id.fieldType != fieldIdentifier {
+		return nil, nil, fmt.Errorf("macaroon id holds no root signature")
+	}
+	data, sig, err := parsePacketV2(data)
+	if err != nil || sig.fieldType != fieldSignature || len(data) > 0 {
+		return nil, nil, fmt.Errorf("macaroon id holds no root signature")
+	}
+	return id.data, sig.data, nil
+}
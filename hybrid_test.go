@@ -0,0 +1,100 @@
+package macaroon_pass
+
+import (
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestHybridMacaroon(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+	pubKey := pub.SerializeCompressed()
+	chainKey := MakeKey([]byte("merchant chain key"))
+
+	signer, err := NewHybridSigner(key, chainKey)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, []byte("card 0001"))
+	err = emt.AuthorizeOperation([]byte("payment"))
+	c.Assert(err, qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	id, err := HybridMacaroonId(m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(id, qt.DeepEquals, []byte("card 0001"))
+
+	err = HybridRootVerify(pubKey, m)
+	c.Assert(err, qt.IsNil)
+	err = HybridSignatureVerify(pubKey, chainKey, m)
+	c.Assert(err, qt.IsNil)
+
+	// A holder attenuates the macaroon with the HMAC chain.
+	holder, err := DeriveHmacSha256Signer(m)
+	c.Assert(err, qt.IsNil)
+	emt = RecreateEmitter(holder, m)
+	err = emt.AuthorizeOperation([]byte("amount 12000"))
+	c.Assert(err, qt.IsNil)
+	m1, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	data, err := MarshalBinary(&MacaroonSlice{[]*Macaroon{m1}})
+	c.Assert(err, qt.IsNil)
+	u, err := UnmarshalBinary(data)
+	c.Assert(err, qt.IsNil)
+	m2, err := u.Get(0)
+	c.Assert(err, qt.IsNil)
+
+	err = HybridSignatureVerify(pubKey, chainKey, m2)
+	c.Assert(err, qt.IsNil)
+
+	// Removing the holder's caveat is detected with the chain key,
+	// but not with the public key alone.
+	m3 := m2.Clone()
+	m3.caveats = m3.caveats[:1]
+	err = HybridSignatureVerify(pubKey, chainKey, m3)
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+	err = HybridRootVerify(pubKey, m3)
+	c.Assert(err, qt.IsNil)
+
+	err = HybridSignatureVerify(pubKey, MakeKey([]byte("other key")), m2)
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+
+	// The root signature of another issuer is not replaced.
+	otherKey, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	other, err := NewHybridSigner(otherKey, chainKey)
+	c.Assert(err, qt.IsNil)
+	m4 := m2.Clone()
+	err = m4.Sign(other)
+	c.Assert(err, qt.ErrorMatches, "wrong root signature")
+	c.Assert(m4.Id(), qt.DeepEquals, m2.Id())
+}
+
+func TestHybridRootVerifyErrors(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	otherKey, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, otherPub := secp256k1.PrivKeyFromBytes(otherKey.bytes())
+
+	signer, err := NewHybridSigner(key, MakeKey([]byte("chain key")))
+	c.Assert(err, qt.IsNil)
+	m := MustNew([]byte("card 0001"), "", V2)
+	err = m.Sign(signer)
+	c.Assert(err, qt.IsNil)
+
+	err = HybridRootVerify(otherPub.SerializeCompressed(), m)
+	c.Assert(err, qt.ErrorMatches, "wrong root signature")
+
+	plain := MustNew([]byte("card 0001"), "", V2)
+	err = HybridRootVerify(otherPub.SerializeCompressed(), plain)
+	c.Assert(err, qt.ErrorMatches, "macaroon id holds no root signature")
+
+	_, err = NewHybridSigner(key, nil)
+	c.Assert(err, qt.ErrorMatches, "no chain key was passed when create hybrid signer")
+}
@@ -0,0 +1,503 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyStatus holds the life cycle state of a key.
+type KeyStatus int
+
+const (
+	// KeyActive keys sign new macaroons and verify existing ones.
+	KeyActive KeyStatus = iota
+
+	// KeyRetired keys no longer sign new macaroons, but still verify
+	// the macaroons they signed.
+	KeyRetired
+
+	// KeyRevoked keys neither sign nor verify.
+	KeyRevoked
+)
+
+var keyStatusNames = map[KeyStatus]string{
+	KeyActive:  "active",
+	KeyRetired: "retired",
+	KeyRevoked: "revoked",
+}
+
+// String returns the name of the status; for example KeyRetired
+// formats as "retired".
+func (s KeyStatus) String() string {
+	if name, ok := keyStatusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("KeyStatus(%d)", int(s))
+}
+
+func parseKeyStatus(name string) (KeyStatus, error) {
+	for s, n := range keyStatusNames {
+		if n == name {
+			return s, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown key status %q", name)
+}
+
+// Key holds a key used to verify macaroons: an HMAC key for
+// HMAC-SHA256 macaroons or a public key otherwise.
+type Key struct {
+	// Id identifies the key within a keyring.
+	Id string
+
+	// Selector holds the macaroon id the key applies to.
+	Selector []byte
+
+	// Algorithm holds the algorithm the key is used with.
+	Algorithm Algorithm
+
+	// Material holds the HMAC key or the serialized public key.
+	Material []byte
+
+	// NotBefore and NotAfter bound the period in which the key may
+	// be used. The zero time leaves the period open on that side.
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	Status KeyStatus
+}
+
+// validAt reports whether the key may be used at the given time.
+func (k *Key) validAt(t time.Time) bool {
+	if !k.NotBefore.IsZero() && t.Before(k.NotBefore) {
+		return false
+	}
+	if !k.NotAfter.IsZero() && t.After(k.NotAfter) {
+		return false
+	}
+	return true
+}
+
+// redactedKey is printed in place of a Key.
+type redactedKey struct {
+	Id        string
+	Selector  []byte
+	Algorithm Algorithm
+	Material  SecretKey
+	NotBefore time.Time
+	NotAfter  time.Time
+	Status    KeyStatus
+}
+
+// Format implements fmt.Formatter. The key material is redacted, as
+// it may hold an HMAC key.
+func (k Key) Format(f fmt.State, verb rune) {
+	format := "%"
+	for _, flag := range "+-# 0" {
+		if f.Flag(int(flag)) {
+			format += string(flag)
+		}
+	}
+	fmt.Fprintf(f, format+string(verb), redactedKey{
+		Id:        k.Id,
+		Selector:  k.Selector,
+		Algorithm: k.Algorithm,
+		NotBefore: k.NotBefore,
+		NotAfter:  k.NotAfter,
+		Status:    k.Status,
+	})
+}
+
+func (k *Key) clone() *Key {
+	k1 := *k
+	k1.Selector = append([]byte(nil), k.Selector...)
+	k1.Material = append([]byte(nil), k.Material...)
+	return &k1
+}
+
+// KeyResolver finds the keys which verify macaroons with a given
+// selector.
+type KeyResolver interface {
+	// ResolveKeys returns all keys for the given selector and
+	// algorithm that may verify a macaroon at the given time.
+	ResolveKeys(selector []byte, alg Algorithm, at time.Time) ([]*Key, error)
+}
+
+// Keyring is an in-memory KeyResolver. It is safe for concurrent use.
+type Keyring struct {
+	mu   sync.RWMutex
+	keys map[string]*Key
+}
+
+func NewKeyring() *Keyring {
+	return &Keyring{keys: make(map[string]*Key)}
+}
+
+// Add adds a copy of the key to the keyring.
+func (r *Keyring) Add(key *Key) error {
+	if key.Id == "" {
+		return fmt.Errorf("key has no id")
+	}
+	if len(key.Material) == 0 {
+		return fmt.Errorf("key %q has no key material", key.Id)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[key.Id]; ok {
+		return fmt.Errorf("key %q already exists", key.Id)
+	}
+	r.keys[key.Id] = key.clone()
+	return nil
+}
+
+// Retire stops the key from signing while it still verifies.
+func (r *Keyring) Retire(id string) error {
+	return r.setStatus(id, KeyRetired)
+}
+
+// Revoke stops the key from both signing and verifying.
+func (r *Keyring) Revoke(id string) error {
+	return r.setStatus(id, KeyRevoked)
+}
+
+func (r *Keyring) setStatus(id string, status KeyStatus) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	key, ok := r.keys[id]
+	if !ok {
+		return fmt.Errorf("key %q not found", id)
+	}
+	key.Status = status
+	return nil
+}
+
+// Remove removes the key from the keyring.
+func (r *Keyring) Remove(id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[id]; !ok {
+		return fmt.Errorf("key %q not found", id)
+	}
+	delete(r.keys, id)
+	return nil
+}
+
+// replace replaces the keys with the keys of another keyring.
+func (r *Keyring) replace(other *Keyring) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = other.keys
+}
+
+// Keys returns copies of all keys, ordered by id.
+func (r *Keyring) Keys() []*Key {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	keys := make([]*Key, 0, len(r.keys))
+	for _, key := range r.keys {
+		keys = append(keys, key.clone())
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Id < keys[j].Id
+	})
+	return keys
+}
+
+// ResolveKeys implements KeyResolver. Active keys come before
+// retired ones.
+func (r *Keyring) ResolveKeys(selector []byte, alg Algorithm, at time.Time) ([]*Key, error) {
+	var keys []*Key
+	for _, key := range r.Keys() {
+		if key.Status == KeyRevoked ||
+			key.Algorithm != alg ||
+			!bytes.Equal(key.Selector, selector) ||
+			!key.validAt(at) {
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.SliceStable(keys, func(i, j int) bool {
+		return keys[i].Status < keys[j].Status
+	})
+	return keys, nil
+}
+
+// SigningKey returns the active key which signs new macaroons with the
+// given selector and algorithm. If several keys are active, the one
+// which became valid last is chosen.
+func (r *Keyring) SigningKey(selector []byte, alg Algorithm, at time.Time) (*Key, error) {
+	keys, err := r.ResolveKeys(selector, alg, at)
+	if err != nil {
+		return nil, err
+	}
+	var res *Key
+	for _, key := range keys {
+		if key.Status != KeyActive {
+			continue
+		}
+		if res == nil || key.NotBefore.After(res.NotBefore) {
+			res = key
+		}
+	}
+	if res == nil {
+		return nil, fmt.Errorf("no active key for selector %q", selector)
+	}
+	return res, nil
+}
+
+// keyringJSON defines the JSON format of a keyring file.
+type keyringJSON struct {
+	Keys []keyJSON `json:"keys"`
+}
+
+type keyJSON struct {
+	Id        string     `json:"id"`
+	Selector  string     `json:"selector64"`
+	Algorithm Algorithm  `json:"algorithm"`
+	Material  string     `json:"key64"`
+	NotBefore *time.Time `json:"not_before,omitempty"`
+	NotAfter  *time.Time `json:"not_after,omitempty"`
+	Status    string     `json:"status"`
+}
+
+// FileKeyring is a Keyring stored in a JSON file. Every change is
+// written to the file before it returns. It is safe for concurrent use.
+type FileKeyring struct {
+	path    string
+	keyring *Keyring
+
+	// mu serializes the changes and the writes of the file, so that
+	// a change is never overwritten by the write of an older state.
+	mu sync.Mutex
+}
+
+// OpenFileKeyring loads the keyring stored in the given file. If the
+// file does not exist, the keyring is empty and the file is created
+// by the first change.
+func OpenFileKeyring(path string) (*FileKeyring, error) {
+	k := &FileKeyring{path: path, keyring: NewKeyring()}
+	if err := k.Reload(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Reload replaces the keys with the content of the file.
+func (k *FileKeyring) Reload() error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	keyring := NewKeyring()
+	data, err := ioutil.ReadFile(k.path)
+	if os.IsNotExist(err) {
+		k.keyring.replace(keyring)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read keyring: %v", err)
+	}
+	var kjson keyringJSON
+	if err := json.Unmarshal(data, &kjson); err != nil {
+		return fmt.Errorf("cannot parse keyring: %v", err)
+	}
+	for _, kj := range kjson.Keys {
+		key := Key{
+			Id:        kj.Id,
+			Algorithm: kj.Algorithm,
+		}
+		if key.Selector, err = base64.RawURLEncoding.DecodeString(kj.Selector); err != nil {
+			return fmt.Errorf("invalid selector of key %q: %v", kj.Id, err)
+		}
+		if key.Material, err = base64.RawURLEncoding.DecodeString(kj.Material); err != nil {
+			return fmt.Errorf("invalid key material of key %q: %v", kj.Id, err)
+		}
+		if key.Status, err = parseKeyStatus(kj.Status); err != nil {
+			return fmt.Errorf("invalid status of key %q: %v", kj.Id, err)
+		}
+		if kj.NotBefore != nil {
+			key.NotBefore = *kj.NotBefore
+		}
+		if kj.NotAfter != nil {
+			key.NotAfter = *kj.NotAfter
+		}
+		if err := keyring.Add(&key); err != nil {
+			return err
+		}
+	}
+	k.keyring.replace(keyring)
+	return nil
+}
+
+func (k *FileKeyring) Add(key *Key) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.keyring.Add(key); err != nil {
+		return err
+	}
+	return k.save()
+}
+
+func (k *FileKeyring) Retire(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.keyring.Retire(id); err != nil {
+		return err
+	}
+	return k.save()
+}
+
+func (k *FileKeyring) Revoke(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.keyring.Revoke(id); err != nil {
+		return err
+	}
+	return k.save()
+}
+
+func (k *FileKeyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if err := k.keyring.Remove(id); err != nil {
+		return err
+	}
+	return k.save()
+}
+
+func (k *FileKeyring) Keys() []*Key {
+	return k.keyring.Keys()
+}
+
+func (k *FileKeyring) ResolveKeys(selector []byte, alg Algorithm, at time.Time) ([]*Key, error) {
+	return k.keyring.ResolveKeys(selector, alg, at)
+}
+
+func (k *FileKeyring) SigningKey(selector []byte, alg Algorithm, at time.Time) (*Key, error) {
+	return k.keyring.SigningKey(selector, alg, at)
+}
+
+// save writes the keyring to a temporary file and renames it over the
+// keyring file, so that readers never see a partially written file.
+// k.mu must be held.
+func (k *FileKeyring) save() error {
+	var kjson keyringJSON
+	for _, key := range k.keyring.Keys() {
+		kj := keyJSON{
+			Id:        key.Id,
+			Selector:  base64.RawURLEncoding.EncodeToString(key.Selector),
+			Algorithm: key.Algorithm,
+			Material:  base64.RawURLEncoding.EncodeToString(key.Material),
+			Status:    key.Status.String(),
+		}
+		if !key.NotBefore.IsZero() {
+			t := key.NotBefore
+			kj.NotBefore = &t
+		}
+		if !key.NotAfter.IsZero() {
+			t := key.NotAfter
+			kj.NotAfter = &t
+		}
+		kjson.Keys = append(kjson.Keys, kj)
+	}
+	data, err := json.MarshalIndent(kjson, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot marshal keyring: %v", err)
+	}
+	f, err := ioutil.TempFile(filepath.Dir(k.path), filepath.Base(k.path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("cannot write keyring: %v", err)
+	}
+	defer os.Remove(f.Name())
+	if err := f.Chmod(0600); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write keyring: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("cannot write keyring: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("cannot write keyring: %v", err)
+	}
+	if err := os.Rename(f.Name(), k.path); err != nil {
+		return fmt.Errorf("cannot write keyring: %v", err)
+	}
+	return nil
+}
+
+// keyVerifiers holds the verify functions of the algorithms whose
+// macaroons are verified with a single key.
+var keyVerifiers = map[Algorithm]func(key []byte, m *Macaroon) error{
+	AlgorithmHmacSha256:   macKeyVerify(AlgorithmHmacSha256),
+	AlgorithmEcdsa:        EcdsaSignatureVerify,
+	AlgorithmCompactEcdsa: CompactEcdsaSignatureVerify,
+	AlgorithmEd25519:      Ed25519SignatureVerify,
+	AlgorithmSchnorr:      SchnorrSignatureVerify,
+	AlgorithmSlhDsa:       SlhDsaSignatureVerify,
+	AlgorithmChainedEcdsa: ChainedEcdsaSignatureVerify,
+
+	AlgorithmHmacSha512_256: macKeyVerify(AlgorithmHmacSha512_256),
+	AlgorithmHmacSha3_256:   macKeyVerify(AlgorithmHmacSha3_256),
+	AlgorithmBlake2b256:     macKeyVerify(AlgorithmBlake2b256),
+}
+
+func macKeyVerify(alg Algorithm) func(key []byte, m *Macaroon) error {
+	return func(key []byte, m *Macaroon) error {
+		return macSignatureVerify(alg, key, m)
+	}
+}
+
+// ResolverContext is a Context which verifies macaroon signatures with
+// the keys found by a KeyResolver, using the macaroon id as selector.
+// Discharge macaroons and operations are handled by the embedded
+// Context.
+type ResolverContext struct {
+	Context
+	resolver KeyResolver
+	now      func() time.Time
+}
+
+func NewResolverContext(resolver KeyResolver, ctx Context) *ResolverContext {
+	return &ResolverContext{
+		Context:  ctx,
+		resolver: resolver,
+		now:      time.Now,
+	}
+}
+
+// Unwrap returns the embedded Context.
+func (c *ResolverContext) Unwrap() Context {
+	return c.Context
+}
+
+// VerifySignature tries every key resolved for the macaroon and
+// succeeds if any of them verifies it. Macaroons which record no
+// algorithm are verified with HMAC-SHA256 keys only.
+func (c *ResolverContext) VerifySignature(m *Macaroon) error {
+	alg := m.chainAlgorithm()
+	verify, ok := keyVerifiers[alg]
+	if !ok {
+		return fmt.Errorf("algorithm %q is not allowed", m.Algorithm())
+	}
+	keys, err := c.resolver.ResolveKeys(m.Id(), alg, c.now())
+	if err != nil {
+		return fmt.Errorf("cannot resolve key: %v", err)
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no key for macaroon %q", m.Id())
+	}
+	for _, key := range keys {
+		err = verify(key.Material, m)
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package macaroon_pass
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+// operationContext accepts the operations it holds and no discharge
+// macaroons. Signatures must be verified by a wrapping Context.
+type operationContext struct {
+	ops map[string]bool
+}
+
+func (c operationContext) VerifySignature(m *Macaroon) error {
+	return fmt.Errorf("no signature verification")
+}
+
+func (c operationContext) GetDischargeMacaroon(caveat *Caveat) (*Macaroon, error) {
+	return nil, fmt.Errorf("no discharge macaroon")
+}
+
+func (c operationContext) ProcessOperation(op []byte) error {
+	if !c.ops[string(op)] {
+		return fmt.Errorf("operation %q is not allowed", op)
+	}
+	return nil
+}
+
+func emitHmacMacaroon(c *qt.C, key *SecretKey, id []byte, ops ...string) *Macaroon {
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, id)
+	for _, op := range ops {
+		c.Assert(emt.AuthorizeOperation([]byte(op)), qt.IsNil)
+	}
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	return m
+}
+
+func TestKeyringRotation(t *testing.T) {
+	c := qt.New(t)
+	now := time.Date(2020, 6, 1, 0, 0, 0, 0, time.UTC)
+	selector := []byte("card 0001")
+	oldKey := MakeKey([]byte("old card key"))
+	newKey := MakeKey([]byte("new card key"))
+
+	r := NewKeyring()
+	err := r.Add(&Key{
+		Id:        "old",
+		Selector:  selector,
+		Algorithm: AlgorithmHmacSha256,
+		Material:  oldKey.bytes(),
+		NotAfter:  now.Add(24 * time.Hour),
+	})
+	c.Assert(err, qt.IsNil)
+	err = r.Add(&Key{
+		Id:        "new",
+		Selector:  selector,
+		Algorithm: AlgorithmHmacSha256,
+		Material:  newKey.bytes(),
+		NotBefore: now.Add(-time.Hour),
+	})
+	c.Assert(err, qt.IsNil)
+	err = r.Add(&Key{Id: "new", Material: newKey.bytes()})
+	c.Assert(err, qt.ErrorMatches, `key "new" already exists`)
+
+	key, err := r.SigningKey(selector, AlgorithmHmacSha256, now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key.Id, qt.Equals, "new")
+
+	mOld := emitHmacMacaroon(c, oldKey, selector, "payment")
+	mNew := emitHmacMacaroon(c, newKey, selector, "payment")
+
+	ctx := NewResolverContext(r, operationContext{map[string]bool{"payment": true}})
+	ctx.now = func() time.Time { return now }
+	c.Assert(VerifyMacaroon(mOld, ctx, nil), qt.IsNil)
+	c.Assert(VerifyMacaroon(mNew, ctx, nil), qt.IsNil)
+
+	// A retired key still verifies, but no longer signs.
+	c.Assert(r.Retire("new"), qt.IsNil)
+	c.Assert(ctx.VerifySignature(mNew), qt.IsNil)
+	key, err = r.SigningKey(selector, AlgorithmHmacSha256, now)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key.Id, qt.Equals, "old")
+
+	// Keys outside of their validity window do not verify.
+	ctx.now = func() time.Time { return now.Add(48 * time.Hour) }
+	c.Assert(ctx.VerifySignature(mOld), qt.ErrorMatches, "wrong signature")
+	c.Assert(ctx.VerifySignature(mNew), qt.IsNil)
+	ctx.now = func() time.Time { return now.Add(-2 * time.Hour) }
+	c.Assert(ctx.VerifySignature(mNew), qt.ErrorMatches, "wrong signature")
+
+	// A revoked key neither signs nor verifies.
+	ctx.now = func() time.Time { return now }
+	c.Assert(r.Revoke("new"), qt.IsNil)
+	c.Assert(ctx.VerifySignature(mNew), qt.ErrorMatches, "wrong signature")
+	c.Assert(r.Revoke("old"), qt.IsNil)
+	c.Assert(ctx.VerifySignature(mOld), qt.ErrorMatches, `no key for macaroon "card 0001"`)
+	_, err = r.SigningKey(selector, AlgorithmHmacSha256, now)
+	c.Assert(err, qt.ErrorMatches, `no active key for selector "card 0001"`)
+
+	c.Assert(r.Remove("old"), qt.IsNil)
+	c.Assert(r.Remove("old"), qt.ErrorMatches, `key "old" not found`)
+	c.Assert(r.Keys(), qt.HasLen, 1)
+}
+
+func TestResolverContextPublicKey(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+	selector := []byte("issuer 1")
+
+	emt := NewEmitter(NewEcdsaSigner(key), selector)
+	c.Assert(emt.AuthorizeOperation([]byte("payment")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	r := NewKeyring()
+	ctx := NewResolverContext(r, operationContext{map[string]bool{"payment": true}})
+	err = r.Add(&Key{
+		Id:        "issuer-1",
+		Selector:  selector,
+		Algorithm: AlgorithmEcdsa,
+		Material:  pub.SerializeCompressed(),
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(VerifyMacaroon(m, ctx, nil), qt.IsNil)
+
+	// The key is only used with the algorithm it is registered for.
+	m1 := emitHmacMacaroon(c, NewSecretKey(pub.SerializeCompressed()), selector, "payment")
+	err = VerifyMacaroon(m1, ctx, nil)
+	c.Assert(err, qt.ErrorMatches, `.*no key for macaroon "issuer 1"`)
+
+	m2 := MustNew(selector, "", V2)
+	m2.setAlgorithm(AlgorithmHybrid)
+	err = ctx.VerifySignature(m2)
+	c.Assert(err, qt.ErrorMatches, `algorithm "hybrid-ecdsa-hmac-sha256" is not allowed`)
+}
+
+func TestFileKeyring(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "keyring")
+	c.Assert(err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+
+	r, err := OpenFileKeyring(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(r.Keys(), qt.HasLen, 0)
+
+	notBefore := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	key := &Key{
+		Id:        "card-1",
+		Selector:  []byte("card 0001"),
+		Algorithm: AlgorithmHmacSha256,
+		Material:  MakeKey([]byte("card key")).bytes(),
+		NotBefore: notBefore,
+	}
+	c.Assert(r.Add(key), qt.IsNil)
+	c.Assert(r.Add(&Key{
+		Id:        "card-2",
+		Selector:  []byte("card 0002"),
+		Algorithm: AlgorithmHmacSha256,
+		Material:  MakeKey([]byte("other card key")).bytes(),
+	}), qt.IsNil)
+	c.Assert(r.Retire("card-2"), qt.IsNil)
+
+	r1, err := OpenFileKeyring(path)
+	c.Assert(err, qt.IsNil)
+	keys := r1.Keys()
+	c.Assert(keys, qt.HasLen, 2)
+	c.Assert(keys[0].Id, qt.Equals, "card-1")
+	c.Assert(keys[0].Selector, qt.DeepEquals, key.Selector)
+	c.Assert(keys[0].Material, qt.DeepEquals, key.Material)
+	c.Assert(keys[0].NotBefore.Equal(notBefore), qt.IsTrue)
+	c.Assert(keys[0].NotAfter.IsZero(), qt.IsTrue)
+	c.Assert(keys[0].Status, qt.Equals, KeyActive)
+	c.Assert(keys[1].Status, qt.Equals, KeyRetired)
+
+	m := emitHmacMacaroon(c, NewSecretKey(key.Material), key.Selector)
+	ctx := NewResolverContext(r1, operationContext{})
+	c.Assert(ctx.VerifySignature(m), qt.IsNil)
+
+	// Changes made through another keyring are seen after reload.
+	c.Assert(r.Revoke("card-1"), qt.IsNil)
+	c.Assert(ctx.VerifySignature(m), qt.IsNil)
+	c.Assert(r1.Reload(), qt.IsNil)
+	c.Assert(ctx.VerifySignature(m), qt.ErrorMatches, `no key for macaroon "card 0001"`)
+
+	err = ioutil.WriteFile(path, []byte(`{"keys":[{"id":"x","key64":"AA","status":"lost"}]}`), 0600)
+	c.Assert(err, qt.IsNil)
+	_, err = OpenFileKeyring(path)
+	c.Assert(err, qt.ErrorMatches, `invalid status of key "x": unknown key status "lost"`)
+}
+
+func TestFileKeyringConcurrentChanges(t *testing.T) {
+	c := qt.New(t)
+	dir, err := ioutil.TempDir("", "keyring")
+	c.Assert(err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "keyring.json")
+	r, err := OpenFileKeyring(path)
+	c.Assert(err, qt.IsNil)
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		c.Assert(r.Add(&Key{
+			Id:        fmt.Sprintf("card-%d", i),
+			Algorithm: AlgorithmHmacSha256,
+			Material:  []byte("card key"),
+		}), qt.IsNil)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Check(r.Revoke(fmt.Sprintf("card-%d", i)), qt.IsNil)
+		}(i)
+	}
+	wg.Wait()
+
+	// No revocation was overwritten by the write of an older state.
+	r1, err := OpenFileKeyring(path)
+	c.Assert(err, qt.IsNil)
+	for _, key := range r1.Keys() {
+		c.Assert(key.Status, qt.Equals, KeyRevoked, qt.Commentf("key %s", key.Id))
+	}
+}
+
+func TestKeyIsRedacted(t *testing.T) {
+	c := qt.New(t)
+	key := &Key{
+		Id:        "card-1",
+		Selector:  []byte("card 0001"),
+		Algorithm: AlgorithmHmacSha256,
+		Material:  []byte("very secret key"),
+	}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%x"} {
+		for _, k := range []interface{}{key, *key} {
+			s := fmt.Sprintf(format, k)
+			c.Assert(s, qt.Not(qt.Contains), "very secret key", qt.Commentf("format %s", format))
+			c.Assert(s, qt.Not(qt.Contains), fmt.Sprintf("%x", "very secret key"), qt.Commentf("format %s", format))
+		}
+	}
+	c.Assert(fmt.Sprintf("%+v", key), qt.Contains, "Id:card-1")
+	c.Assert(fmt.Sprintf("%+v", key), qt.Contains, "Material:SecretKey(REDACTED)")
+}
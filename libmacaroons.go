@@ -0,0 +1,151 @@
+package macaroon_pass
+
+import (
+	"crypto/hmac"
+	"fmt"
+)
+
+// The HMAC chain of HmacSha256Signer keys the first link with the root
+// key itself and signs every caveat with HMAC(sig, vid || cid). The
+// libmacaroons and gopkg.in/macaroon.v2 libraries instead key the chain
+// with MakeKey(rootKey) and sign third-party caveats with
+// keyedHash2(sig, vid, cid), so their macaroons verify with neither.
+//
+// LibmacaroonsSigner and the Libmacaroons verify functions implement the
+// standard chain. Macaroons signed with it carry no algorithm, as the
+// upstream libraries reject unknown fields, so verifiers must know which
+// chain to check.
+
+// LibmacaroonsSigner signs macaroons with the standard libmacaroons
+// HMAC-SHA256 chain. Like HmacSha256Signer it signs only one macaroon,
+// and only adds the caveats which were not signed yet.
+type LibmacaroonsSigner struct {
+	rootKey  *SecretKey
+	macaroon *Macaroon
+	nextStep int
+}
+
+// NewLibmacaroonsSigner creates a signer from a root key of any length,
+// which is derived with MakeKey as in libmacaroons.
+func NewLibmacaroonsSigner(rootKey *SecretKey) (*LibmacaroonsSigner, error) {
+	if len(rootKey.bytes()) == 0 {
+		return nil, fmt.Errorf("no key was passed when create libmacaroons signer")
+	}
+	return &LibmacaroonsSigner{rootKey: rootKey}, nil
+}
+
+// DeriveLibmacaroonsSigner creates a signer which adds caveats to the
+// given macaroon, such as a macaroon received from an upstream library.
+func DeriveLibmacaroonsSigner(m *Macaroon) (*LibmacaroonsSigner, error) {
+	if m == nil {
+		return nil, fmt.Errorf("no macaroon was passed when derive libmacaroons signer")
+	}
+	if len(m.sig) == 0 {
+		return nil, fmt.Errorf("can not use unsigned macaroon to derive libmacaroons signer")
+	}
+	if m.chainAlgorithm() != AlgorithmHmacSha256 {
+		return nil, fmt.Errorf("can not derive libmacaroons signer for %s macaroon", m.Algorithm())
+	}
+	return &LibmacaroonsSigner{
+		macaroon: m,
+		nextStep: len(m.caveats) + 1,
+	}, nil
+}
+
+func (s *LibmacaroonsSigner) SignMacaroon(m *Macaroon) error {
+	if s.macaroon != nil && s.macaroon != m {
+		return fmt.Errorf("can not sign another macaroon")
+	}
+	if s.macaroon != nil && s.macaroon.sig == nil {
+		return fmt.Errorf("wrong libmacaroons signer state")
+	}
+
+	if s.nextStep == 0 {
+		if s.rootKey.isDestroyed() {
+			return fmt.Errorf("key was destroyed")
+		}
+		m.setAlgorithm(AlgorithmHmacSha256)
+	}
+	var key []byte
+	if s.nextStep == 0 {
+		key = makeKey(s.rootKey.bytes())
+	}
+	signatures, err := makeLibmacaroonsSignature(key, m, s.nextStep)
+	if err != nil {
+		return err
+	}
+	s.macaroon = m
+	m.sig = signatures[len(signatures)-1]
+	s.nextStep = len(m.caveats) + 1
+	return nil
+}
+
+func (s *LibmacaroonsSigner) SignData(data []byte) ([]byte, error) {
+	if s.macaroon == nil || s.macaroon.sig == nil {
+		return nil, fmt.Errorf("there is still no incremental signature available")
+	}
+	return HmacSha256KeyedHash(s.macaroon.sig, data), nil
+}
+
+// makeLibmacaroonsSignature computes the libmacaroons chain of the
+// macaroon from the derived key, starting at the given step as
+// makeMacSignature does.
+func makeLibmacaroonsSignature(key []byte, m *Macaroon, step int) ([][]byte, error) {
+	signatures := [][]byte(nil)
+
+	if step == 0 {
+		signatures = append(signatures, HmacSha256KeyedHash(key, m.id))
+		step++
+	} else if m.sig != nil {
+		signatures = append(signatures, m.sig)
+	} else {
+		return nil, fmt.Errorf("wrong libmacaroons signer state")
+	}
+
+	for i := step - 1; i < len(m.caveats); i++ {
+		cav := m.caveats[i]
+		sig := signatures[len(signatures)-1]
+		if len(cav.VerificationId) == 0 {
+			sig = HmacSha256KeyedHash(sig, cav.Id)
+		} else {
+			sig = keyedHash2(sig, cav.VerificationId, cav.Id)
+		}
+		signatures = append(signatures, sig)
+	}
+	return signatures, nil
+}
+
+// LibmacaroonsSignatureVerify verifies a macaroon signed by libmacaroons,
+// gopkg.in/macaroon.v2 or LibmacaroonsSigner with the given root key.
+// Third-party caveats are not checked; use LibmacaroonsDischargeVerify
+// for macaroons which have them.
+func LibmacaroonsSignatureVerify(rootKey *SecretKey, m *Macaroon) error {
+	if m.chainAlgorithm() != AlgorithmHmacSha256 {
+		return fmt.Errorf("algorithm %q is not allowed", m.Algorithm())
+	}
+	if rootKey.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	sig, err := makeLibmacaroonsSignature(makeKey(rootKey.bytes()), m, 0)
+	if err != nil {
+		return fmt.Errorf("signature error: %v", err)
+	}
+	if hmac.Equal(m.macSignature(sig[len(sig)-1]), m.sig) {
+		return nil
+	}
+	return fmt.Errorf("wrong signature")
+}
+
+// LibmacaroonsDischargeVerify is like HmacSha256DischargeVerify for
+// macaroons and discharge macaroons signed with the libmacaroons chain.
+// Discharge macaroons must be bound to m with Macaroon.Bind, as the
+// upstream libraries do.
+func LibmacaroonsDischargeVerify(rootKey *SecretKey, m *Macaroon, discharges []*Macaroon) error {
+	if m.chainAlgorithm() != AlgorithmHmacSha256 {
+		return fmt.Errorf("algorithm %q is not allowed", m.Algorithm())
+	}
+	if rootKey.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	return dischargeVerify(makeLibmacaroonsSignature, makeKey(rootKey.bytes()), m, discharges)
+}
@@ -0,0 +1,98 @@
+package macaroon_pass
+
+import (
+	"encoding/hex"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// The example from the libmacaroons README.
+var libmacaroonsRootKey = NewSecretKey([]byte("this is our super secret key; only we should know it"))
+
+func TestLibmacaroonsSignerVectors(t *testing.T) {
+	c := qt.New(t)
+	signer, err := NewLibmacaroonsSigner(libmacaroonsRootKey)
+	c.Assert(err, qt.IsNil)
+	m := MustNew([]byte("we used our secret key"), "http://mybank/", V2)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(hex.EncodeToString(m.Signature()), qt.Equals, "e3d9e02908526c4c0039ae15114115d97fdd68bf2ba379b342aaf0f617d0552f")
+
+	for _, test := range []struct {
+		caveat string
+		sig    string
+	}{
+		{"account = 3735928559", "1efe4763f290dbce0c1d08477367e11f4eee456a64933cf662d79772dbb82128"},
+		{"time < 2020-01-01T00:00", "b5f06c8c8ef92f6c82c6ff282cd1f8bd1849301d09a2db634ba182536a611c49"},
+		{"email = alice@example.org", "ddf553e46083e55b8d71ab822be3d8fcf21d6bf19c40d617bb9fb438934474b6"},
+	} {
+		c.Assert(m.AddFirstPartyCaveat([]byte(test.caveat)), qt.IsNil)
+		c.Assert(m.Sign(signer), qt.IsNil)
+		c.Assert(hex.EncodeToString(m.Signature()), qt.Equals, test.sig)
+	}
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmUnknown)
+	c.Assert(LibmacaroonsSignatureVerify(libmacaroonsRootKey, m), qt.IsNil)
+	c.Assert(LibmacaroonsSignatureVerify(NewSecretKey([]byte("another key")), m), qt.ErrorMatches, "wrong signature")
+	c.Assert(HmacSha256SignatureVerify(libmacaroonsRootKey, m), qt.ErrorMatches, "wrong signature")
+}
+
+// Macaroons minted by gopkg.in/macaroon.v2: a primary macaroon with a
+// third-party caveat and its bound discharge macaroon.
+const (
+	upstreamMacaroon  = "AgEOaHR0cDovL215YmFuay8CFndlIHVzZWQgb3VyIHNlY3JldCBrZXkAAhRhY2NvdW50ID0gMzczNTkyODU1OQABE2h0dHA6Ly9hdXRoLm15YmFuay8CDHVzZXIgPSBhbGljZQRIIsqNBsir0XvRp2lhtSmSq9f4Q2Ws5CpdIe1T8jiBRt7wp64tEnH_bV0SQf9-Tu-wMF_ZtfRIt8cjSWmzEV8_6-e_ISGRXIcRAAIXdGltZSA8IDIwMzAtMDEtMDFUMDA6MDAAAAYgeRvxigfj2NcNFsRb5UFM0gLv2wp1PbRe9pLp7ua_t9E"
+	upstreamDischarge = "AgETaHR0cDovL2F1dGgubXliYW5rLwIMdXNlciA9IGFsaWNlAAINaXAgPSAxMC4wLjAuMQAABiAlXoyjzYAxNSOkw0cMljWVverT2TJXigYpiSwQrAtCUw"
+)
+
+func mustUnmarshalBase64(c *qt.C, s string) *Macaroon {
+	data, err := Base64Decode([]byte(s))
+	c.Assert(err, qt.IsNil)
+	m := marshaller{&Macaroon{}}
+	c.Assert(m.UnmarshalBinary(data), qt.IsNil)
+	return m.Macaroon
+}
+
+func TestLibmacaroonsDischargeVerify(t *testing.T) {
+	c := qt.New(t)
+	m := mustUnmarshalBase64(c, upstreamMacaroon)
+	d := mustUnmarshalBase64(c, upstreamDischarge)
+
+	err := LibmacaroonsDischargeVerify(libmacaroonsRootKey, m, []*Macaroon{d})
+	c.Assert(err, qt.IsNil)
+	err = LibmacaroonsDischargeVerify(libmacaroonsRootKey, m, nil)
+	c.Assert(err, qt.ErrorMatches, `cannot find discharge macaroon for caveat "user = alice"`)
+	err = HmacSha256DischargeVerify(libmacaroonsRootKey, m, []*Macaroon{d})
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+
+	// Adding a caveat changes the signature the discharge is bound to.
+	signer, err := DeriveLibmacaroonsSigner(m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount < 100")), qt.IsNil)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(LibmacaroonsSignatureVerify(libmacaroonsRootKey, m), qt.IsNil)
+	err = LibmacaroonsDischargeVerify(libmacaroonsRootKey, m, []*Macaroon{d})
+	c.Assert(err, qt.ErrorMatches, `discharge macaroon "user = alice": wrong signature`)
+}
+
+func TestLibmacaroonsThirdPartyCaveat(t *testing.T) {
+	c := qt.New(t)
+	signer, err := NewLibmacaroonsSigner(libmacaroonsRootKey)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, []byte("we used our secret key"))
+	c.Assert(emt.AuthorizeOperation([]byte("account = 3735928559")), qt.IsNil)
+	c.Assert(emt.DelegateEncryptedAuthorization([]byte("user = alice"), "http://auth.mybank/", []byte("this is another secret key")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	// The third-party caveat is signed with keyedHash2.
+	cav := m.Caveats()[1]
+	c.Assert(m.Signature(), qt.DeepEquals, keyedHash2(HmacSha256KeyedHash(HmacSha256KeyedHash(makeKey(libmacaroonsRootKey.bytes()), m.Id()), m.Caveats()[0].Id), cav.VerificationId, cav.Id))
+
+	dischargeSigner, err := NewLibmacaroonsSigner(NewSecretKey([]byte("this is another secret key")))
+	c.Assert(err, qt.IsNil)
+	d := MustNew([]byte("user = alice"), "http://auth.mybank/", V2)
+	c.Assert(d.Sign(dischargeSigner), qt.IsNil)
+	err = LibmacaroonsDischargeVerify(libmacaroonsRootKey, m, []*Macaroon{d})
+	c.Assert(err, qt.ErrorMatches, `discharge macaroon "user = alice": wrong signature`)
+	d.Bind(m.Signature())
+	c.Assert(LibmacaroonsDischargeVerify(libmacaroonsRootKey, m, []*Macaroon{d}), qt.IsNil)
+}
@@ -0,0 +1,157 @@
+package macaroon_pass
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
+)
+
+// macFunc computes the keyed hash of data which chains the signatures
+// of a MAC macaroon.
+type macFunc func(key, data []byte) ([]byte, error)
+
+// macAlgorithms holds the keyed hashes of the algorithms which sign
+// macaroons with a MAC chain. All of them make 32-byte signatures, so
+// that the signatures can key the next link of the chain. Encrypted
+// third-party caveats are only supported by HMAC-SHA256 chains.
+var macAlgorithms = map[Algorithm]macFunc{
+	AlgorithmHmacSha256:     hmacSha256Mac,
+	AlgorithmHmacSha512_256: hmacMac(sha512.New512_256),
+	AlgorithmHmacSha3_256:   hmacMac(sha3.New256),
+	AlgorithmBlake2b256:     blake2b256Mac,
+}
+
+const macSignatureLen = 32
+
+func hmacSha256Mac(key, data []byte) ([]byte, error) {
+	return HmacSha256KeyedHash(key, data), nil
+}
+
+func hmacMac(h func() hash.Hash) macFunc {
+	return func(key, data []byte) ([]byte, error) {
+		mac := hmac.New(h, key)
+		mac.Write(data)
+		return mac.Sum(nil), nil
+	}
+}
+
+func blake2b256Mac(key, data []byte) ([]byte, error) {
+	h, err := blake2b.New256(key)
+	if err != nil {
+		return nil, fmt.Errorf("cannot use BLAKE2b key: %v", err)
+	}
+	h.Write(data)
+	return h.Sum(nil), nil
+}
+
+// MacSigner signs macaroons with the MAC chain of HmacSha256Signer, using
+// the keyed hash of the given algorithm in place of HMAC-SHA256.
+type MacSigner struct {
+	alg      Algorithm
+	mac      macFunc
+	key      *SecretKey
+	macaroon *Macaroon
+	nextStep int
+}
+
+// NewMacSigner creates a signer for one of AlgorithmHmacSha256,
+// AlgorithmHmacSha512_256, AlgorithmHmacSha3_256 and AlgorithmBlake2b256.
+// BLAKE2b keys must not be longer than 64 bytes.
+func NewMacSigner(alg Algorithm, key *SecretKey) (*MacSigner, error) {
+	mac, ok := macAlgorithms[alg]
+	if !ok {
+		return nil, fmt.Errorf("algorithm %q is not a MAC algorithm", alg)
+	}
+	if len(key.bytes()) == 0 {
+		return nil, fmt.Errorf("no key was passed when create MAC signer")
+	}
+	if _, err := mac(key.bytes(), nil); err != nil {
+		return nil, err
+	}
+	return &MacSigner{alg: alg, mac: mac, key: key}, nil
+}
+
+// DeriveMacSigner creates a signer which adds caveats to the given
+// macaroon with the algorithm recorded in it.
+func DeriveMacSigner(m *Macaroon) (*MacSigner, error) {
+	if m == nil {
+		return nil, fmt.Errorf("no macaroon was passed when derive MAC signer")
+	}
+	if len(m.sig) == 0 {
+		return nil, fmt.Errorf("can not use unsigned macaroon to derive MAC signer")
+	}
+	mac, ok := macAlgorithms[m.chainAlgorithm()]
+	if !ok {
+		return nil, fmt.Errorf("algorithm %q is not a MAC algorithm", m.Algorithm())
+	}
+	return &MacSigner{
+		alg:      m.chainAlgorithm(),
+		mac:      mac,
+		macaroon: m,
+		nextStep: len(m.caveats) + 1,
+	}, nil
+}
+
+func (s *MacSigner) SignMacaroon(m *Macaroon) error {
+	if s.macaroon != nil && s.macaroon != m {
+		return fmt.Errorf("can not sign another macaroon")
+	}
+	if s.macaroon != nil && s.macaroon.sig == nil {
+		return fmt.Errorf("wrong MAC signer state")
+	}
+
+	if s.nextStep == 0 {
+		if s.key.isDestroyed() {
+			return fmt.Errorf("key was destroyed")
+		}
+		m.setAlgorithm(s.alg)
+	}
+	signatures, err := makeMacSignature(s.mac, s.key.bytes(), m, s.nextStep)
+	if err != nil {
+		return err
+	}
+	s.macaroon = m
+	m.sig = signatures[len(signatures)-1]
+	s.nextStep = len(m.caveats) + 1
+	return nil
+}
+
+func (s *MacSigner) SignData(data []byte) ([]byte, error) {
+	if s.macaroon == nil || s.macaroon.sig == nil {
+		return nil, fmt.Errorf("there is still no incremental signature available")
+	}
+	return s.mac(s.macaroon.sig, data)
+}
+
+// MacSignatureVerify verifies a macaroon signed by MacSigner with the
+// given algorithm. The MAC chain does not cover the algorithm recorded
+// in the macaroon, so the caller passes the algorithm of the key and
+// macaroons which record another one are rejected.
+func MacSignatureVerify(alg Algorithm, key *SecretKey, m *Macaroon) error {
+	if key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	return macSignatureVerify(alg, key.bytes(), m)
+}
+
+func macSignatureVerify(alg Algorithm, key []byte, m *Macaroon) error {
+	mac, ok := macAlgorithms[alg]
+	if !ok {
+		return fmt.Errorf("algorithm %q is not a MAC algorithm", alg)
+	}
+	if m.chainAlgorithm() != alg {
+		return fmt.Errorf("macaroon algorithm %q does not match %q", m.chainAlgorithm(), alg)
+	}
+	sig, err := makeMacSignature(mac, key, m, 0)
+	if err != nil {
+		return fmt.Errorf("signature error: %v", err)
+	}
+	if hmac.Equal(m.macSignature(sig[len(sig)-1]), m.sig) {
+		return nil
+	}
+	return fmt.Errorf("wrong signature")
+}
@@ -0,0 +1,125 @@
+package macaroon_pass
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+var macSignerTests = []struct {
+	alg Algorithm
+	sig string
+}{{
+	alg: AlgorithmHmacSha512_256,
+	sig: "5a49c76c703bee269c2583fc84c5b2dcff4b40958d3220e60befb95cc725f4c1",
+}, {
+	alg: AlgorithmHmacSha3_256,
+	sig: "be72eb6e2c1febecd46794f86a3fff2548de23bb1c5673c940bf87f47e563c23",
+}, {
+	alg: AlgorithmBlake2b256,
+	sig: "57a1bea133356f72ea440595e241f87201a64f1943d15ef9785114002fb2ac07",
+}}
+
+func TestMacSigner(t *testing.T) {
+	c := qt.New(t)
+	k := make([]byte, 32)
+	for i := range k {
+		k[i] = byte(i)
+	}
+	key := NewSecretKey(k)
+	for i, test := range macSignerTests {
+		c.Logf("test %d: %s", i, test.alg)
+		signer, err := NewMacSigner(test.alg, key)
+		c.Assert(err, qt.IsNil)
+		emt := NewEmitter(signer, []byte("some id"))
+		c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+		m, err := emt.EmitMacaroon()
+		c.Assert(err, qt.IsNil)
+		c.Assert(m.Algorithm(), qt.Equals, test.alg)
+		c.Assert(hex.EncodeToString(m.Signature()), qt.Equals, test.sig)
+		c.Assert(MacSignatureVerify(test.alg, key, m), qt.IsNil)
+
+		// The algorithm survives marshaling, so the holder and the
+		// verifier use the same keyed hash.
+		data, err := MarshalBinary(&MacaroonSlice{[]*Macaroon{m}})
+		c.Assert(err, qt.IsNil)
+		ms, err := UnmarshalBinary(data)
+		c.Assert(err, qt.IsNil)
+		m, err = ms.Get(0)
+		c.Assert(err, qt.IsNil)
+
+		holder, err := DeriveMacSigner(m)
+		c.Assert(err, qt.IsNil)
+		emt = RecreateEmitter(holder, m)
+		c.Assert(emt.AuthorizeOperation([]byte("merchant 42")), qt.IsNil)
+		m, err = emt.EmitMacaroon()
+		c.Assert(err, qt.IsNil)
+		c.Assert(MacSignatureVerify(test.alg, key, m), qt.IsNil)
+
+		_, err = DeriveHmacSha256Signer(m)
+		c.Assert(err, qt.ErrorMatches, "can not derive HMAC SHA256 signer for "+string(test.alg)+" macaroon")
+
+		// The verifier picks the keyed hash, not the macaroon.
+		err = MacSignatureVerify(AlgorithmHmacSha256, key, m)
+		c.Assert(err, qt.ErrorMatches, `macaroon algorithm "`+string(test.alg)+`" does not match "hmac-sha256"`)
+		m.setAlgorithm(AlgorithmHmacSha256)
+		c.Assert(MacSignatureVerify(test.alg, key, m), qt.ErrorMatches, `macaroon algorithm "hmac-sha256" does not match "`+string(test.alg)+`"`)
+	}
+}
+
+func TestMacSignerHmacSha256(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("secret"))
+	signer, err := NewMacSigner(AlgorithmHmacSha256, key)
+	c.Assert(err, qt.IsNil)
+	m := MustNew([]byte("some id"), "", V2)
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 100")), qt.IsNil)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(HmacSha256SignatureVerify(key, m), qt.IsNil)
+	c.Assert(MacSignatureVerify(AlgorithmHmacSha256, key, m), qt.IsNil)
+}
+
+func TestMacSignerErrors(t *testing.T) {
+	c := qt.New(t)
+	_, err := NewMacSigner(AlgorithmEcdsa, NewSecretKey([]byte("key")))
+	c.Assert(err, qt.ErrorMatches, `algorithm "ecdsa-secp256k1" is not a MAC algorithm`)
+	_, err = NewMacSigner(AlgorithmBlake2b256, nil)
+	c.Assert(err, qt.ErrorMatches, "no key was passed when create MAC signer")
+	_, err = NewMacSigner(AlgorithmBlake2b256, NewSecretKey(make([]byte, 65)))
+	c.Assert(err, qt.ErrorMatches, "cannot use BLAKE2b key: .*")
+
+	m := MustNew([]byte("some id"), "", V2)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Sign(NewEcdsaSigner(key)), qt.IsNil)
+	_, err = DeriveMacSigner(m)
+	c.Assert(err, qt.ErrorMatches, `algorithm "ecdsa-secp256k1" is not a MAC algorithm`)
+	err = MacSignatureVerify(AlgorithmEcdsa, key, m)
+	c.Assert(err, qt.ErrorMatches, `algorithm "ecdsa-secp256k1" is not a MAC algorithm`)
+	err = MacSignatureVerify(AlgorithmBlake2b256, key, m)
+	c.Assert(err, qt.ErrorMatches, `macaroon algorithm "ecdsa-secp256k1" does not match "blake2b-256"`)
+}
+
+func TestJSONSignatureLength(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+	m := MustNew([]byte("some id"), "", V2)
+	c.Assert(m.Sign(NewEcdsaSigner(key)), qt.IsNil)
+
+	// ECDSA signatures are longer than the HMAC SHA256 ones.
+	data, err := json.Marshal(&marshaller{m})
+	c.Assert(err, qt.IsNil)
+	m1 := marshaller{&Macaroon{}}
+	err = json.Unmarshal(data, &m1)
+	c.Assert(err, qt.IsNil)
+	c.Assert(EcdsaSignatureVerify(pub.SerializeCompressed(), m1.Macaroon), qt.IsNil)
+
+	// MAC signatures still must have the length of the MAC.
+	err = json.Unmarshal([]byte(`{"i": "hello", "a": "blake2b-256", "s64": "AAAA"}`), &m1)
+	c.Assert(err, qt.ErrorMatches, "signature has unexpected length 3")
+}
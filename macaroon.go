@@ -9,7 +9,9 @@ package macaroon_pass
 
 import (
 	"bytes"
+	"crypto/rand"
 	"fmt"
+	"io"
 	"unicode/utf8"
 )
 
@@ -22,8 +24,14 @@ type Macaroon struct {
 	location string
 	id       []byte
 	caveats  []Caveat
-	sig      []byte
-	version  Version
+	sig       []byte
+	version   Version
+	algorithm Algorithm
+
+	// boundTo holds the signature of the primary macaroon while a
+	// discharge macaroon is signed by SignBound or verified by
+	// VerifyMacaroon. It is never serialized.
+	boundTo []byte
 }
 
 // Equal reports whether m has exactly the same content as m1.
@@ -35,6 +43,7 @@ func (m *Macaroon) Equal(m1 *Macaroon) bool {
 		!bytes.Equal(m.id, m1.id) ||
 		!bytes.Equal(m.sig, m1.sig) ||
 		m.version != m1.version ||
+		m.algorithm != m1.algorithm ||
 		len(m.caveats) != len(m1.caveats) {
 		return false
 	}
@@ -217,21 +226,35 @@ func (m *Macaroon) AddFirstPartyCaveat(condition []byte) error {
 // way, either by encrypting it with a key known to the third party
 // or by holding a reference to it stored in the third party's
 // storage.
-//func (m *Macaroon) AddThirdPartyCaveat(rootKey, caveatId []byte, loc string) error {
-//	return m.addThirdPartyCaveatWithRand(rootKey, caveatId, loc, rand.Reader)
-//}
 //
-//// addThirdPartyCaveatWithRand adds a third-party caveat to the macaroon, using
-//// the given source of randomness for encrypting the caveat id.
-//func (m *Macaroon) addThirdPartyCaveatWithRand(rootKey, caveatId []byte, loc string, r io.Reader) error {
-//	derivedKey := MakeKey(rootKey)
-//	verificationId, err := encrypt(&m.sig, derivedKey, r)
-//	if err != nil {
-//		return err
-//	}
-//	m.AddCaveat(caveatId, verificationId, loc)
-//	return nil
-//}
+// As in libmacaroons, the verification id holds the root key encrypted
+// under the current signature, so the macaroon must be signed with an
+// HMAC-SHA256 chain before the caveat is added, and signed again after.
+func (m *Macaroon) AddThirdPartyCaveat(rootKey, caveatId []byte, loc string) error {
+	return m.addThirdPartyCaveatWithRand(rootKey, caveatId, loc, rand.Reader)
+}
+
+// addThirdPartyCaveatWithRand adds a third-party caveat to the macaroon, using
+// the given source of randomness for encrypting the caveat id.
+func (m *Macaroon) addThirdPartyCaveatWithRand(rootKey, caveatId []byte, loc string, r io.Reader) error {
+	switch m.chainAlgorithm() {
+	case AlgorithmHmacSha256, AlgorithmHybrid:
+	default:
+		return fmt.Errorf("cannot add encrypted third-party caveat to %s macaroon", m.Algorithm())
+	}
+	if len(m.sig) != hashLen {
+		return fmt.Errorf("cannot add encrypted third-party caveat to unsigned macaroon")
+	}
+	var sig [keyLen]byte
+	copy(sig[:], m.sig)
+	var derivedKey [hashLen]byte
+	copy(derivedKey[:], makeKey(rootKey))
+	verificationId, err := encrypt(&sig, &derivedKey, r)
+	if err != nil {
+		return err
+	}
+	return m.AddCaveat(caveatId, verificationId, loc)
+}
 
 var zeroKey [hashLen]byte
 
@@ -306,6 +329,46 @@ func (m *Macaroon) Sign(signer Signer) error {
 	return nil
 }
 
+// SignBound signs a discharge macaroon bound to rootSig, the signature
+// of the primary macaroon it is used with, so that it can not be used
+// with any other macaroon. Macaroons signed with a MAC chain are signed
+// and then bound with Bind, as in libmacaroons. Public-key signers sign
+// the digest together with rootSig instead, since their signatures can
+// not be bound afterwards. No caveats can be added after SignBound.
+func (m *Macaroon) SignBound(signer Signer, rootSig []byte) error {
+	if len(rootSig) == 0 {
+		return fmt.Errorf("no primary signature was passed when sign bound macaroon")
+	}
+	m.boundTo = rootSig
+	err := signer.SignMacaroon(m)
+	m.boundTo = nil
+	if err != nil {
+		return err
+	}
+	if isMacAlgorithm(m.chainAlgorithm()) {
+		m.Bind(rootSig)
+	}
+	return nil
+}
+
+// BoundTo returns the signature of the primary macaroon that a
+// discharge macaroon passed to Context.VerifySignature is bound to, or
+// nil for a primary macaroon. The signature must be verified bound to
+// it, as the verify functions of this package do.
+func (m *Macaroon) BoundTo() []byte {
+	return m.boundTo
+}
+
+// macSignature returns the signature a macaroon with the given MAC
+// chain signature must carry, which is bound to the primary signature
+// while a discharge macaroon is verified.
+func (m *Macaroon) macSignature(sig []byte) []byte {
+	if m.boundTo == nil {
+		return sig
+	}
+	return bindForRequest(m.boundTo, sig)
+}
+
 func (m *Macaroon) EraseSignature() {
 	m.sig = nil
 }
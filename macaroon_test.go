@@ -70,33 +70,108 @@ func TestNoCaveats(t *testing.T) {
 //	c.Assert(tested["not met"], qt.Equals, true)
 //}
 //
-//func TestThirdPartyCaveat(t *testing.T) {
-//	c := qt.New(t)
-//	rootKey := []byte("secret")
-//	m := MustNew(rootKey, []byte("some id"), "a location", LatestVersion)
-//
-//	dischargeRootKey := []byte("shared root key")
-//	thirdPartyCaveatId := []byte("3rd party caveat")
-//	err := m.AddThirdPartyCaveat(dischargeRootKey, thirdPartyCaveatId, "remote.com")
-//	c.Assert(err, qt.IsNil)
-//
-//	marsh := MustNew(dischargeRootKey, thirdPartyCaveatId, "remote location", LatestVersion)
-//	dm := &marsh.Macaroon
-//	dm.Bind(m.Signature())
-//	err = m.Verify(rootKey, never, []*Macaroon{dm})
-//	c.Assert(err, qt.IsNil)
-//}
-//
-//func TestThirdPartyCaveatBadRandom(t *testing.T) {
-//	c := qt.New(t)
-//	rootKey := []byte("secret")
-//	m := MustNew(rootKey, []byte("some id"), "a location", LatestVersion)
-//	dischargeRootKey := []byte("shared root key")
-//	thirdPartyCaveatId := []byte("3rd party caveat")
-//
-//	err := m.addThirdPartyCaveatWithRand(dischargeRootKey, thirdPartyCaveatId, "remote.com", &ErrorReader{})
-//	c.Assert(err, qt.ErrorMatches, "cannot generate random bytes: fail")
-//}
+func TestThirdPartyCaveat(t *testing.T) {
+	c := qt.New(t)
+	rootKey := []byte("secret")
+	m := MustNew([]byte("some id"), "a location", LatestVersion)
+	signer, err := NewHmacSha256Signer(MakeKey(rootKey))
+	c.Assert(err, qt.IsNil)
+	err = m.Sign(signer)
+	c.Assert(err, qt.IsNil)
+
+	dischargeRootKey := []byte("shared root key")
+	thirdPartyCaveatId := []byte("3rd party caveat")
+	err = m.AddThirdPartyCaveat(dischargeRootKey, thirdPartyCaveatId, "remote.com")
+	c.Assert(err, qt.IsNil)
+	err = m.Sign(signer)
+	c.Assert(err, qt.IsNil)
+
+	dm := MustNew(thirdPartyCaveatId, "remote location", LatestVersion)
+	dsigner, err := NewHmacSha256Signer(MakeKey(dischargeRootKey))
+	c.Assert(err, qt.IsNil)
+	err = dm.Sign(dsigner)
+	c.Assert(err, qt.IsNil)
+
+	// The discharge macaroon must be bound to the primary macaroon.
+	err = HmacSha256DischargeVerify(MakeKey(rootKey), m, []*Macaroon{dm})
+	c.Assert(err, qt.ErrorMatches, `discharge macaroon "3rd party caveat": wrong signature`)
+	dm.Bind(m.Signature())
+	err = HmacSha256DischargeVerify(MakeKey(rootKey), m, []*Macaroon{dm})
+	c.Assert(err, qt.IsNil)
+
+	err = HmacSha256DischargeVerify(MakeKey(rootKey), m, nil)
+	c.Assert(err, qt.ErrorMatches, `cannot find discharge macaroon for caveat "3rd party caveat"`)
+	err = HmacSha256DischargeVerify(MakeKey(rootKey), m, []*Macaroon{dm, dm})
+	c.Assert(err, qt.ErrorMatches, `discharge macaroon "3rd party caveat" was not used`)
+	err = HmacSha256DischargeVerify(MakeKey([]byte("other")), m, []*Macaroon{dm})
+	c.Assert(err, qt.ErrorMatches, "wrong signature")
+}
+
+func TestThirdPartyCaveatBadRandom(t *testing.T) {
+	c := qt.New(t)
+	rootKey := []byte("secret")
+	m := MustNew([]byte("some id"), "a location", LatestVersion)
+	signer, err := NewHmacSha256Signer(MakeKey(rootKey))
+	c.Assert(err, qt.IsNil)
+	err = m.Sign(signer)
+	c.Assert(err, qt.IsNil)
+	dischargeRootKey := []byte("shared root key")
+	thirdPartyCaveatId := []byte("3rd party caveat")
+
+	err = m.addThirdPartyCaveatWithRand(dischargeRootKey, thirdPartyCaveatId, "remote.com", &ErrorReader{})
+	c.Assert(err, qt.ErrorMatches, "cannot generate random bytes: fail")
+}
+
+func TestThirdPartyCaveatNeedsHmacSignature(t *testing.T) {
+	c := qt.New(t)
+	m := MustNew([]byte("some id"), "a location", LatestVersion)
+	err := m.AddThirdPartyCaveat([]byte("shared root key"), []byte("3rd party caveat"), "remote.com")
+	c.Assert(err, qt.ErrorMatches, "cannot add encrypted third-party caveat to unsigned macaroon")
+
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	err = m.Sign(NewEcdsaSigner(key))
+	c.Assert(err, qt.IsNil)
+	err = m.AddThirdPartyCaveat([]byte("shared root key"), []byte("3rd party caveat"), "remote.com")
+	c.Assert(err, qt.ErrorMatches, "cannot add encrypted third-party caveat to ecdsa-secp256k1 macaroon")
+}
+
+func TestMultilevelThirdPartyCaveat(t *testing.T) {
+	c := qt.New(t)
+	rootKey := MakeKey([]byte("secret"))
+	emt := NewEmitter(mustHmacSha256Signer(c, rootKey), []byte("some id"))
+	c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+	c.Assert(emt.DelegateEncryptedAuthorization([]byte("bank-caveat"), "bank", []byte("bank key")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	// The bank requires a discharge from the auth service.
+	emt = NewEmitter(mustHmacSha256Signer(c, MakeKey([]byte("bank key"))), []byte("bank-caveat"))
+	c.Assert(emt.DelegateEncryptedAuthorization([]byte("auth-caveat"), "auth", []byte("auth key")), qt.IsNil)
+	bank, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	auth := MustNew([]byte("auth-caveat"), "auth", LatestVersion)
+	c.Assert(auth.Sign(mustHmacSha256Signer(c, MakeKey([]byte("auth key")))), qt.IsNil)
+
+	bank.Bind(m.Signature())
+	auth.Bind(m.Signature())
+	err = HmacSha256DischargeVerify(rootKey, m, []*Macaroon{auth, bank})
+	c.Assert(err, qt.IsNil)
+
+	// Discharge macaroons bound to their direct parent are rejected.
+	auth1 := MustNew([]byte("auth-caveat"), "auth", LatestVersion)
+	c.Assert(auth1.Sign(mustHmacSha256Signer(c, MakeKey([]byte("auth key")))), qt.IsNil)
+	auth1.Bind(bank.Signature())
+	err = HmacSha256DischargeVerify(rootKey, m, []*Macaroon{auth1, bank})
+	c.Assert(err, qt.ErrorMatches, `discharge macaroon "bank-caveat": discharge macaroon "auth-caveat": wrong signature`)
+}
+
+func mustHmacSha256Signer(c *qt.C, key *SecretKey) *HmacSha256Signer {
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	return signer
+}
 
 func TestSetLocation(t *testing.T) {
 	c := qt.New(t)
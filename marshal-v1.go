@@ -25,6 +25,9 @@ type caveatJSONV1 struct {
 
 // marshalJSONV1 marshals the macaroon to the V1 JSON format.
 func (m *marshaller) marshalJSONV1() ([]byte, error) {
+	if m.algorithm != "" {
+		return nil, fmt.Errorf("cannot record algorithm %q in v1 macaroon", m.algorithm)
+	}
 	if !utf8.Valid(m.id) {
 		return nil, fmt.Errorf("macaroon id is not valid UTF-8")
 	}
@@ -156,6 +159,9 @@ func expectPacketV1(data []byte, kind string) (packetV1, error) {
 
 // appendBinaryV1 appends the binary encoding of m to data.
 func (m *marshaller) appendBinaryV1(data []byte) ([]byte, error) {
+	if m.algorithm != "" {
+		return nil, fmt.Errorf("cannot record algorithm %q in v1 macaroon", m.algorithm)
+	}
 	var ok bool
 	data, ok = appendPacketV1(data, fieldNameLocation, []byte(m.location))
 	if !ok {
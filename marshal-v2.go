@@ -15,6 +15,7 @@ type macaroonJSONV2 struct {
 	Identifier64 string         `json:"i64,omitempty"`
 	Signature    string         `json:"s,omitempty"`
 	Signature64  string         `json:"s64,omitempty"`
+	Algorithm    string         `json:"a,omitempty"`
 }
 
 // caveatJSONV2 defines the V2 JSON format for caveats within a macaroon.
@@ -28,8 +29,9 @@ type caveatJSONV2 struct {
 
 func (m *marshaller) marshalJSONV2() ([]byte, error) {
 	mjson := macaroonJSONV2{
-		Location: m.location,
-		Caveats:  make([]caveatJSONV2, len(m.caveats)),
+		Location:  m.location,
+		Caveats:   make([]caveatJSONV2, len(m.caveats)),
+		Algorithm: string(m.algorithm),
 	}
 	putJSONBinaryField(m.id, &mjson.Identifier, &mjson.Identifier64)
 	putJSONBinaryField(m.sig[:], &mjson.Signature, &mjson.Signature64)
@@ -56,11 +58,15 @@ func (m *marshaller) initJSONV2(mjson *macaroonJSONV2) error {
 		return fmt.Errorf("invalid identifier: %v", err)
 	}
 	m.init(id, mjson.Location, V2)
+	if mjson.Algorithm != "" && !isRecordableAlgorithm(Algorithm(mjson.Algorithm)) {
+		return fmt.Errorf("invalid macaroon algorithm %q", mjson.Algorithm)
+	}
+	m.algorithm = Algorithm(mjson.Algorithm)
 	sig, err := jsonBinaryField(mjson.Signature, mjson.Signature64)
 	if err != nil {
 		return fmt.Errorf("invalid signature: %v", err)
 	}
-	if len(sig) != hashLen {
+	if n := signatureLen(m.chainAlgorithm()); n != 0 && len(sig) != n {
 		return fmt.Errorf("signature has unexpected length %d", len(sig))
 	}
 	m.sig = sig
@@ -125,6 +131,7 @@ func jsonBinaryField(s, sb64 string) ([]byte, error) {
 // version [1 byte]
 // location?
 // identifier
+// algorithm?
 // eos
 // (
 //	location?
@@ -154,11 +161,24 @@ func (m *marshaller) parseBinaryV2(data []byte) ([]byte, error) {
 		loc = string(section[0].data)
 		section = section[1:]
 	}
-	if len(section) != 1 || section[0].fieldType != fieldIdentifier {
+	if len(section) == 0 || section[0].fieldType != fieldIdentifier {
 		return nil, fmt.Errorf("invalid macaroon header")
 	}
 	id := section[0].data
+	section = section[1:]
+	var alg Algorithm
+	if len(section) > 0 && section[0].fieldType == fieldAlgorithm {
+		alg = Algorithm(section[0].data)
+		if !isRecordableAlgorithm(alg) {
+			return nil, fmt.Errorf("invalid macaroon algorithm %q", alg)
+		}
+		section = section[1:]
+	}
+	if len(section) != 0 {
+		return nil, fmt.Errorf("invalid macaroon header")
+	}
 	m.init(id, loc, V2)
+	m.algorithm = alg
 	for len(data) > 0 {
 		rest, section, err := parseSectionV2(data)
 		if err != nil {
@@ -224,6 +244,12 @@ func (m *marshaller) appendBinaryV2(data []byte) []byte {
 		fieldType: fieldIdentifier,
 		data:      m.id,
 	})
+	if m.algorithm != "" {
+		data = appendPacketV2(data, packetV2{
+			fieldType: fieldAlgorithm,
+			data:      []byte(m.algorithm),
+		})
+	}
 	data = appendEOSV2(data)
 	for _, cav := range m.caveats {
 		if len(cav.Location) > 0 {
@@ -0,0 +1,284 @@
+package macaroon_pass
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+)
+
+// Multi-issuer macaroons carry independent signatures of several
+// issuers, each made with the issuer's own key over the same digest
+// calcMacaroonHash. Unlike ThresholdSigner no key is shared: verifiers
+// are configured with the public keys of n issuers and require
+// signatures from at least m of them.
+//
+// Issuers co-sign in turn with CoSigner, after all caveats are added;
+// adding a caveat invalidates every co-signature. The signature field
+// holds the following data, where all entries other than the version
+// are packets as parsed by parsePacketV2.
+//
+// version [1 byte]
+// (
+//	algorithm
+//	public key
+//	signature
+//	eos
+// )+
+
+const multiIssuerVersion = 1
+
+// Field constants as used in the multi-issuer signature encoding.
+const (
+	multiFieldAlgorithm fieldType = 1
+	multiFieldPublicKey fieldType = 2
+	multiFieldSignature fieldType = 3
+)
+
+// coSignature holds the signature of one issuer.
+type coSignature struct {
+	alg    Algorithm
+	pubKey []byte
+	sig    []byte
+}
+
+func marshalCoSignatures(sigs []coSignature) []byte {
+	data := []byte{multiIssuerVersion}
+	for _, s := range sigs {
+		data = appendPacketV2(data, packetV2{
+			fieldType: multiFieldAlgorithm,
+			data:      []byte(s.alg),
+		})
+		data = appendPacketV2(data, packetV2{
+			fieldType: multiFieldPublicKey,
+			data:      s.pubKey,
+		})
+		data = appendPacketV2(data, packetV2{
+			fieldType: multiFieldSignature,
+			data:      s.sig,
+		})
+		data = appendEOSV2(data)
+	}
+	return data
+}
+
+func parseCoSignatures(data []byte) ([]coSignature, error) {
+	if len(data) == 0 {
+		return nil, fmt.Errorf("signature is nil")
+	}
+	if data[0] != multiIssuerVersion {
+		return nil, fmt.Errorf("unknown multi-issuer signature version %d", data[0])
+	}
+	data = data[1:]
+	var sigs []coSignature
+	for len(data) > 0 {
+		rest, section, err := parseSectionV2(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse multi-issuer signature: %v", err)
+		}
+		data = rest
+		if len(section) != 3 ||
+			section[0].fieldType != multiFieldAlgorithm ||
+			section[1].fieldType != multiFieldPublicKey ||
+			section[2].fieldType != multiFieldSignature {
+			return nil, fmt.Errorf("cannot parse multi-issuer signature: invalid entry")
+		}
+		sigs = append(sigs, coSignature{
+			alg:    Algorithm(section[0].data),
+			pubKey: section[1].data,
+			sig:    section[2].data,
+		})
+	}
+	if len(sigs) == 0 {
+		return nil, fmt.Errorf("cannot parse multi-issuer signature: no signatures")
+	}
+	return sigs, nil
+}
+
+// coSignatureVerifiers verify the signatures made by the SignData method
+// of the issuer signers over a macaroon digest.
+var coSignatureVerifiers = map[Algorithm]func(pubKey, digest, sig []byte) error{
+	AlgorithmEcdsa: func(pubKey, digest, sig []byte) error {
+		key, err := secp256k1.ParsePubKey(pubKey)
+		if err != nil {
+			return fmt.Errorf("cannot parse public key: %v", err)
+		}
+		s, err := secp256k1.ParseSignature(sig)
+		if err != nil {
+			return fmt.Errorf("cannot parse signature: %v", err)
+		}
+		hash := sha256.Sum256(digest)
+		if !s.Verify(hash[:], key) {
+			return fmt.Errorf("wrong signature")
+		}
+		return nil
+	},
+	AlgorithmEd25519: func(pubKey, digest, sig []byte) error {
+		if len(pubKey) != ed25519.PublicKeySize {
+			return fmt.Errorf("cannot parse public key: wrong length %d", len(pubKey))
+		}
+		if !ed25519.Verify(ed25519.PublicKey(pubKey), digest, sig) {
+			return fmt.Errorf("wrong signature")
+		}
+		return nil
+	},
+	AlgorithmSchnorr: func(pubKey, digest, sig []byte) error {
+		hash := sha256.Sum256(digest)
+		return schnorrVerify(pubKey, hash[:], sig)
+	},
+	AlgorithmSlhDsa: func(pubKey, digest, sig []byte) error {
+		return slhDsaVerify(slhDsaShake128s, pubKey, digest, sig)
+	},
+}
+
+// CoSigner adds the signature of one issuer to a multi-issuer macaroon.
+// Signing a macaroon which is not a multi-issuer macaroon yet replaces
+// its signature.
+type CoSigner struct {
+	signer Signer
+	alg    Algorithm
+	pubKey []byte
+}
+
+// NewCoSigner creates a co-signer from an EcdsaSigner, Ed25519Signer,
+// SchnorrSigner or SlhDsaSigner.
+func NewCoSigner(signer Signer) (*CoSigner, error) {
+	s := &CoSigner{signer: signer}
+	switch signer := signer.(type) {
+	case *EcdsaSigner:
+		s.alg, s.pubKey = AlgorithmEcdsa, signer.PublicKey()
+	case *Ed25519Signer:
+		s.alg, s.pubKey = AlgorithmEd25519, signer.PublicKey()
+	case *SchnorrSigner:
+		s.alg, s.pubKey = AlgorithmSchnorr, signer.PublicKey()
+	case *SlhDsaSigner:
+		s.alg, s.pubKey = AlgorithmSlhDsa, signer.PublicKey()
+	default:
+		return nil, fmt.Errorf("cannot co-sign with %T", signer)
+	}
+	return s, nil
+}
+
+// SignMacaroon adds the signature of the issuer to the macaroon,
+// replacing any earlier signature of the same issuer.
+func (s *CoSigner) SignMacaroon(m *Macaroon) error {
+	var sigs []coSignature
+	if m.Algorithm() == AlgorithmMultiIssuer {
+		var err error
+		sigs, err = parseCoSignatures(m.sig)
+		if err != nil {
+			return err
+		}
+	}
+	m.setAlgorithm(AlgorithmMultiIssuer)
+	hash := calcMacaroonHash(m)
+	sig, err := s.signer.SignData(hash[:])
+	if err != nil {
+		return err
+	}
+	own := coSignature{alg: s.alg, pubKey: s.pubKey, sig: sig}
+	found := false
+	for i := range sigs {
+		if sigs[i].alg == s.alg && string(sigs[i].pubKey) == string(s.pubKey) {
+			sigs[i] = own
+			found = true
+		}
+	}
+	if !found {
+		sigs = append(sigs, own)
+	}
+	m.sig = marshalCoSignatures(sigs)
+	return nil
+}
+
+func (s *CoSigner) SignData(data []byte) ([]byte, error) {
+	return s.signer.SignData(data)
+}
+
+// CoIssuer identifies an issuer of multi-issuer macaroons.
+type CoIssuer struct {
+	Algorithm Algorithm
+	PublicKey []byte
+}
+
+// MultiIssuerVerifier verifies that multi-issuer macaroons are signed by
+// at least a threshold of the configured issuers. Its VerifySignature
+// method can be registered in a VerifierRegistry for
+// AlgorithmMultiIssuer.
+type MultiIssuerVerifier struct {
+	threshold int
+	issuers   []CoIssuer
+}
+
+// NewMultiIssuerVerifier creates a verifier which requires signatures of
+// threshold of the given issuers.
+func NewMultiIssuerVerifier(threshold int, issuers ...CoIssuer) (*MultiIssuerVerifier, error) {
+	if threshold < 1 || threshold > len(issuers) {
+		return nil, fmt.Errorf("invalid threshold %d of %d issuers", threshold, len(issuers))
+	}
+	v := &MultiIssuerVerifier{threshold: threshold}
+	for _, issuer := range issuers {
+		if _, ok := coSignatureVerifiers[issuer.Algorithm]; !ok {
+			return nil, fmt.Errorf("algorithm %q cannot co-sign", issuer.Algorithm)
+		}
+		pubKey := issuer.PublicKey
+		if issuer.Algorithm == AlgorithmEcdsa {
+			key, err := secp256k1.ParsePubKey(pubKey)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse public key: %v", err)
+			}
+			pubKey = key.SerializeCompressed()
+		}
+		if v.issuerIndex(issuer.Algorithm, pubKey) >= 0 {
+			return nil, fmt.Errorf("duplicate issuer %x", pubKey)
+		}
+		v.issuers = append(v.issuers, CoIssuer{
+			Algorithm: issuer.Algorithm,
+			PublicKey: append([]byte(nil), pubKey...),
+		})
+	}
+	return v, nil
+}
+
+func (v *MultiIssuerVerifier) issuerIndex(alg Algorithm, pubKey []byte) int {
+	for i, issuer := range v.issuers {
+		if issuer.Algorithm == alg && string(issuer.PublicKey) == string(pubKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+// VerifySignature verifies the macaroon signatures. Signatures of
+// unknown issuers are ignored, while a wrong signature of a configured
+// issuer fails the verification.
+func (v *MultiIssuerVerifier) VerifySignature(m *Macaroon) error {
+	if m.Algorithm() != AlgorithmMultiIssuer {
+		return fmt.Errorf("algorithm %q is not allowed", m.Algorithm())
+	}
+	sigs, err := parseCoSignatures(m.Signature())
+	if err != nil {
+		return err
+	}
+	hash := calcMacaroonHash(m)
+	signed := make([]bool, len(v.issuers))
+	count := 0
+	for _, s := range sigs {
+		i := v.issuerIndex(s.alg, s.pubKey)
+		if i < 0 {
+			continue
+		}
+		if err := coSignatureVerifiers[s.alg](s.pubKey, hash[:], s.sig); err != nil {
+			return fmt.Errorf("issuer %x: %v", s.pubKey, err)
+		}
+		if !signed[i] {
+			signed[i] = true
+			count++
+		}
+	}
+	if count < v.threshold {
+		return fmt.Errorf("macaroon is signed by %d of the %d required issuers", count, v.threshold)
+	}
+	return nil
+}
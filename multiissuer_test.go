@@ -0,0 +1,123 @@
+package macaroon_pass
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+type coIssuerTest struct {
+	signers []*CoSigner
+	issuers []CoIssuer
+}
+
+func newCoIssuerTest(c *qt.C) *coIssuerTest {
+	var t coIssuerTest
+	add := func(signer Signer, alg Algorithm, pubKey []byte) {
+		s, err := NewCoSigner(signer)
+		c.Assert(err, qt.IsNil)
+		t.signers = append(t.signers, s)
+		t.issuers = append(t.issuers, CoIssuer{Algorithm: alg, PublicKey: pubKey})
+	}
+
+	// The card issuer signs with ECDSA and is configured with its
+	// uncompressed key.
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+	add(NewEcdsaSigner(key), AlgorithmEcdsa, pub.SerializeUncompressed())
+
+	// The acquirer signs with Ed25519.
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, qt.IsNil)
+	edSigner, err := NewEd25519Signer(NewSecretKey(edPriv))
+	c.Assert(err, qt.IsNil)
+	add(edSigner, AlgorithmEd25519, edPub)
+
+	// The scheme signs with Schnorr.
+	key, err = RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	schnorrSigner, err := NewSchnorrSigner(key)
+	c.Assert(err, qt.IsNil)
+	add(schnorrSigner, AlgorithmSchnorr, schnorrSigner.PublicKey())
+	return &t
+}
+
+func newCoSignedMacaroon(c *qt.C, signers ...*CoSigner) *Macaroon {
+	m := MustNew([]byte("payment 42"), "", V2)
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 100000")), qt.IsNil)
+	for _, s := range signers {
+		c.Assert(m.Sign(s), qt.IsNil)
+	}
+	return m
+}
+
+func TestMultiIssuerVerifier(t *testing.T) {
+	c := qt.New(t)
+	ct := newCoIssuerTest(c)
+	v, err := NewMultiIssuerVerifier(2, ct.issuers...)
+	c.Assert(err, qt.IsNil)
+
+	m := newCoSignedMacaroon(c, ct.signers[0], ct.signers[1])
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmMultiIssuer)
+	c.Assert(v.VerifySignature(m), qt.IsNil)
+	m = newCoSignedMacaroon(c, ct.signers[2], ct.signers[0])
+	c.Assert(v.VerifySignature(m), qt.IsNil)
+
+	// One issuer is not enough, even if it signs twice.
+	m = newCoSignedMacaroon(c, ct.signers[1], ct.signers[1])
+	sigs, err := parseCoSignatures(m.Signature())
+	c.Assert(err, qt.IsNil)
+	c.Assert(sigs, qt.HasLen, 1)
+	c.Assert(v.VerifySignature(m), qt.ErrorMatches, "macaroon is signed by 1 of the 2 required issuers")
+	sigs = append(sigs, sigs[0])
+	m.SetSignature(marshalCoSignatures(sigs))
+	c.Assert(v.VerifySignature(m), qt.ErrorMatches, "macaroon is signed by 1 of the 2 required issuers")
+
+	// Signatures of unknown issuers do not count.
+	other := newCoIssuerTest(c)
+	m = newCoSignedMacaroon(c, ct.signers[1], other.signers[0], other.signers[1])
+	c.Assert(v.VerifySignature(m), qt.ErrorMatches, "macaroon is signed by 1 of the 2 required issuers")
+
+	// Adding a caveat invalidates all signatures.
+	m = newCoSignedMacaroon(c, ct.signers[0], ct.signers[1])
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 1")), qt.IsNil)
+	c.Assert(v.VerifySignature(m), qt.ErrorMatches, "issuer [0-9a-f]+: wrong signature")
+
+	// The signatures survive marshaling.
+	m = newCoSignedMacaroon(c, ct.signers...)
+	data, err := (&marshaller{m}).MarshalBinary()
+	c.Assert(err, qt.IsNil)
+	m1 := marshaller{&Macaroon{}}
+	c.Assert(m1.UnmarshalBinary(data), qt.IsNil)
+	v, err = NewMultiIssuerVerifier(3, ct.issuers...)
+	c.Assert(err, qt.IsNil)
+	c.Assert(v.VerifySignature(m1.Macaroon), qt.IsNil)
+
+	// A co-signature is not a signature of the single issuer.
+	m.setAlgorithm(AlgorithmEd25519)
+	m.SetSignature(sigs[0].sig)
+	c.Assert(Ed25519SignatureVerify(ct.issuers[1].PublicKey, m), qt.ErrorMatches, "wrong signature")
+	c.Assert(v.VerifySignature(m), qt.ErrorMatches, `algorithm "ed25519" is not allowed`)
+}
+
+func TestNewMultiIssuerVerifierErrors(t *testing.T) {
+	c := qt.New(t)
+	ct := newCoIssuerTest(c)
+	_, err := NewMultiIssuerVerifier(0, ct.issuers...)
+	c.Assert(err, qt.ErrorMatches, "invalid threshold 0 of 3 issuers")
+	_, err = NewMultiIssuerVerifier(4, ct.issuers...)
+	c.Assert(err, qt.ErrorMatches, "invalid threshold 4 of 3 issuers")
+	_, err = NewMultiIssuerVerifier(1, ct.issuers[0], ct.issuers[0])
+	c.Assert(err, qt.ErrorMatches, "duplicate issuer [0-9a-f]+")
+	_, err = NewMultiIssuerVerifier(1, CoIssuer{Algorithm: AlgorithmHmacSha256, PublicKey: []byte("key")})
+	c.Assert(err, qt.ErrorMatches, `algorithm "hmac-sha256" cannot co-sign`)
+
+	hmacSigner, err := NewHmacSha256Signer(MakeKey([]byte("key")))
+	c.Assert(err, qt.IsNil)
+	_, err = NewCoSigner(hmacSigner)
+	c.Assert(err, qt.ErrorMatches, `cannot co-sign with \*macaroon_pass.HmacSha256Signer`)
+}
@@ -12,6 +12,7 @@ const (
 	fieldEOS            fieldType = 0
 	fieldLocation       fieldType = 1
 	fieldIdentifier     fieldType = 2
+	fieldAlgorithm      fieldType = 3
 	fieldVerificationId fieldType = 4
 	fieldSignature      fieldType = 6
 )
@@ -2,6 +2,8 @@ package macaroon_pass
 
 import (
 	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
 	"encoding/hex"
 	"fmt"
 	"github.com/dcpn-io/threshold"
@@ -14,7 +16,7 @@ func TestMacaroonPass(t *testing.T) {
 }
 
 type PassTestSuite struct {
-	key                []byte
+	key                *SecretKey
 	hmacSha256Selector []byte
 	operations         [][]byte
 	payOp              []byte
@@ -23,6 +25,15 @@ type PassTestSuite struct {
 	priv               []byte
 	pub                []byte
 
+	ed25519Selector    []byte
+	ed25519Priv        []byte
+	ed25519Pub         []byte
+
+	thresholdSelector  []byte
+	thresholdGroup     *ThresholdGroup
+
+	registry *VerifierRegistry
+
 	cardKey []byte
 	cardId []byte
 	random []byte
@@ -37,13 +48,7 @@ type PassTestSuite struct {
 }
 
 func (s *PassTestSuite) VerifySignature (m *Macaroon) error {
-	if bytes.Equal(m.Id(), s.hmacSha256Selector) {
-		return HmacSha256SignatureVerify(s.key, m)
-	} else if bytes.Equal(m.Id(), s.ecdsaSelector) {
-		return EcdsaSignatureVerify(s.pub, m)
-	} else {
-		return fmt.Errorf("wrong test macaroon selector")
-	}
+	return s.registry.VerifySignature(m)
 }
 
 func (s *PassTestSuite) GetDischargeMacaroon (caveat *Caveat) (*Macaroon, error) {
@@ -66,7 +71,8 @@ func (s *PassTestSuite) SetUpSuite(c *check.C) {
 	k, err := RandomKey(32)
 	c.Assert(err, check.IsNil)
 
-	s.key = MakeKey(k)
+	s.key, err = DeriveKey(k)
+	c.Assert(err, check.IsNil)
 	s.hmacSha256Selector = []byte("HMAC Sha256")
 	s.operations = [][]byte{[]byte("payment"), []byte("read")}
 	s.payOp = []byte("payment")
@@ -76,6 +82,28 @@ func (s *PassTestSuite) SetUpSuite(c *check.C) {
 	s.priv = priv.Serialize()
 	s.pub = pub.Serialize()
 
+	s.ed25519Selector = []byte("Ed25519")
+	s.ed25519Pub, s.ed25519Priv, err = ed25519.GenerateKey(rand.Reader)
+	c.Assert(err, check.IsNil)
+
+	s.thresholdSelector = []byte("Threshold ECDSA")
+	s.thresholdGroup, err = NewThresholdGroup(3, 3)
+	c.Assert(err, check.IsNil)
+
+	s.registry = NewVerifierRegistry()
+	s.registry.Register(AlgorithmUnknown, func(m *Macaroon) error {
+		return HmacSha256SignatureVerify(s.key, m)
+	})
+	s.registry.Register(AlgorithmEcdsa, func(m *Macaroon) error {
+		if bytes.Equal(m.Id(), s.thresholdSelector) {
+			return EcdsaSignatureVerify(s.thresholdGroup.PublicKey(), m)
+		}
+		return EcdsaSignatureVerify(s.pub, m)
+	})
+	s.registry.Register(AlgorithmEd25519, func(m *Macaroon) error {
+		return Ed25519SignatureVerify(s.ed25519Pub, m)
+	})
+
 	s.cardKey,_ = hex.DecodeString("7f2b5755de2b52f3e843d2ba15c42f948e806a18c73b450e88258f5f45c0ffdc")
 	s.cardId,_ = hex.DecodeString("3030303030303030303030303030303030303030303033334130383130303034")
 	s.random,_ = hex.DecodeString("40C1750299AF1C704B46B96342294480DEC6DBEFCFA481FF8EB29F5431C3384918409BD18AE87FB51AFBDB5F99E39EB690975C36E07E12F99D099DBC0F8E7401")
@@ -117,7 +145,7 @@ func (s *PassTestSuite) TestAuthenticate(c *check.C) {
 }
 
 func (s *PassTestSuite) TestEcdsaSignaturePass (c *check.C) {
-	signer := NewEcdsaSigner(s.priv)
+	signer := NewEcdsaSigner(NewSecretKey(s.priv))
 	emt := NewEmitter(signer, s.ecdsaSelector)
 	
 	err := emt.AuthorizeOperation(s.operations[0])
@@ -141,6 +169,66 @@ func (s *PassTestSuite) TestEcdsaSignaturePass (c *check.C) {
 	c.Assert(err, check.IsNil)
 }
 
+func (s *PassTestSuite) TestEd25519SignaturePass(c *check.C) {
+	signer, err := NewEd25519Signer(NewSecretKey(s.ed25519Priv))
+	c.Assert(err, check.IsNil)
+	c.Assert(signer.PublicKey(), check.DeepEquals, s.ed25519Pub)
+
+	emt := NewEmitter(signer, s.ed25519Selector)
+
+	err = emt.AuthorizeOperation(s.operations[0])
+	c.Assert(err, check.IsNil)
+	err = emt.AuthorizeOperation(s.operations[1])
+	c.Assert(err, check.IsNil)
+
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, check.IsNil)
+
+	buf, err := MarshalBinary(&MacaroonSlice{[]*Macaroon{m}})
+	c.Assert(err, check.IsNil)
+
+	u, err := UnmarshalBinary(buf)
+	c.Assert(err, check.IsNil)
+
+	um, err := u.Get(0)
+	c.Assert(err, check.IsNil)
+
+	err = VerifyMacaroon(um, s, s.operations)
+	c.Assert(err, check.IsNil)
+
+	err = um.AddFirstPartyCaveat([]byte("payment"))
+	c.Assert(err, check.IsNil)
+	err = Ed25519SignatureVerify(s.ed25519Pub, um)
+	c.Assert(err, check.ErrorMatches, "wrong signature")
+}
+
+func (s *PassTestSuite) TestThresholdSignaturePass(c *check.C) {
+	signer, err := NewThresholdSigner(s.thresholdGroup, []int{1, 2, 3})
+	c.Assert(err, check.IsNil)
+
+	emt := NewEmitter(signer, s.thresholdSelector)
+
+	err = emt.AuthorizeOperation(s.operations[0])
+	c.Assert(err, check.IsNil)
+	err = emt.AuthorizeOperation(s.operations[1])
+	c.Assert(err, check.IsNil)
+
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, check.IsNil)
+
+	buf, err := MarshalBinary(&MacaroonSlice{[]*Macaroon{m}})
+	c.Assert(err, check.IsNil)
+
+	u, err := UnmarshalBinary(buf)
+	c.Assert(err, check.IsNil)
+
+	um, err := u.Get(0)
+	c.Assert(err, check.IsNil)
+
+	err = VerifyMacaroon(um, s, s.operations)
+	c.Assert(err, check.IsNil)
+}
+
 func (s *PassTestSuite) TestNilOperations(c *check.C) {
 	signer, err := NewHmacSha256Signer(s.key)
 	c.Assert(err, check.IsNil)
@@ -209,7 +297,7 @@ func (s *PassTestSuite) TestEmitterWithMacaroonBase(c *check.C) {
 }
 
 func (s *PassTestSuite) TestPassWithEcdsa(c *check.C) {
-	signer := NewEcdsaSigner(s.priv)
+	signer := NewEcdsaSigner(NewSecretKey(s.priv))
 
 	emt := NewEmitter(signer, s.ecdsaSelector)
 
@@ -322,7 +410,7 @@ func (s *PassTestSuite) TestPassSeparateSignature(c *check.C) {
 
 func (s *PassTestSuite) TestHmacSha256MacaroonSignature (c *check.C) {
 
-	signer,_ := NewHmacSha256Signer(s.cardKey)
+	signer,_ := NewHmacSha256Signer(NewSecretKey(s.cardKey))
 
 	m,_ := New(s.cardId, "", V2)
 
@@ -334,7 +422,7 @@ func (s *PassTestSuite) TestHmacSha256MacaroonSignature (c *check.C) {
 
 	m.SetSignature(s.baseSignature)
 
-	err = HmacSha256SignatureVerify(s.cardKey, m)
+	err = HmacSha256SignatureVerify(NewSecretKey(s.cardKey), m)
 	c.Assert(err, check.IsNil)
 
 	_ = m.AddFirstPartyCaveat(s.payCavId)
@@ -356,3 +444,33 @@ func (s *PassTestSuite) TestHmacSha256MacaroonSignature (c *check.C) {
 
 	c.Assert(signatures[len(signatures) - 1], check.DeepEquals, s.resultSignature)
 }
+
+func (s *PassTestSuite) TestCardSignerMacaroonSignature(c *check.C) {
+	card, err := NewCardSimulator(s.cardId, NewSecretKey(s.cardKey))
+	c.Assert(err, check.IsNil)
+	signer := NewCardSigner(card)
+
+	cardId, err := signer.CardId()
+	c.Assert(err, check.IsNil)
+	m, _ := New(cardId, "", V2)
+
+	err = m.Sign(signer)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Signature(), check.DeepEquals, s.baseSignature)
+
+	_ = m.AddFirstPartyCaveat(s.payCavId)
+	err = m.Sign(signer)
+	c.Assert(err, check.IsNil)
+
+	vId, err := signer.SignData(s.random)
+	c.Assert(err, check.IsNil)
+	c.Assert(vId, check.DeepEquals, HmacSha256KeyedHash(m.Signature(), s.random))
+
+	_ = m.AddCaveat(s.dasCavId, vId, "das")
+	err = m.Sign(signer)
+	c.Assert(err, check.IsNil)
+	c.Assert(m.Signature(), check.DeepEquals, s.resultSignature)
+
+	err = HmacSha256SignatureVerify(NewSecretKey(s.cardKey), m)
+	c.Assert(err, check.IsNil)
+}
@@ -0,0 +1,168 @@
+package macaroon_pass
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+)
+
+// Recoverable ECDSA macaroons carry a 65-byte compact signature: a
+// recovery byte followed by R and S. The public key of the issuer can be
+// recovered from the signature and the macaroon digest, so verifiers
+// only need to know which issuers they trust, not which key signed a
+// given macaroon id.
+
+const compactEcdsaSignatureLen = 65
+
+// CompactEcdsaSigner signs macaroons with recoverable compact secp256k1
+// ECDSA signatures.
+type CompactEcdsaSigner struct {
+	key *SecretKey
+	pub []byte
+}
+
+func NewCompactEcdsaSigner(key *SecretKey) (*CompactEcdsaSigner, error) {
+	if n := len(key.bytes()); n != 32 {
+		return nil, fmt.Errorf("wrong ECDSA key length %d", n)
+	}
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+	return &CompactEcdsaSigner{key: key, pub: pub.SerializeCompressed()}, nil
+}
+
+// PublicKey returns the compressed public key of the signer, as
+// recovered from its signatures.
+func (s *CompactEcdsaSigner) PublicKey() []byte {
+	return append([]byte(nil), s.pub...)
+}
+
+func (s *CompactEcdsaSigner) SignData(data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	return s.sign(hash[:])
+}
+
+func (s *CompactEcdsaSigner) SignMacaroon(m *Macaroon) error {
+	if s.key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	m.setAlgorithm(AlgorithmCompactEcdsa)
+	hash := calcMacaroonHash(m)
+	sig, err := s.sign(hash[:])
+	if err != nil {
+		return err
+	}
+	m.sig = sig
+	return nil
+}
+
+func (s *CompactEcdsaSigner) sign(hash []byte) ([]byte, error) {
+	if s.key.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	priv, _ := secp256k1.PrivKeyFromBytes(s.key.bytes())
+	sig, err := secp256k1.SignCompact(priv, hash, true)
+	if err != nil {
+		return nil, fmt.Errorf("cannot make ECDSA signature: %v", err)
+	}
+	return sig, nil
+}
+
+// RecoverEcdsaIssuer returns the compressed public key which made the
+// compact signature of the macaroon. Any well-formed signature recovers
+// some key, so the key must be checked against the trusted issuers.
+func RecoverEcdsaIssuer(m *Macaroon) ([]byte, error) {
+	if m.Algorithm() != AlgorithmCompactEcdsa {
+		return nil, fmt.Errorf("algorithm %q has no recoverable signature", m.Algorithm())
+	}
+	s := m.Signature()
+	if s == nil {
+		return nil, fmt.Errorf("signature is nil")
+	}
+	if len(s) != compactEcdsaSignatureLen {
+		return nil, fmt.Errorf("signature has unexpected length %d", len(s))
+	}
+	hash := calcMacaroonHash(m)
+	key, _, err := secp256k1.RecoverCompact(s, hash[:])
+	if err != nil {
+		return nil, fmt.Errorf("cannot recover public key: %v", err)
+	}
+	return key.SerializeCompressed(), nil
+}
+
+// CompactEcdsaSignatureVerify verifies the compact signature of a
+// macaroon against a known public key.
+func CompactEcdsaSignatureVerify(pubKey []byte, m *Macaroon) error {
+	key, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return fmt.Errorf("cannot parse public key: %v", err)
+	}
+	issuer, err := RecoverEcdsaIssuer(m)
+	if err != nil {
+		return err
+	}
+	if string(issuer) != string(key.SerializeCompressed()) {
+		return fmt.Errorf("wrong signature")
+	}
+	return nil
+}
+
+// EcdsaIssuerAllowlist verifies compact ECDSA macaroons by recovering
+// the issuer key and checking that it is allowed. Its VerifySignature
+// method can be registered in a VerifierRegistry for
+// AlgorithmCompactEcdsa.
+type EcdsaIssuerAllowlist struct {
+	mu      sync.RWMutex
+	issuers map[string]bool
+}
+
+// NewEcdsaIssuerAllowlist creates an allowlist of the given compressed
+// or uncompressed public keys.
+func NewEcdsaIssuerAllowlist(pubKeys ...[]byte) (*EcdsaIssuerAllowlist, error) {
+	l := &EcdsaIssuerAllowlist{issuers: make(map[string]bool)}
+	for _, pubKey := range pubKeys {
+		if err := l.Add(pubKey); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// Add allows the issuer with the given public key.
+func (l *EcdsaIssuerAllowlist) Add(pubKey []byte) error {
+	key, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return fmt.Errorf("cannot parse public key: %v", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.issuers[string(key.SerializeCompressed())] = true
+	return nil
+}
+
+// Remove disallows the issuer with the given public key.
+func (l *EcdsaIssuerAllowlist) Remove(pubKey []byte) error {
+	key, err := secp256k1.ParsePubKey(pubKey)
+	if err != nil {
+		return fmt.Errorf("cannot parse public key: %v", err)
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.issuers, string(key.SerializeCompressed()))
+	return nil
+}
+
+// VerifySignature verifies that the macaroon was signed by an allowed
+// issuer.
+func (l *EcdsaIssuerAllowlist) VerifySignature(m *Macaroon) error {
+	issuer, err := RecoverEcdsaIssuer(m)
+	if err != nil {
+		return err
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if !l.issuers[string(issuer)] {
+		return fmt.Errorf("issuer %x is not allowed", issuer)
+	}
+	return nil
+}
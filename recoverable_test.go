@@ -0,0 +1,89 @@
+package macaroon_pass
+
+import (
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestCompactEcdsaSignatureVerify(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	_, pub := secp256k1.PrivKeyFromBytes(key.bytes())
+	signer, err := NewCompactEcdsaSigner(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(signer.PublicKey(), qt.DeepEquals, pub.SerializeCompressed())
+
+	m := MustNew([]byte("issuer 1"), "", V2)
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 100")), qt.IsNil)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmCompactEcdsa)
+	c.Assert(m.Signature(), qt.HasLen, 65)
+
+	issuer, err := RecoverEcdsaIssuer(m)
+	c.Assert(err, qt.IsNil)
+	c.Assert(issuer, qt.DeepEquals, pub.SerializeCompressed())
+	c.Assert(CompactEcdsaSignatureVerify(pub.SerializeCompressed(), m), qt.IsNil)
+	c.Assert(CompactEcdsaSignatureVerify(pub.SerializeUncompressed(), m), qt.IsNil)
+
+	// The signature survives marshaling.
+	data, err := (&marshaller{m}).MarshalBinary()
+	c.Assert(err, qt.IsNil)
+	m1 := marshaller{&Macaroon{}}
+	c.Assert(m1.UnmarshalBinary(data), qt.IsNil)
+	c.Assert(CompactEcdsaSignatureVerify(pub.SerializeCompressed(), m1.Macaroon), qt.IsNil)
+
+	// Another key is recovered from a tampered macaroon.
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 1000")), qt.IsNil)
+	c.Assert(CompactEcdsaSignatureVerify(pub.SerializeCompressed(), m), qt.ErrorMatches, "wrong signature")
+
+	m.SetSignature(m.Signature()[:64])
+	_, err = RecoverEcdsaIssuer(m)
+	c.Assert(err, qt.ErrorMatches, "signature has unexpected length 64")
+
+	m = MustNew([]byte("issuer 1"), "", V2)
+	c.Assert(m.Sign(NewEcdsaSigner(key)), qt.IsNil)
+	_, err = RecoverEcdsaIssuer(m)
+	c.Assert(err, qt.ErrorMatches, `algorithm "ecdsa-secp256k1" has no recoverable signature`)
+}
+
+func TestEcdsaIssuerAllowlist(t *testing.T) {
+	c := qt.New(t)
+	var signers []*CompactEcdsaSigner
+	for i := 0; i < 3; i++ {
+		key, err := RandomKey(32)
+		c.Assert(err, qt.IsNil)
+		signer, err := NewCompactEcdsaSigner(key)
+		c.Assert(err, qt.IsNil)
+		signers = append(signers, signer)
+	}
+	l, err := NewEcdsaIssuerAllowlist(signers[0].PublicKey(), signers[1].PublicKey())
+	c.Assert(err, qt.IsNil)
+	r := NewVerifierRegistry()
+	r.Register(AlgorithmCompactEcdsa, l.VerifySignature)
+
+	sign := func(signer *CompactEcdsaSigner) *Macaroon {
+		m := MustNew([]byte("some id"), "", V2)
+		c.Assert(m.AddFirstPartyCaveat([]byte("amount 100")), qt.IsNil)
+		c.Assert(m.Sign(signer), qt.IsNil)
+		return m
+	}
+	c.Assert(r.VerifySignature(sign(signers[0])), qt.IsNil)
+	c.Assert(r.VerifySignature(sign(signers[1])), qt.IsNil)
+	c.Assert(r.VerifySignature(sign(signers[2])), qt.ErrorMatches, "issuer [0-9a-f]{66} is not allowed")
+
+	c.Assert(l.Remove(signers[0].PublicKey()), qt.IsNil)
+	c.Assert(r.VerifySignature(sign(signers[0])), qt.ErrorMatches, "issuer [0-9a-f]{66} is not allowed")
+	c.Assert(l.Add(signers[2].PublicKey()), qt.IsNil)
+	c.Assert(r.VerifySignature(sign(signers[2])), qt.IsNil)
+
+	// Caveats cannot be added without the issuer key.
+	m := sign(signers[1])
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 1000")), qt.IsNil)
+	c.Assert(r.VerifySignature(m), qt.ErrorMatches, "issuer [0-9a-f]{66} is not allowed")
+
+	_, err = NewEcdsaIssuerAllowlist([]byte("bad key"))
+	c.Assert(err, qt.ErrorMatches, "cannot parse public key: .*")
+}
@@ -0,0 +1,454 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The remote signer protocol keeps issuing keys in a signing daemon
+// instead of every service which embeds an Emitter. RemoteSigner posts
+// JSON requests over HTTP, either on a Unix socket or on a local TCP
+// port, and SigningDaemon answers them.
+//
+// Callers are authenticated with a key shared with the daemon: every
+// request carries the client id and an HMAC-SHA256 of the request path
+// and body. The body holds the time of the request, so that captured
+// requests are only accepted for remoteMaxSkew, and a random nonce,
+// which the daemon remembers for as long as the request is accepted so
+// that no request is served twice. The daemon signs only for the
+// selectors which are allowed for the client.
+//
+// Two endpoints are served:
+//
+//  - /sign-macaroon signs the macaroon of the request from scratch and
+//    returns it. A discharge macaroon signed with SignBound is signed
+//    bound to the primary signature sent with it.
+//  - /sign-data signs data as the SignData method of the signer for the
+//    selector. It is only served for HMAC SHA256 keys, for which the
+//    macaroon of the request is signed first, since the data is signed
+//    with its signature. ECDSA keys sign the SHA-256 hash of the data,
+//    so signing arbitrary data would let a client sign the digest of
+//    any macaroon, bypassing the checks of /sign-macaroon.
+
+const (
+	remoteSignMacaroonPath = "/sign-macaroon"
+	remoteSignDataPath     = "/sign-data"
+
+	remoteClientHeader = "Macaroon-Pass-Client"
+	remoteMacHeader    = "Macaroon-Pass-Mac"
+
+	remoteMaxSkew = 30 * time.Second
+
+	remoteMaxRequestSize = 1 << 20
+)
+
+type remoteRequest struct {
+	Time     int64  `json:"time"`
+	Nonce    []byte `json:"nonce"`
+	Selector []byte `json:"selector"`
+	Macaroon []byte `json:"macaroon,omitempty"`
+	BoundTo  []byte `json:"boundTo,omitempty"`
+	Data     []byte `json:"data,omitempty"`
+}
+
+type remoteResponse struct {
+	Macaroon  []byte `json:"macaroon,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// remoteMac returns the MAC which authenticates a request.
+func remoteMac(key []byte, path string, body []byte) []byte {
+	return keyedHash2(key, []byte(path), body)
+}
+
+func marshalRemoteMacaroon(m *Macaroon) ([]byte, error) {
+	if m.version != V2 {
+		return nil, fmt.Errorf("cannot sign %v macaroon remotely", m.version)
+	}
+	marsh := marshaller{m}
+	return marsh.MarshalBinary()
+}
+
+func unmarshalRemoteMacaroon(data []byte) (*Macaroon, error) {
+	marsh := marshaller{&Macaroon{}}
+	if err := marsh.UnmarshalBinary(data); err != nil {
+		return nil, err
+	}
+	return marsh.Macaroon, nil
+}
+
+// RemoteSigner signs macaroons with a key held by a SigningDaemon.
+type RemoteSigner struct {
+	client    *http.Client
+	url       string
+	clientId  string
+	clientKey *SecretKey
+	selector  []byte
+	macaroon  *Macaroon
+}
+
+// NewRemoteSigner creates a signer for the given selector which
+// forwards signing to the daemon at the given URL, for example
+// "http://127.0.0.1:8700".
+func NewRemoteSigner(url, clientId string, clientKey *SecretKey, selector []byte) (*RemoteSigner, error) {
+	if len(clientKey.bytes()) == 0 {
+		return nil, fmt.Errorf("no client key was passed when create remote signer")
+	}
+	return &RemoteSigner{
+		client:    http.DefaultClient,
+		url:       url,
+		clientId:  clientId,
+		clientKey: clientKey,
+		selector:  selector,
+	}, nil
+}
+
+// NewUnixRemoteSigner is like NewRemoteSigner, but the daemon listens on
+// the Unix socket with the given path.
+func NewUnixRemoteSigner(socketPath, clientId string, clientKey *SecretKey, selector []byte) (*RemoteSigner, error) {
+	s, err := NewRemoteSigner("http://unix", clientId, clientKey, selector)
+	if err != nil {
+		return nil, err
+	}
+	s.client = &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", socketPath)
+			},
+		},
+	}
+	return s, nil
+}
+
+func (s *RemoteSigner) SignMacaroon(m *Macaroon) error {
+	if s.macaroon != nil && s.macaroon != m {
+		return fmt.Errorf("can not sign another macaroon")
+	}
+	if !bytes.Equal(m.id, s.selector) {
+		return fmt.Errorf("macaroon id does not match the selector of the remote signer")
+	}
+	data, err := marshalRemoteMacaroon(m)
+	if err != nil {
+		return err
+	}
+	resp, err := s.call(remoteSignMacaroonPath, &remoteRequest{
+		Selector: s.selector,
+		Macaroon: data,
+		BoundTo:  m.boundTo,
+	})
+	if err != nil {
+		return err
+	}
+	signed, err := unmarshalRemoteMacaroon(resp.Macaroon)
+	if err != nil {
+		return fmt.Errorf("cannot unmarshal signed macaroon: %v", err)
+	}
+	// Only take over the signature, after checking that the daemon
+	// signed the macaroon which was sent.
+	unsigned := *m
+	unsigned.sig = signed.sig
+	unsigned.algorithm = signed.algorithm
+	if !unsigned.Equal(signed) {
+		return fmt.Errorf("remote signer returned another macaroon")
+	}
+	m.sig = signed.sig
+	m.algorithm = signed.algorithm
+	s.macaroon = m
+	return nil
+}
+
+func (s *RemoteSigner) SignData(data []byte) ([]byte, error) {
+	req := remoteRequest{
+		Selector: s.selector,
+		Data:     data,
+	}
+	if s.macaroon != nil {
+		m, err := marshalRemoteMacaroon(s.macaroon)
+		if err != nil {
+			return nil, err
+		}
+		req.Macaroon = m
+	}
+	resp, err := s.call(remoteSignDataPath, &req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Signature, nil
+}
+
+func (s *RemoteSigner) call(path string, req *remoteRequest) (*remoteResponse, error) {
+	if s.clientKey.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	nonce, err := newNonce(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Time = time.Now().Unix()
+	req.Nonce = nonce[:]
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal request: %v", err)
+	}
+	hreq, err := http.NewRequest("POST", s.url+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %v", err)
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set(remoteClientHeader, s.clientId)
+	hreq.Header.Set(remoteMacHeader, base64.RawURLEncoding.EncodeToString(remoteMac(s.clientKey.bytes(), path, body)))
+	hresp, err := s.client.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("cannot call remote signer: %v", err)
+	}
+	defer hresp.Body.Close()
+	var resp remoteResponse
+	if err := json.NewDecoder(hresp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("cannot parse remote signer response: %v", err)
+	}
+	if resp.Error != "" {
+		return nil, fmt.Errorf("remote signer: %s", resp.Error)
+	}
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote signer: %s", hresp.Status)
+	}
+	return &resp, nil
+}
+
+type daemonKey struct {
+	alg Algorithm
+	key *SecretKey
+}
+
+type daemonClient struct {
+	key       *SecretKey
+	selectors map[string]bool
+}
+
+// SigningDaemon holds HMAC SHA256 and ECDSA issuing keys and signs
+// macaroons for the clients of RemoteSigner. It implements http.Handler
+// and is safe for concurrent use.
+type SigningDaemon struct {
+	mu      sync.RWMutex
+	keys    map[string]daemonKey
+	clients map[string]daemonClient
+	now     func() time.Time
+
+	// nonces holds the nonces of the accepted requests with the time
+	// until which the requests would be accepted.
+	nonceMu sync.Mutex
+	nonces  map[string]time.Time
+}
+
+func NewSigningDaemon() *SigningDaemon {
+	return &SigningDaemon{
+		keys:    make(map[string]daemonKey),
+		clients: make(map[string]daemonClient),
+		now:     time.Now,
+		nonces:  make(map[string]time.Time),
+	}
+}
+
+// AddKey sets the key which signs macaroons with the given selector.
+// The algorithm must be AlgorithmHmacSha256 or AlgorithmEcdsa.
+func (d *SigningDaemon) AddKey(selector []byte, alg Algorithm, key *SecretKey) error {
+	if alg != AlgorithmHmacSha256 && alg != AlgorithmEcdsa {
+		return fmt.Errorf("algorithm %q is not supported by signing daemon", alg)
+	}
+	if len(key.bytes()) == 0 {
+		return fmt.Errorf("no key was passed for selector %q", selector)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.keys[string(selector)] = daemonKey{
+		alg: alg,
+		key: key,
+	}
+	return nil
+}
+
+// AddClient allows the client with the given id, authenticated with the
+// given key, to sign macaroons with the given selectors.
+func (d *SigningDaemon) AddClient(id string, key *SecretKey, selectors ...[]byte) error {
+	if len(key.bytes()) == 0 {
+		return fmt.Errorf("no key was passed for client %q", id)
+	}
+	c := daemonClient{
+		key:       key,
+		selectors: make(map[string]bool),
+	}
+	for _, selector := range selectors {
+		c.selectors[string(selector)] = true
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.clients[id] = c
+	return nil
+}
+
+func (d *SigningDaemon) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var resp *remoteResponse
+	status := http.StatusOK
+	req, key, err := d.authenticate(r)
+	if err != nil {
+		status = http.StatusUnauthorized
+	} else {
+		switch r.URL.Path {
+		case remoteSignMacaroonPath:
+			resp, err = d.signMacaroon(req, key)
+		case remoteSignDataPath:
+			resp, err = d.signData(req, key)
+		default:
+			status, err = http.StatusNotFound, fmt.Errorf("unknown endpoint %q", r.URL.Path)
+		}
+		if err != nil && status == http.StatusOK {
+			status = http.StatusBadRequest
+		}
+	}
+	if err != nil {
+		resp = &remoteResponse{Error: err.Error()}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// authenticate checks the caller and returns its request together
+// with the key for the requested selector.
+func (d *SigningDaemon) authenticate(r *http.Request) (*remoteRequest, daemonKey, error) {
+	if r.Method != "POST" {
+		return nil, daemonKey{}, fmt.Errorf("method %s is not allowed", r.Method)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, remoteMaxRequestSize+1))
+	if err != nil {
+		return nil, daemonKey{}, fmt.Errorf("cannot read request: %v", err)
+	}
+	if len(body) > remoteMaxRequestSize {
+		return nil, daemonKey{}, fmt.Errorf("request too large")
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(r.Header.Get(remoteMacHeader))
+	if err != nil {
+		return nil, daemonKey{}, fmt.Errorf("unauthorized")
+	}
+
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	c, ok := d.clients[r.Header.Get(remoteClientHeader)]
+	if !ok || c.key.isDestroyed() || !hmac.Equal(mac, remoteMac(c.key.bytes(), r.URL.Path, body)) {
+		return nil, daemonKey{}, fmt.Errorf("unauthorized")
+	}
+	var req remoteRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		return nil, daemonKey{}, fmt.Errorf("cannot parse request: %v", err)
+	}
+	skew := d.now().Sub(time.Unix(req.Time, 0))
+	if skew > remoteMaxSkew || skew < -remoteMaxSkew {
+		return nil, daemonKey{}, fmt.Errorf("request time is out of range")
+	}
+	if len(req.Nonce) != nonceLen {
+		return nil, daemonKey{}, fmt.Errorf("request has no valid nonce")
+	}
+	if !d.useNonce(req.Nonce, time.Unix(req.Time, 0).Add(remoteMaxSkew)) {
+		return nil, daemonKey{}, fmt.Errorf("request was already served")
+	}
+	key, ok := d.keys[string(req.Selector)]
+	if !ok || !c.selectors[string(req.Selector)] {
+		return nil, daemonKey{}, fmt.Errorf("selector %q is not allowed", req.Selector)
+	}
+	return &req, key, nil
+}
+
+// useNonce records the nonce of a request which is accepted until the
+// given time, and reports whether the nonce was not used before.
+func (d *SigningDaemon) useNonce(nonce []byte, until time.Time) bool {
+	d.nonceMu.Lock()
+	defer d.nonceMu.Unlock()
+	now := d.now()
+	for n, t := range d.nonces {
+		if now.After(t) {
+			delete(d.nonces, n)
+		}
+	}
+	if _, ok := d.nonces[string(nonce)]; ok {
+		return false
+	}
+	d.nonces[string(nonce)] = until
+	return true
+}
+
+// requestMacaroon returns the macaroon of the request, which must have
+// the requested selector as id.
+func (d *SigningDaemon) requestMacaroon(req *remoteRequest) (*Macaroon, error) {
+	m, err := unmarshalRemoteMacaroon(req.Macaroon)
+	if err != nil {
+		return nil, fmt.Errorf("cannot unmarshal macaroon: %v", err)
+	}
+	if !bytes.Equal(m.id, req.Selector) {
+		return nil, fmt.Errorf("macaroon id does not match selector")
+	}
+	return m, nil
+}
+
+func (d *SigningDaemon) signer(key daemonKey) (Signer, error) {
+	if key.alg == AlgorithmEcdsa {
+		return NewEcdsaSigner(key.key), nil
+	}
+	return NewHmacSha256Signer(key.key)
+}
+
+func (d *SigningDaemon) signMacaroon(req *remoteRequest, key daemonKey) (*remoteResponse, error) {
+	m, err := d.requestMacaroon(req)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := d.signer(key)
+	if err != nil {
+		return nil, err
+	}
+	m.boundTo = req.BoundTo
+	err = signer.SignMacaroon(m)
+	m.boundTo = nil
+	if err != nil {
+		return nil, err
+	}
+	data, err := marshalRemoteMacaroon(m)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteResponse{Macaroon: data}, nil
+}
+
+func (d *SigningDaemon) signData(req *remoteRequest, key daemonKey) (*remoteResponse, error) {
+	if key.alg != AlgorithmHmacSha256 {
+		return nil, fmt.Errorf("cannot sign data with %s key", key.alg)
+	}
+	signer, err := d.signer(key)
+	if err != nil {
+		return nil, err
+	}
+	m, err := d.requestMacaroon(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := signer.SignMacaroon(m); err != nil {
+		return nil, err
+	}
+	sig, err := signer.SignData(req.Data)
+	if err != nil {
+		return nil, err
+	}
+	return &remoteResponse{Signature: sig}, nil
+}
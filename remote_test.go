@@ -0,0 +1,241 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+type remoteSignerTest struct {
+	daemon    *SigningDaemon
+	srv       *httptest.Server
+	url       string
+	clientKey *SecretKey
+	hmacKey   *SecretKey
+	ecdsaKey  *SecretKey
+}
+
+func newRemoteSignerTest(c *qt.C) *remoteSignerTest {
+	t := &remoteSignerTest{
+		daemon:    NewSigningDaemon(),
+		clientKey: MakeKey([]byte("client key")),
+		hmacKey:   MakeKey([]byte("card key")),
+	}
+	var err error
+	t.ecdsaKey, err = RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	c.Assert(t.daemon.AddKey([]byte("card 0001"), AlgorithmHmacSha256, t.hmacKey), qt.IsNil)
+	c.Assert(t.daemon.AddKey([]byte("issuer 1"), AlgorithmEcdsa, t.ecdsaKey), qt.IsNil)
+	c.Assert(t.daemon.AddKey([]byte("card 0002"), AlgorithmHmacSha256, t.hmacKey), qt.IsNil)
+	err = t.daemon.AddClient("pos-1", t.clientKey, []byte("card 0001"), []byte("issuer 1"))
+	c.Assert(err, qt.IsNil)
+
+	t.srv = httptest.NewServer(t.daemon)
+	t.url = t.srv.URL
+	return t
+}
+
+func (t *remoteSignerTest) close() {
+	t.srv.Close()
+}
+
+func TestRemoteSignerHmacSha256(t *testing.T) {
+	c := qt.New(t)
+	rt := newRemoteSignerTest(c)
+	defer rt.close()
+	selector := []byte("card 0001")
+
+	signer, err := NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, selector)
+	c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+	c.Assert(emt.DelegateEncryptedAuthorization([]byte("das"), "das", []byte("das key")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	c.Assert(HmacSha256SignatureVerify(rt.hmacKey, m), qt.IsNil)
+
+	local, err := NewHmacSha256Signer(rt.hmacKey)
+	c.Assert(err, qt.IsNil)
+	c.Assert(local.SignMacaroon(m.Clone()), qt.IsNil)
+	want, err := local.SignData([]byte("data"))
+	c.Assert(err, qt.IsNil)
+	got, err := signer.SignData([]byte("data"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, want)
+}
+
+func TestRemoteSignerEcdsa(t *testing.T) {
+	c := qt.New(t)
+	rt := newRemoteSignerTest(c)
+	defer rt.close()
+	selector := []byte("issuer 1")
+	_, pub := secp256k1.PrivKeyFromBytes(rt.ecdsaKey.bytes())
+
+	signer, err := NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	emt := NewEmitter(signer, selector)
+	c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmEcdsa)
+	c.Assert(EcdsaSignatureVerify(pub.SerializeCompressed(), m), qt.IsNil)
+
+	// Signing data with the ECDSA key would let the client sign the
+	// digest of any macaroon.
+	hash := calcMacaroonHash(MustNew([]byte("card 0002"), "", V2))
+	_, err = signer.SignData(hash[:])
+	c.Assert(err, qt.ErrorMatches, "remote signer: cannot sign data with ecdsa-secp256k1 key")
+}
+
+func TestRemoteSignerSignBound(t *testing.T) {
+	c := qt.New(t)
+	rt := newRemoteSignerTest(c)
+	defer rt.close()
+	selector := []byte("issuer 1")
+	_, pub := secp256k1.PrivKeyFromBytes(rt.ecdsaKey.bytes())
+	rootSig := []byte("primary signature")
+
+	// The daemon signs the digest bound to the primary signature.
+	signer, err := NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	d := MustNew(selector, "", V2)
+	c.Assert(d.AddFirstPartyCaveat([]byte("merchant 4711")), qt.IsNil)
+	c.Assert(d.SignBound(signer, rootSig), qt.IsNil)
+	c.Assert(EcdsaSignatureVerify(pub.SerializeCompressed(), d), qt.ErrorMatches, "wrong signature")
+	d.boundTo = rootSig
+	c.Assert(EcdsaSignatureVerify(pub.SerializeCompressed(), d), qt.IsNil)
+}
+
+func TestRemoteSignerUnixSocket(t *testing.T) {
+	c := qt.New(t)
+	rt := newRemoteSignerTest(c)
+	defer rt.close()
+	dir, err := ioutil.TempDir("", "signd")
+	c.Assert(err, qt.IsNil)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "signd.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, qt.IsNil)
+	srv := &http.Server{Handler: rt.daemon}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	selector := []byte("card 0001")
+	signer, err := NewUnixRemoteSigner(path, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	m := MustNew(selector, "", V2)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(HmacSha256SignatureVerify(rt.hmacKey, m), qt.IsNil)
+}
+
+func TestSigningDaemonRejectsCallers(t *testing.T) {
+	c := qt.New(t)
+	rt := newRemoteSignerTest(c)
+	defer rt.close()
+
+	// A selector which is not allowed for the client.
+	selector := []byte("card 0002")
+	signer, err := NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	err = MustNew(selector, "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, `remote signer: selector "card 0002" is not allowed`)
+
+	// A selector the daemon has no key for.
+	selector = []byte("card 0003")
+	signer, err = NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	err = MustNew(selector, "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, `remote signer: selector "card 0003" is not allowed`)
+
+	// Unknown clients and wrong client keys.
+	selector = []byte("card 0001")
+	signer, err = NewRemoteSigner(rt.url, "pos-2", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	err = MustNew(selector, "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, "remote signer: unauthorized")
+	signer, err = NewRemoteSigner(rt.url, "pos-1", MakeKey([]byte("other key")), selector)
+	c.Assert(err, qt.IsNil)
+	err = MustNew(selector, "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, "remote signer: unauthorized")
+
+	// Requests from too long ago.
+	rt.daemon.now = func() time.Time { return time.Now().Add(time.Minute) }
+	signer, err = NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	err = MustNew(selector, "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, "remote signer: request time is out of range")
+
+	// The signer only signs macaroons with its selector.
+	err = MustNew([]byte("card 0002"), "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, "macaroon id does not match the selector of the remote signer")
+}
+
+// recordingTransport records the last request it sends.
+type recordingTransport struct {
+	req  *http.Request
+	body []byte
+}
+
+func (t *recordingTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	t.req, t.body = r, body
+	return http.DefaultTransport.RoundTrip(t.replay())
+}
+
+func (t *recordingTransport) replay() *http.Request {
+	r := t.req.Clone(t.req.Context())
+	r.Body = ioutil.NopCloser(bytes.NewReader(t.body))
+	return r
+}
+
+func TestSigningDaemonRejectsReplay(t *testing.T) {
+	c := qt.New(t)
+	rt := newRemoteSignerTest(c)
+	defer rt.close()
+	selector := []byte("card 0001")
+
+	signer, err := NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	tr := &recordingTransport{}
+	signer.client = &http.Client{Transport: tr}
+	c.Assert(MustNew(selector, "", V2).Sign(signer), qt.IsNil)
+
+	// Every request carries a fresh nonce.
+	var req1, req2 remoteRequest
+	c.Assert(json.Unmarshal(tr.body, &req1), qt.IsNil)
+	c.Assert(req1.Nonce, qt.HasLen, nonceLen)
+	signer, err = NewRemoteSigner(rt.url, "pos-1", rt.clientKey, selector)
+	c.Assert(err, qt.IsNil)
+	signer.client = &http.Client{Transport: tr}
+	c.Assert(MustNew(selector, "", V2).Sign(signer), qt.IsNil)
+	c.Assert(json.Unmarshal(tr.body, &req2), qt.IsNil)
+	c.Assert(req2.Nonce, qt.Not(qt.DeepEquals), req1.Nonce)
+
+	hresp, err := http.DefaultTransport.RoundTrip(tr.replay())
+	c.Assert(err, qt.IsNil)
+	defer hresp.Body.Close()
+	c.Assert(hresp.StatusCode, qt.Equals, http.StatusUnauthorized)
+	var resp remoteResponse
+	c.Assert(json.NewDecoder(hresp.Body).Decode(&resp), qt.IsNil)
+	c.Assert(resp.Error, qt.Equals, "request was already served")
+
+	// Nonces are forgotten once their requests expire.
+	c.Assert(rt.daemon.nonces, qt.HasLen, 2)
+	rt.daemon.now = func() time.Time { return time.Now().Add(time.Minute) }
+	c.Assert(rt.daemon.useNonce([]byte("nonce"), time.Now().Add(2*time.Minute)), qt.IsTrue)
+	c.Assert(rt.daemon.nonces, qt.HasLen, 1)
+	c.Assert(rt.daemon.useNonce([]byte("nonce"), time.Now().Add(2*time.Minute)), qt.IsFalse)
+}
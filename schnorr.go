@@ -0,0 +1,219 @@
+package macaroon_pass
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+)
+
+// This file implements BIP-340 Schnorr signatures over secp256k1
+// (https://github.com/bitcoin/bips/blob/master/bip-0340.mediawiki).
+// Public keys are 32-byte x-only keys and signatures are always
+// 64 bytes long.
+
+const (
+	schnorrPubKeyLen    = 32
+	schnorrSignatureLen = 64
+)
+
+var (
+	bip340TagAux       = []byte("BIP0340/aux")
+	bip340TagNonce     = []byte("BIP0340/nonce")
+	bip340TagChallenge = []byte("BIP0340/challenge")
+)
+
+type SchnorrSigner struct {
+	key *SecretKey
+	pub []byte
+}
+
+// NewSchnorrSigner creates a BIP-340 signer from a 32-byte secp256k1
+// private key.
+func NewSchnorrSigner(key *SecretKey) (*SchnorrSigner, error) {
+	if n := len(key.bytes()); n != 32 {
+		return nil, fmt.Errorf("wrong Schnorr key length %d", n)
+	}
+	_, pub, err := schnorrKey(key.bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &SchnorrSigner{key: key, pub: pub}, nil
+}
+
+// schnorrKey returns the secret scalar, negated if needed so that the
+// public point has an even y coordinate, and the x-only public key.
+func schnorrKey(key []byte) (*big.Int, []byte, error) {
+	curve := secp256k1.S256()
+	d := new(big.Int).SetBytes(key)
+	if d.Sign() == 0 || d.Cmp(curve.N) >= 0 {
+		return nil, nil, fmt.Errorf("Schnorr key is out of range")
+	}
+	px, py := curve.ScalarBaseMult(key)
+	if py.Bit(0) != 0 {
+		d.Sub(curve.N, d)
+	}
+	return d, scalarBytes(px), nil
+}
+
+// PublicKey returns the x-only public key which verifies signatures
+// of the signer.
+func (s *SchnorrSigner) PublicKey() []byte {
+	return append([]byte(nil), s.pub...)
+}
+
+func (s *SchnorrSigner) SignData(data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	return s.sign(hash[:], rand.Reader)
+}
+
+func (s *SchnorrSigner) SignMacaroon(m *Macaroon) error {
+	if s.key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	m.setAlgorithm(AlgorithmSchnorr)
+	hash := calcMacaroonHash(m)
+	sig, err := s.sign(hash[:], rand.Reader)
+	if err != nil {
+		return err
+	}
+	m.sig = sig
+	return nil
+}
+
+func (s *SchnorrSigner) sign(msg []byte, r io.Reader) ([]byte, error) {
+	var aux [32]byte
+	if _, err := io.ReadFull(r, aux[:]); err != nil {
+		return nil, fmt.Errorf("cannot generate random bytes: %v", err)
+	}
+	if s.key.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	d, _, err := schnorrKey(s.key.bytes())
+	if err != nil {
+		return nil, err
+	}
+	return schnorrSign(d, s.pub, msg, aux[:])
+}
+
+// schnorrSign signs msg with the even-y private scalar d whose
+// x-only public key is pub, using aux as auxiliary randomness.
+func schnorrSign(d *big.Int, pub, msg, aux []byte) ([]byte, error) {
+	curve := secp256k1.S256()
+
+	t := scalarBytes(d)
+	auxHash := taggedHash(bip340TagAux, aux)
+	for i := range t {
+		t[i] ^= auxHash[i]
+	}
+
+	nonce := taggedHash(bip340TagNonce, t, pub, msg)
+	k := new(big.Int).SetBytes(nonce)
+	k.Mod(k, curve.N)
+	if k.Sign() == 0 {
+		return nil, fmt.Errorf("cannot make Schnorr signature: zero nonce")
+	}
+	rx, ry := curve.ScalarBaseMult(scalarBytes(k))
+	if ry.Bit(0) != 0 {
+		k.Sub(curve.N, k)
+	}
+
+	rBytes := scalarBytes(rx)
+	e := schnorrChallenge(rBytes, pub, msg)
+
+	sVal := new(big.Int).Mul(e, d)
+	sVal.Add(sVal, k)
+	sVal.Mod(sVal, curve.N)
+
+	sig := make([]byte, 0, schnorrSignatureLen)
+	sig = append(sig, rBytes...)
+	sig = append(sig, scalarBytes(sVal)...)
+	return sig, nil
+}
+
+// schnorrVerify verifies the BIP-340 signature sig of msg against
+// the x-only public key pub.
+func schnorrVerify(pub, msg, sig []byte) error {
+	if len(pub) != schnorrPubKeyLen {
+		return fmt.Errorf("cannot parse public key: wrong length %d", len(pub))
+	}
+	if len(sig) != schnorrSignatureLen {
+		return fmt.Errorf("signature has unexpected length %d", len(sig))
+	}
+	curve := secp256k1.S256()
+
+	px, py, err := liftX(pub)
+	if err != nil {
+		return fmt.Errorf("cannot parse public key: %v", err)
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	if r.Cmp(curve.P) >= 0 {
+		return fmt.Errorf("wrong signature")
+	}
+	s := new(big.Int).SetBytes(sig[32:])
+	if s.Cmp(curve.N) >= 0 {
+		return fmt.Errorf("wrong signature")
+	}
+	e := schnorrChallenge(sig[:32], pub, msg)
+
+	// R = s*G - e*P
+	sx, sy := curve.ScalarBaseMult(sig[32:])
+	ex, ey := curve.ScalarMult(px, py, scalarBytes(e))
+	ey.Sub(curve.P, ey)
+	rx, ry := curve.Add(sx, sy, ex, ey)
+
+	if (rx.Sign() == 0 && ry.Sign() == 0) || ry.Bit(0) != 0 || rx.Cmp(r) != 0 {
+		return fmt.Errorf("wrong signature")
+	}
+	return nil
+}
+
+func SchnorrSignatureVerify(pubKey []byte, m *Macaroon) error {
+	s := m.Signature()
+	if s == nil {
+		return fmt.Errorf("signature is nil")
+	}
+	hash := calcMacaroonHash(m)
+	return schnorrVerify(pubKey, hash[:], s)
+}
+
+func schnorrChallenge(r, pub, msg []byte) *big.Int {
+	e := new(big.Int).SetBytes(taggedHash(bip340TagChallenge, r, pub, msg))
+	return e.Mod(e, secp256k1.S256().N)
+}
+
+// liftX returns the point with the given x coordinate and an even
+// y coordinate.
+func liftX(xBytes []byte) (*big.Int, *big.Int, error) {
+	p := secp256k1.S256().P
+	x := new(big.Int).SetBytes(xBytes)
+	if x.Cmp(p) >= 0 {
+		return nil, nil, fmt.Errorf("x coordinate is out of range")
+	}
+	// c = x^3 + 7
+	c := new(big.Int).Exp(x, big.NewInt(3), p)
+	c.Add(c, big.NewInt(7))
+	c.Mod(c, p)
+	// y = c^((p+1)/4)
+	exp := new(big.Int).Add(p, big.NewInt(1))
+	exp.Rsh(exp, 2)
+	y := new(big.Int).Exp(c, exp, p)
+	if new(big.Int).Exp(y, big.NewInt(2), p).Cmp(c) != 0 {
+		return nil, nil, fmt.Errorf("x coordinate is not on the curve")
+	}
+	if y.Bit(0) != 0 {
+		y.Sub(p, y)
+	}
+	return x, y, nil
+}
+
+// scalarBytes returns the 32-byte big-endian encoding of x.
+func scalarBytes(x *big.Int) []byte {
+	var buf [32]byte
+	b := x.Bytes()
+	copy(buf[32-len(b):], b)
+	return buf[:]
+}
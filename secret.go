@@ -0,0 +1,75 @@
+package macaroon_pass
+
+import (
+	"crypto/subtle"
+	"fmt"
+)
+
+// SecretKey holds secret key material: an HMAC key or a private key.
+//
+// The key bytes are not exported and never printed: String and Format,
+// and so every fmt verb, only output a redacted placeholder. Signers and
+// resolvers keep a reference to the SecretKey they were created with
+// instead of a copy of the bytes, so Destroy also disables them. A
+// SecretKey should therefore be passed by pointer and never copied.
+type SecretKey struct {
+	key       []byte
+	destroyed bool
+}
+
+const redactedSecretKey = "SecretKey(REDACTED)"
+
+// NewSecretKey creates a SecretKey holding a copy of key. The caller
+// should overwrite key once it is no longer needed.
+func NewSecretKey(key []byte) *SecretKey {
+	return &SecretKey{key: append([]byte(nil), key...)}
+}
+
+// String implements fmt.Stringer without revealing the key.
+func (k SecretKey) String() string {
+	return redactedSecretKey
+}
+
+// GoString implements fmt.GoStringer without revealing the key.
+func (k SecretKey) GoString() string {
+	return redactedSecretKey
+}
+
+// Format implements fmt.Formatter. All verbs output the same redacted
+// placeholder, so that %x or %v do not leak the key.
+func (k SecretKey) Format(f fmt.State, verb rune) {
+	f.Write([]byte(redactedSecretKey))
+}
+
+// Equal reports whether k and k1 hold the same key. Destroyed keys are
+// equal to no key. The time taken depends only on the lengths of the
+// keys.
+func (k *SecretKey) Equal(k1 *SecretKey) bool {
+	if k.isDestroyed() || k1.isDestroyed() {
+		return false
+	}
+	return subtle.ConstantTimeCompare(k.key, k1.key) == 1
+}
+
+// Destroy overwrites the key with zeros. Afterwards the key, and every
+// signer holding it, refuses to sign or verify.
+func (k *SecretKey) Destroy() {
+	for i := range k.key {
+		k.key[i] = 0
+	}
+	k.destroyed = true
+}
+
+// isDestroyed reports whether the key is missing or was destroyed.
+func (k *SecretKey) isDestroyed() bool {
+	return k == nil || k.destroyed
+}
+
+// bytes returns the key material without copying it. Callers must not
+// keep the returned slice.
+func (k *SecretKey) bytes() []byte {
+	if k == nil {
+		return nil
+	}
+	return k.key
+}
@@ -0,0 +1,137 @@
+package macaroon_pass
+
+import (
+	"fmt"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestSecretKeyIsRedacted(t *testing.T) {
+	c := qt.New(t)
+	key := NewSecretKey([]byte("very secret key"))
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X", "%d"} {
+		c.Assert(fmt.Sprintf(format, key), qt.Equals, "SecretKey(REDACTED)", qt.Commentf("format %s", format))
+		c.Assert(fmt.Sprintf(format, *key), qt.Equals, "SecretKey(REDACTED)", qt.Commentf("format %s", format))
+	}
+	c.Assert(key.String(), qt.Equals, "SecretKey(REDACTED)")
+
+	// Keys held by signers are redacted too.
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(fmt.Sprintf("%+v", signer), qt.Not(qt.Contains), "very secret key")
+	c.Assert(fmt.Sprintf("%#v", signer), qt.Not(qt.Contains), "very secret key")
+}
+
+func TestSecretKeyEqual(t *testing.T) {
+	c := qt.New(t)
+	key := NewSecretKey([]byte("very secret key"))
+	c.Assert(key.Equal(NewSecretKey([]byte("very secret key"))), qt.IsTrue)
+	c.Assert(key.Equal(NewSecretKey([]byte("very secret kez"))), qt.IsFalse)
+	c.Assert(key.Equal(NewSecretKey([]byte("very secret"))), qt.IsFalse)
+	c.Assert(key.Equal(nil), qt.IsFalse)
+}
+
+func TestSecretKeyDestroy(t *testing.T) {
+	c := qt.New(t)
+	key := MakeKey([]byte("secret"))
+	m := MustNew([]byte("some id"), "", V2)
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(HmacSha256SignatureVerify(key, m), qt.IsNil)
+
+	key.Destroy()
+	c.Assert(key.bytes(), qt.DeepEquals, make([]byte, keyLen))
+	c.Assert(key.Equal(key), qt.IsFalse)
+
+	// A destroyed key neither signs nor verifies.
+	err = HmacSha256SignatureVerify(key, m)
+	c.Assert(err, qt.ErrorMatches, "key was destroyed")
+	signer, err = NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	err = MustNew([]byte("some id"), "", V2).Sign(signer)
+	c.Assert(err, qt.ErrorMatches, "key was destroyed")
+
+	macSigner, err := NewMacSigner(AlgorithmBlake2b256, key)
+	c.Assert(err, qt.IsNil)
+	err = MustNew([]byte("some id"), "", V2).Sign(macSigner)
+	c.Assert(err, qt.ErrorMatches, "key was destroyed")
+}
+
+func TestSecretKeyDestroyDisablesSigners(t *testing.T) {
+	c := qt.New(t)
+	newKey := func(n int) *SecretKey {
+		key, err := RandomKey(n)
+		c.Assert(err, qt.IsNil)
+		return key
+	}
+	ecdsaKey := newKey(32)
+	edKey := newKey(32)
+	schnorrKey := newKey(32)
+	chainedKey := newKey(32)
+	compactKey := newKey(32)
+	slhDsaKey := newKey(64)
+	hybridKey := newKey(32)
+
+	schnorrSigner, err := NewSchnorrSigner(schnorrKey)
+	c.Assert(err, qt.IsNil)
+	edSigner, err := NewEd25519Signer(edKey)
+	c.Assert(err, qt.IsNil)
+	compactSigner, err := NewCompactEcdsaSigner(compactKey)
+	c.Assert(err, qt.IsNil)
+	slhDsaSigner, err := NewSlhDsaSigner(slhDsaKey)
+	c.Assert(err, qt.IsNil)
+	hybridSigner, err := NewHybridSigner(hybridKey, MakeKey([]byte("chain key")))
+	c.Assert(err, qt.IsNil)
+	signers := []Signer{
+		NewEcdsaSigner(ecdsaKey),
+		edSigner,
+		schnorrSigner,
+		NewChainedEcdsaSigner(chainedKey),
+		compactSigner,
+		slhDsaSigner,
+		hybridSigner,
+	}
+	for _, key := range []*SecretKey{ecdsaKey, edKey, schnorrKey, chainedKey, compactKey, slhDsaKey, hybridKey} {
+		key.Destroy()
+	}
+	for i, signer := range signers {
+		c.Logf("test %d: %T", i, signer)
+		err := MustNew([]byte("some id"), "", V2).Sign(signer)
+		c.Assert(err, qt.ErrorMatches, "key was destroyed")
+		if _, ok := signer.(*HybridSigner); !ok {
+			_, err = signer.SignData([]byte("data"))
+			c.Assert(err, qt.ErrorMatches, "key was destroyed")
+		}
+	}
+}
+
+func TestSecretKeyAllZero(t *testing.T) {
+	c := qt.New(t)
+	// An all-zero key is a weak key, but not a destroyed one.
+	key := NewSecretKey(make([]byte, keyLen))
+	signer, err := NewHmacSha256Signer(key)
+	c.Assert(err, qt.IsNil)
+	m := MustNew([]byte("some id"), "", V2)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(HmacSha256SignatureVerify(key, m), qt.IsNil)
+	c.Assert(key.Equal(NewSecretKey(make([]byte, keyLen))), qt.IsTrue)
+}
+
+func TestDeriveKey(t *testing.T) {
+	c := qt.New(t)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	derived, err := DeriveKey(key)
+	c.Assert(err, qt.IsNil)
+	c.Assert(derived.Equal(MakeKey(key.bytes())), qt.IsTrue)
+
+	// The derived key is independent of the key it was derived from.
+	key.Destroy()
+	c.Assert(derived.isDestroyed(), qt.IsFalse)
+	_, err = DeriveKey(key)
+	c.Assert(err, qt.ErrorMatches, "key was destroyed")
+	_, err = DeriveKey(nil)
+	c.Assert(err, qt.ErrorMatches, "key was destroyed")
+}
@@ -0,0 +1,566 @@
+package macaroon_pass
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/sha3"
+)
+
+// This file implements the SLH-DSA-SHAKE-128s stateless hash-based
+// signature scheme of FIPS 205 (SPHINCS+), using the pure signing
+// interface with an empty context string. Its security rests on SHAKE256
+// only, so it is an option for long-lived issuer keys which must resist
+// quantum computers. Signatures are 7856 bytes long.
+//
+// Private keys are SK.seed || SK.prf || PK.seed || PK.root and public
+// keys PK.seed || PK.root, as in FIPS 205.
+
+// slhDsaParams holds an SLH-DSA parameter set.
+type slhDsaParams struct {
+	n    int // security parameter, in bytes
+	h    int // total tree height
+	d    int // number of layers
+	hp   int // XMSS tree height h'
+	a    int // FORS tree height
+	k    int // number of FORS trees
+	lgW  int // Winternitz parameter bits
+	m    int // message digest length, in bytes
+	len1 int
+	len2 int
+}
+
+var slhDsaShake128s = &slhDsaParams{
+	n: 16, h: 63, d: 7, hp: 9, a: 12, k: 14, lgW: 4, m: 30,
+	len1: 32, len2: 3,
+}
+
+func (p *slhDsaParams) wotsLen() int {
+	return p.len1 + p.len2
+}
+
+func (p *slhDsaParams) signatureLen() int {
+	return p.n + p.k*(1+p.a)*p.n + (p.h+p.d*p.wotsLen())*p.n
+}
+
+// Address types.
+const (
+	slhAdrsWotsHash  = 0
+	slhAdrsWotsPk    = 1
+	slhAdrsTree      = 2
+	slhAdrsForsTree  = 3
+	slhAdrsForsRoots = 4
+	slhAdrsWotsPrf   = 5
+	slhAdrsForsPrf   = 6
+)
+
+// slhAdrs is the 32-byte address which separates the hash calls.
+type slhAdrs [32]byte
+
+func (a *slhAdrs) setLayer(l int) {
+	binary.BigEndian.PutUint32(a[0:], uint32(l))
+}
+
+func (a *slhAdrs) setTree(t uint64) {
+	binary.BigEndian.PutUint32(a[4:], 0)
+	binary.BigEndian.PutUint64(a[8:], t)
+}
+
+func (a *slhAdrs) setTypeAndClear(t int) {
+	binary.BigEndian.PutUint32(a[16:], uint32(t))
+	for i := 20; i < 32; i++ {
+		a[i] = 0
+	}
+}
+
+func (a *slhAdrs) setKeyPair(i int) {
+	binary.BigEndian.PutUint32(a[20:], uint32(i))
+}
+
+func (a *slhAdrs) keyPair() int {
+	return int(binary.BigEndian.Uint32(a[20:]))
+}
+
+func (a *slhAdrs) setChain(i int) {
+	binary.BigEndian.PutUint32(a[24:], uint32(i))
+}
+
+func (a *slhAdrs) setTreeHeight(z int) {
+	binary.BigEndian.PutUint32(a[24:], uint32(z))
+}
+
+func (a *slhAdrs) setHash(i int) {
+	binary.BigEndian.PutUint32(a[28:], uint32(i))
+}
+
+func (a *slhAdrs) setTreeIndex(i int) {
+	binary.BigEndian.PutUint32(a[28:], uint32(i))
+}
+
+func (a *slhAdrs) treeIndex() int {
+	return int(binary.BigEndian.Uint32(a[28:]))
+}
+
+// slhDsa holds the keys and hash state of a single signing or verifying
+// operation. It is not safe for concurrent use.
+type slhDsa struct {
+	p      *slhDsaParams
+	pkSeed []byte
+	skSeed []byte
+	shake  sha3.ShakeHash
+}
+
+func newSlhDsa(p *slhDsaParams, pkSeed, skSeed []byte) *slhDsa {
+	return &slhDsa{p: p, pkSeed: pkSeed, skSeed: skSeed, shake: sha3.NewShake256()}
+}
+
+func (s *slhDsa) shakeSum(out []byte, data ...[]byte) []byte {
+	s.shake.Reset()
+	for _, d := range data {
+		s.shake.Write(d)
+	}
+	s.shake.Read(out)
+	return out
+}
+
+// thash is the tweakable hash T_l of FIPS 205, which is also used as
+// F and H.
+func (s *slhDsa) thash(adrs *slhAdrs, msg ...[]byte) []byte {
+	data := append([][]byte{s.pkSeed, adrs[:]}, msg...)
+	return s.shakeSum(make([]byte, s.p.n), data...)
+}
+
+func (s *slhDsa) prf(adrs *slhAdrs) []byte {
+	return s.shakeSum(make([]byte, s.p.n), s.pkSeed, adrs[:], s.skSeed)
+}
+
+// base2b splits x into outLen integers of b bits each.
+func base2b(x []byte, b, outLen int) []int {
+	out := make([]int, outLen)
+	in, bits, total := 0, 0, 0
+	for i := range out {
+		for bits < b {
+			total = total<<8 | int(x[in])
+			in++
+			bits += 8
+		}
+		bits -= b
+		out[i] = (total >> uint(bits)) & (1<<uint(b) - 1)
+	}
+	return out
+}
+
+func (s *slhDsa) chain(x []byte, i, steps int, adrs *slhAdrs) []byte {
+	for j := i; j < i+steps; j++ {
+		adrs.setHash(j)
+		x = s.thash(adrs, x)
+	}
+	return x
+}
+
+// wotsDigits returns the base-w digits of msg followed by those of its
+// checksum.
+func (s *slhDsa) wotsDigits(msg []byte) []int {
+	p := s.p
+	w := 1 << uint(p.lgW)
+	digits := base2b(msg, p.lgW, p.len1)
+	csum := 0
+	for _, d := range digits {
+		csum += w - 1 - d
+	}
+	csum <<= uint((8 - p.len2*p.lgW%8) % 8)
+	csumBytes := make([]byte, (p.len2*p.lgW+7)/8)
+	for i := len(csumBytes) - 1; i >= 0; i-- {
+		csumBytes[i] = byte(csum)
+		csum >>= 8
+	}
+	return append(digits, base2b(csumBytes, p.lgW, p.len2)...)
+}
+
+func (s *slhDsa) wotsSecret(adrs slhAdrs, i int) []byte {
+	skAdrs := adrs
+	skAdrs.setTypeAndClear(slhAdrsWotsPrf)
+	skAdrs.setKeyPair(adrs.keyPair())
+	skAdrs.setChain(i)
+	return s.prf(&skAdrs)
+}
+
+func (s *slhDsa) wotsPublicKey(adrs slhAdrs, chains [][]byte) []byte {
+	pkAdrs := adrs
+	pkAdrs.setTypeAndClear(slhAdrsWotsPk)
+	pkAdrs.setKeyPair(adrs.keyPair())
+	return s.thash(&pkAdrs, chains...)
+}
+
+func (s *slhDsa) wotsPkGen(adrs slhAdrs) []byte {
+	w := 1 << uint(s.p.lgW)
+	chains := make([][]byte, s.p.wotsLen())
+	for i := range chains {
+		adrs.setChain(i)
+		chains[i] = s.chain(s.wotsSecret(adrs, i), 0, w-1, &adrs)
+	}
+	return s.wotsPublicKey(adrs, chains)
+}
+
+func (s *slhDsa) wotsSign(msg []byte, adrs slhAdrs) []byte {
+	var sig []byte
+	for i, d := range s.wotsDigits(msg) {
+		adrs.setChain(i)
+		sig = append(sig, s.chain(s.wotsSecret(adrs, i), 0, d, &adrs)...)
+	}
+	return sig
+}
+
+func (s *slhDsa) wotsPkFromSig(sig, msg []byte, adrs slhAdrs) []byte {
+	n, w := s.p.n, 1<<uint(s.p.lgW)
+	chains := make([][]byte, s.p.wotsLen())
+	for i, d := range s.wotsDigits(msg) {
+		adrs.setChain(i)
+		chains[i] = s.chain(sig[i*n:(i+1)*n], d, w-1-d, &adrs)
+	}
+	return s.wotsPublicKey(adrs, chains)
+}
+
+// xmssNode returns the node at height z and index i of the XMSS tree
+// at the layer and tree address of adrs.
+func (s *slhDsa) xmssNode(i, z int, adrs slhAdrs) []byte {
+	if z == 0 {
+		adrs.setTypeAndClear(slhAdrsWotsHash)
+		adrs.setKeyPair(i)
+		return s.wotsPkGen(adrs)
+	}
+	left := s.xmssNode(2*i, z-1, adrs)
+	right := s.xmssNode(2*i+1, z-1, adrs)
+	adrs.setTypeAndClear(slhAdrsTree)
+	adrs.setTreeHeight(z)
+	adrs.setTreeIndex(i)
+	return s.thash(&adrs, left, right)
+}
+
+func (s *slhDsa) xmssSign(msg []byte, idx int, adrs slhAdrs) []byte {
+	var auth []byte
+	for j := 0; j < s.p.hp; j++ {
+		auth = append(auth, s.xmssNode(idx>>uint(j)^1, j, adrs)...)
+	}
+	adrs.setTypeAndClear(slhAdrsWotsHash)
+	adrs.setKeyPair(idx)
+	return append(s.wotsSign(msg, adrs), auth...)
+}
+
+func (s *slhDsa) xmssPkFromSig(idx int, sig, msg []byte, adrs slhAdrs) []byte {
+	n := s.p.n
+	wotsSigLen := s.p.wotsLen() * n
+	adrs.setTypeAndClear(slhAdrsWotsHash)
+	adrs.setKeyPair(idx)
+	node := s.wotsPkFromSig(sig[:wotsSigLen], msg, adrs)
+
+	auth := sig[wotsSigLen:]
+	adrs.setTypeAndClear(slhAdrsTree)
+	adrs.setTreeIndex(idx)
+	for k := 0; k < s.p.hp; k++ {
+		adrs.setTreeHeight(k + 1)
+		sibling := auth[k*n : (k+1)*n]
+		if idx>>uint(k)&1 == 0 {
+			adrs.setTreeIndex(adrs.treeIndex() / 2)
+			node = s.thash(&adrs, node, sibling)
+		} else {
+			adrs.setTreeIndex((adrs.treeIndex() - 1) / 2)
+			node = s.thash(&adrs, sibling, node)
+		}
+	}
+	return node
+}
+
+func (s *slhDsa) xmssSignatureLen() int {
+	return (s.p.wotsLen() + s.p.hp) * s.p.n
+}
+
+// htSign signs msg with the hypertree, from the XMSS tree idxTree and
+// leaf idxLeaf of the bottom layer up.
+func (s *slhDsa) htSign(msg []byte, idxTree uint64, idxLeaf int) []byte {
+	var adrs slhAdrs
+	var sig []byte
+	root := msg
+	for j := 0; j < s.p.d; j++ {
+		if j > 0 {
+			idxLeaf = int(idxTree & (1<<uint(s.p.hp) - 1))
+			idxTree >>= uint(s.p.hp)
+		}
+		adrs.setLayer(j)
+		adrs.setTree(idxTree)
+		xmssSig := s.xmssSign(root, idxLeaf, adrs)
+		sig = append(sig, xmssSig...)
+		if j < s.p.d-1 {
+			root = s.xmssPkFromSig(idxLeaf, xmssSig, root, adrs)
+		}
+	}
+	return sig
+}
+
+// htRoot returns the root of the hypertree computed from the signature
+// of msg.
+func (s *slhDsa) htRoot(msg, sig []byte, idxTree uint64, idxLeaf int) []byte {
+	var adrs slhAdrs
+	xmssSigLen := s.xmssSignatureLen()
+	node := msg
+	for j := 0; j < s.p.d; j++ {
+		if j > 0 {
+			idxLeaf = int(idxTree & (1<<uint(s.p.hp) - 1))
+			idxTree >>= uint(s.p.hp)
+		}
+		adrs.setLayer(j)
+		adrs.setTree(idxTree)
+		node = s.xmssPkFromSig(idxLeaf, sig[j*xmssSigLen:(j+1)*xmssSigLen], node, adrs)
+	}
+	return node
+}
+
+func (s *slhDsa) forsSecret(adrs slhAdrs, idx int) []byte {
+	skAdrs := adrs
+	skAdrs.setTypeAndClear(slhAdrsForsPrf)
+	skAdrs.setKeyPair(adrs.keyPair())
+	skAdrs.setTreeIndex(idx)
+	return s.prf(&skAdrs)
+}
+
+func (s *slhDsa) forsNode(i, z int, adrs slhAdrs) []byte {
+	if z == 0 {
+		sk := s.forsSecret(adrs, i)
+		adrs.setTreeHeight(0)
+		adrs.setTreeIndex(i)
+		return s.thash(&adrs, sk)
+	}
+	left := s.forsNode(2*i, z-1, adrs)
+	right := s.forsNode(2*i+1, z-1, adrs)
+	adrs.setTreeHeight(z)
+	adrs.setTreeIndex(i)
+	return s.thash(&adrs, left, right)
+}
+
+func (s *slhDsa) forsSign(md []byte, adrs slhAdrs) []byte {
+	a := s.p.a
+	var sig []byte
+	for i, idx := range base2b(md, a, s.p.k) {
+		sig = append(sig, s.forsSecret(adrs, i<<uint(a)+idx)...)
+		for j := 0; j < a; j++ {
+			sibling := idx>>uint(j) ^ 1
+			sig = append(sig, s.forsNode(i<<uint(a-j)+sibling, j, adrs)...)
+		}
+	}
+	return sig
+}
+
+func (s *slhDsa) forsPkFromSig(sig, md []byte, adrs slhAdrs) []byte {
+	n, a := s.p.n, s.p.a
+	roots := make([][]byte, s.p.k)
+	for i, idx := range base2b(md, a, s.p.k) {
+		treeSig := sig[i*(a+1)*n : (i+1)*(a+1)*n]
+		adrs.setTreeHeight(0)
+		adrs.setTreeIndex(i<<uint(a) + idx)
+		node := s.thash(&adrs, treeSig[:n])
+		for j := 0; j < a; j++ {
+			adrs.setTreeHeight(j + 1)
+			sibling := treeSig[(j+1)*n : (j+2)*n]
+			if idx>>uint(j)&1 == 0 {
+				adrs.setTreeIndex(adrs.treeIndex() / 2)
+				node = s.thash(&adrs, node, sibling)
+			} else {
+				adrs.setTreeIndex((adrs.treeIndex() - 1) / 2)
+				node = s.thash(&adrs, sibling, node)
+			}
+		}
+		roots[i] = node
+	}
+	pkAdrs := adrs
+	pkAdrs.setTypeAndClear(slhAdrsForsRoots)
+	pkAdrs.setKeyPair(adrs.keyPair())
+	return s.thash(&pkAdrs, roots...)
+}
+
+// digest splits H_msg into the FORS message digest and the hypertree
+// indexes of the signing FORS key.
+func (s *slhDsa) digest(r, pkRoot, msg []byte) (md []byte, idxTree uint64, idxLeaf int) {
+	p := s.p
+	digest := s.shakeSum(make([]byte, p.m), r, s.pkSeed, pkRoot, msg)
+	mdLen := (p.k*p.a + 7) / 8
+	treeLen := (p.h - p.hp + 7) / 8
+	leafLen := (p.hp + 7) / 8
+	md = digest[:mdLen]
+	for _, b := range digest[mdLen : mdLen+treeLen] {
+		idxTree = idxTree<<8 | uint64(b)
+	}
+	idxTree &= 1<<uint(p.h-p.hp) - 1
+	for _, b := range digest[mdLen+treeLen : mdLen+treeLen+leafLen] {
+		idxLeaf = idxLeaf<<8 | int(b)
+	}
+	idxLeaf &= 1<<uint(p.hp) - 1
+	return md, idxTree, idxLeaf
+}
+
+// slhDsaMessage encodes msg for the pure signing interface with an
+// empty context string.
+func slhDsaMessage(msg []byte) []byte {
+	return append([]byte{0, 0}, msg...)
+}
+
+// slhDsaRoot computes PK.root from SK.seed and PK.seed.
+func slhDsaRoot(p *slhDsaParams, skSeed, pkSeed []byte) []byte {
+	s := newSlhDsa(p, pkSeed, skSeed)
+	var adrs slhAdrs
+	adrs.setLayer(p.d - 1)
+	return s.xmssNode(0, p.hp, adrs)
+}
+
+// slhDsaSign signs msg with the private key sk, using addRand as
+// additional randomness.
+func slhDsaSign(p *slhDsaParams, sk, msg, addRand []byte) []byte {
+	return slhDsaSignInternal(p, sk, slhDsaMessage(msg), addRand)
+}
+
+// slhDsaSignInternal is slh_sign_internal of FIPS 205: it signs the
+// encoded message msg.
+func slhDsaSignInternal(p *slhDsaParams, sk, msg, addRand []byte) []byte {
+	n := p.n
+	skSeed, skPrf, pkSeed, pkRoot := sk[:n], sk[n:2*n], sk[2*n:3*n], sk[3*n:4*n]
+	s := newSlhDsa(p, pkSeed, skSeed)
+
+	r := s.shakeSum(make([]byte, n), skPrf, addRand, msg)
+	md, idxTree, idxLeaf := s.digest(r, pkRoot, msg)
+
+	var adrs slhAdrs
+	adrs.setTree(idxTree)
+	adrs.setTypeAndClear(slhAdrsForsTree)
+	adrs.setKeyPair(idxLeaf)
+	forsSig := s.forsSign(md, adrs)
+	forsPk := s.forsPkFromSig(forsSig, md, adrs)
+
+	sig := make([]byte, 0, p.signatureLen())
+	sig = append(sig, r...)
+	sig = append(sig, forsSig...)
+	return append(sig, s.htSign(forsPk, idxTree, idxLeaf)...)
+}
+
+// slhDsaVerify verifies the signature sig of msg against the public key
+// pk.
+func slhDsaVerify(p *slhDsaParams, pk, msg, sig []byte) error {
+	return slhDsaVerifyInternal(p, pk, slhDsaMessage(msg), sig)
+}
+
+// slhDsaVerifyInternal is slh_verify_internal of FIPS 205: it verifies
+// the signature of the encoded message msg.
+func slhDsaVerifyInternal(p *slhDsaParams, pk, msg, sig []byte) error {
+	n := p.n
+	if len(pk) != 2*n {
+		return fmt.Errorf("cannot parse public key: wrong length %d", len(pk))
+	}
+	if len(sig) != p.signatureLen() {
+		return fmt.Errorf("signature has unexpected length %d", len(sig))
+	}
+	pkSeed, pkRoot := pk[:n], pk[n:]
+	s := newSlhDsa(p, pkSeed, nil)
+
+	forsSigLen := p.k * (1 + p.a) * n
+	r, forsSig, htSig := sig[:n], sig[n:n+forsSigLen], sig[n+forsSigLen:]
+	md, idxTree, idxLeaf := s.digest(r, pkRoot, msg)
+
+	var adrs slhAdrs
+	adrs.setTree(idxTree)
+	adrs.setTypeAndClear(slhAdrsForsTree)
+	adrs.setKeyPair(idxLeaf)
+	forsPk := s.forsPkFromSig(forsSig, md, adrs)
+
+	if string(s.htRoot(forsPk, htSig, idxTree, idxLeaf)) != string(pkRoot) {
+		return fmt.Errorf("wrong signature")
+	}
+	return nil
+}
+
+// SlhDsaSigner signs macaroons with SLH-DSA-SHAKE-128s.
+type SlhDsaSigner struct {
+	key  *SecretKey
+	pub  []byte
+	rand io.Reader
+}
+
+// NewSlhDsaSigner creates a signer from either a 48-byte seed, which
+// holds SK.seed, SK.prf and PK.seed, or a 64-byte private key. Deriving
+// the public key from a seed takes some time, so long-lived keys should
+// be stored as private keys, as returned by PrivateKey.
+func NewSlhDsaSigner(key *SecretKey) (*SlhDsaSigner, error) {
+	p := slhDsaShake128s
+	k := key.bytes()
+	var pub []byte
+	switch len(k) {
+	case 3 * p.n:
+		pub = make([]byte, 0, 2*p.n)
+		pub = append(pub, k[2*p.n:]...)
+		pub = append(pub, slhDsaRoot(p, k[:p.n], k[2*p.n:])...)
+	case 4 * p.n:
+		pub = append([]byte(nil), k[2*p.n:]...)
+	default:
+		return nil, fmt.Errorf("wrong SLH-DSA key length %d", len(k))
+	}
+	return &SlhDsaSigner{key: key, pub: pub, rand: rand.Reader}, nil
+}
+
+// PrivateKey returns a copy of the 64-byte private key of the signer.
+func (s *SlhDsaSigner) PrivateKey() *SecretKey {
+	return &SecretKey{key: s.privateKey()}
+}
+
+// privateKey assembles the private key from SK.seed and SK.prf, which
+// are read from the key on every call, and the public key.
+func (s *SlhDsaSigner) privateKey() []byte {
+	n := slhDsaShake128s.n
+	sk := make([]byte, 0, 4*n)
+	sk = append(sk, s.key.bytes()[:2*n]...)
+	return append(sk, s.pub...)
+}
+
+// PublicKey returns the 32-byte public key which verifies signatures of
+// the signer.
+func (s *SlhDsaSigner) PublicKey() []byte {
+	return append([]byte(nil), s.pub...)
+}
+
+func (s *SlhDsaSigner) SignData(data []byte) ([]byte, error) {
+	return s.sign(data)
+}
+
+func (s *SlhDsaSigner) SignMacaroon(m *Macaroon) error {
+	if s.key.isDestroyed() {
+		return fmt.Errorf("key was destroyed")
+	}
+	m.setAlgorithm(AlgorithmSlhDsa)
+	hash := calcMacaroonHash(m)
+	sig, err := s.sign(hash[:])
+	if err != nil {
+		return err
+	}
+	m.sig = sig
+	return nil
+}
+
+func (s *SlhDsaSigner) sign(msg []byte) ([]byte, error) {
+	addRand := make([]byte, slhDsaShake128s.n)
+	if _, err := io.ReadFull(s.rand, addRand); err != nil {
+		return nil, fmt.Errorf("cannot generate random bytes: %v", err)
+	}
+	if s.key.isDestroyed() {
+		return nil, fmt.Errorf("key was destroyed")
+	}
+	sk := s.PrivateKey()
+	defer sk.Destroy()
+	return slhDsaSign(slhDsaShake128s, sk.bytes(), msg, addRand), nil
+}
+
+func SlhDsaSignatureVerify(pubKey []byte, m *Macaroon) error {
+	s := m.Signature()
+	if s == nil {
+		return fmt.Errorf("signature is nil")
+	}
+	hash := calcMacaroonHash(m)
+	return slhDsaVerify(slhDsaShake128s, pubKey, hash[:], s)
+}
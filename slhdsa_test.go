@@ -0,0 +1,229 @@
+package macaroon_pass
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestBase2b(t *testing.T) {
+	c := qt.New(t)
+	c.Assert(base2b([]byte{0x12, 0x34, 0x56}, 4, 6), qt.DeepEquals, []int{1, 2, 3, 4, 5, 6})
+	c.Assert(base2b([]byte{0x12, 0x34, 0x56}, 12, 2), qt.DeepEquals, []int{0x123, 0x456})
+	c.Assert(base2b([]byte{0xff, 0x80}, 6, 2), qt.DeepEquals, []int{0x3f, 0x38})
+}
+
+func TestSlhDsaParams(t *testing.T) {
+	c := qt.New(t)
+	p := slhDsaShake128s
+	c.Assert(p.signatureLen(), qt.Equals, 7856)
+	c.Assert(p.wotsLen(), qt.Equals, 35)
+	c.Assert(p.h, qt.Equals, p.d*p.hp)
+	c.Assert(p.m, qt.Equals, (p.k*p.a+7)/8+(p.h-p.hp+7)/8+(p.hp+7)/8)
+}
+
+// slhDsaKnownAnswers holds deterministic SLH-DSA-SHAKE-128s vectors:
+// the key is generated from SK.seed || SK.prf || PK.seed, and msg is
+// signed with the pure interface, an empty context and addRand = PK.seed.
+// The expected values were computed with a separate implementation of
+// FIPS 205, not with this one. sigSha256 is the SHA-256 of the signature.
+var slhDsaKnownAnswers = []struct {
+	seed      string
+	msg       string
+	pub       string
+	sigSha256 string
+}{{
+	seed:      "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f202122232425262728292a2b2c2d2e2f",
+	msg:       "SLH-DSA-SHAKE-128s test message",
+	pub:       "202122232425262728292a2b2c2d2e2f89fd81fdbb5b94129b14761bdc6bf682",
+	sigSha256: "f3f0a43db1625b8db3d94d1e6b27f7f1c5fbc58403eb390458f1a479e3c2cca5",
+}}
+
+func TestSlhDsaKnownAnswers(t *testing.T) {
+	c := qt.New(t)
+	p := slhDsaShake128s
+	for _, test := range slhDsaKnownAnswers {
+		seed, err := hex.DecodeString(test.seed)
+		c.Assert(err, qt.IsNil)
+		signer, err := NewSlhDsaSigner(NewSecretKey(seed))
+		c.Assert(err, qt.IsNil)
+		c.Assert(hex.EncodeToString(signer.PublicKey()), qt.Equals, test.pub)
+
+		sk := signer.PrivateKey()
+		sig := slhDsaSign(p, sk.bytes(), []byte(test.msg), seed[2*p.n:])
+		sk.Destroy()
+		sum := sha256.Sum256(sig)
+		c.Assert(hex.EncodeToString(sum[:]), qt.Equals, test.sigSha256)
+		c.Assert(slhDsaVerify(p, signer.PublicKey(), []byte(test.msg), sig), qt.IsNil)
+	}
+}
+
+// slhDsaAcvp holds the SLH-DSA-SHAKE-128s keyGen, sigGen and sigVer
+// vectors of the NIST ACVP server, for the internal interface and for
+// the pure external one. Pre-hash signatures are not supported.
+type slhDsaAcvp struct {
+	KeyGen []struct {
+		TcId   int
+		SkSeed string
+		SkPrf  string
+		PkSeed string
+		Sk     string
+		Pk     string
+	}
+	SigGen []struct {
+		TcId                 int
+		Interface            string
+		Deterministic        bool
+		Sk                   string
+		Message              string
+		Context              string
+		AdditionalRandomness string
+		SignatureSha256      string
+	}
+	SigVer []struct {
+		TcId       int
+		Interface  string
+		Pk         string
+		Message    string
+		Context    string
+		Signature  string
+		TestPassed bool
+	}
+}
+
+func readSlhDsaAcvp(c *qt.C) *slhDsaAcvp {
+	f, err := os.Open("testdata/slhdsa-shake-128s-acvp.json.gz")
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+	r, err := gzip.NewReader(f)
+	c.Assert(err, qt.IsNil)
+	var v slhDsaAcvp
+	c.Assert(json.NewDecoder(r).Decode(&v), qt.IsNil)
+	return &v
+}
+
+// slhDsaAcvpMessage returns the message passed to the internal
+// functions: the external interface prepends the context.
+func slhDsaAcvpMessage(c *qt.C, iface string, msg, ctx []byte) []byte {
+	switch iface {
+	case "internal":
+		return msg
+	case "external":
+		return append(append([]byte{0, byte(len(ctx))}, ctx...), msg...)
+	}
+	c.Fatalf("unknown signature interface %q", iface)
+	return nil
+}
+
+func TestSlhDsaAcvp(t *testing.T) {
+	c := qt.New(t)
+	p := slhDsaShake128s
+	v := readSlhDsaAcvp(c)
+	c.Assert(v.KeyGen, qt.HasLen, 10)
+	c.Assert(v.SigGen, qt.HasLen, 28)
+	c.Assert(v.SigVer, qt.HasLen, 28)
+
+	for _, test := range v.KeyGen {
+		seed := mustDecodeHex(test.SkSeed + test.SkPrf + test.PkSeed)
+		signer, err := NewSlhDsaSigner(NewSecretKey(seed))
+		c.Assert(err, qt.IsNil)
+		c.Assert(hex.EncodeToString(signer.PublicKey()), qt.Equals, strings.ToLower(test.Pk), qt.Commentf("tcId %d", test.TcId))
+		sk := signer.PrivateKey()
+		c.Assert(hex.EncodeToString(sk.bytes()), qt.Equals, strings.ToLower(test.Sk), qt.Commentf("tcId %d", test.TcId))
+	}
+
+	// Signing is slow, so -short signs one message of each group only.
+	signed := make(map[string]bool)
+	for _, test := range v.SigGen {
+		group := fmt.Sprint(test.Interface, test.Deterministic)
+		if testing.Short() && signed[group] {
+			continue
+		}
+		signed[group] = true
+		sk := mustDecodeHex(test.Sk)
+		msg := slhDsaAcvpMessage(c, test.Interface, mustDecodeHex(test.Message), mustDecodeHex(test.Context))
+		addRand := sk[2*p.n : 3*p.n]
+		if !test.Deterministic {
+			addRand = mustDecodeHex(test.AdditionalRandomness)
+		}
+		sig := slhDsaSignInternal(p, sk, msg, addRand)
+		sum := sha256.Sum256(sig)
+		c.Assert(hex.EncodeToString(sum[:]), qt.Equals, test.SignatureSha256, qt.Commentf("tcId %d", test.TcId))
+		c.Assert(slhDsaVerifyInternal(p, sk[2*p.n:], msg, sig), qt.IsNil, qt.Commentf("tcId %d", test.TcId))
+	}
+
+	var passed, failed int
+	for _, test := range v.SigVer {
+		msg := slhDsaAcvpMessage(c, test.Interface, mustDecodeHex(test.Message), mustDecodeHex(test.Context))
+		err := slhDsaVerifyInternal(p, mustDecodeHex(test.Pk), msg, mustDecodeHex(test.Signature))
+		if test.TestPassed {
+			passed++
+			c.Assert(err, qt.IsNil, qt.Commentf("tcId %d", test.TcId))
+		} else {
+			failed++
+			c.Assert(err, qt.Not(qt.IsNil), qt.Commentf("tcId %d", test.TcId))
+		}
+	}
+	c.Assert(passed, qt.Equals, 4)
+	c.Assert(failed, qt.Equals, 24)
+}
+
+func TestSlhDsaSignatureVerify(t *testing.T) {
+	c := qt.New(t)
+	seed, err := RandomKey(48)
+	c.Assert(err, qt.IsNil)
+	signer, err := NewSlhDsaSigner(seed)
+	c.Assert(err, qt.IsNil)
+	pub := signer.PublicKey()
+	c.Assert(pub, qt.HasLen, 32)
+	c.Assert(pub[:16], qt.DeepEquals, seed.bytes()[32:])
+
+	m := MustNew([]byte("issuer 1"), "", V2)
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 100")), qt.IsNil)
+	c.Assert(m.Sign(signer), qt.IsNil)
+	c.Assert(m.Algorithm(), qt.Equals, AlgorithmSlhDsa)
+	c.Assert(m.Signature(), qt.HasLen, 7856)
+	c.Assert(SlhDsaSignatureVerify(pub, m), qt.IsNil)
+
+	// The large signature survives both V2 encodings.
+	data, err := (&marshaller{m}).MarshalBinary()
+	c.Assert(err, qt.IsNil)
+	m1 := marshaller{&Macaroon{}}
+	c.Assert(m1.UnmarshalBinary(data), qt.IsNil)
+	c.Assert(SlhDsaSignatureVerify(pub, m1.Macaroon), qt.IsNil)
+	data, err = (&marshaller{m}).MarshalJSON()
+	c.Assert(err, qt.IsNil)
+	m2 := marshaller{&Macaroon{}}
+	c.Assert(m2.UnmarshalJSON(data), qt.IsNil)
+	c.Assert(SlhDsaSignatureVerify(pub, m2.Macaroon), qt.IsNil)
+
+	// A signer made from the private key has the same public key.
+	signer1, err := NewSlhDsaSigner(signer.PrivateKey())
+	c.Assert(err, qt.IsNil)
+	c.Assert(signer1.PublicKey(), qt.DeepEquals, pub)
+	other, err := RandomKey(48)
+	c.Assert(err, qt.IsNil)
+	signer2, err := NewSlhDsaSigner(other)
+	c.Assert(err, qt.IsNil)
+	c.Assert(SlhDsaSignatureVerify(signer2.PublicKey(), m), qt.ErrorMatches, "wrong signature")
+
+	c.Assert(m.AddFirstPartyCaveat([]byte("amount 1000")), qt.IsNil)
+	c.Assert(SlhDsaSignatureVerify(pub, m), qt.ErrorMatches, "wrong signature")
+
+	sig := append([]byte(nil), m1.Signature()...)
+	sig[len(sig)-1] ^= 1
+	m1.SetSignature(sig)
+	c.Assert(SlhDsaSignatureVerify(pub, m1.Macaroon), qt.ErrorMatches, "wrong signature")
+	m1.SetSignature(sig[:64])
+	c.Assert(SlhDsaSignatureVerify(pub, m1.Macaroon), qt.ErrorMatches, "signature has unexpected length 64")
+
+	_, err = NewSlhDsaSigner(NewSecretKey(seed.bytes()[:32]))
+	c.Assert(err, qt.ErrorMatches, "wrong SLH-DSA key length 32")
+}
@@ -0,0 +1,158 @@
+package macaroon_pass
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/nacl/box"
+)
+
+// Public-key third-party caveats let an issuer delegate to a discharge
+// service knowing only its Curve25519 public key. The caveat id holds
+// the condition and the discharge root key, sealed with NaCl box to the
+// public key of the third party with a one-time key pair. The third
+// party recovers both with DecodeThirdPartyCaveatId and, as for
+// AddThirdPartyCaveat, signs the discharge macaroon with the key
+// MakeKey derives from the root key. The verification id is made as by
+// AddThirdPartyCaveat.
+//
+// The verifier recovers the root key from the verification id with the
+// signature of the MAC chain, so only macaroons signed with an
+// HMAC-SHA256 chain, by HmacSha256Signer or HybridSigner, can hold such
+// caveats. Macaroons signed with ECDSA, Ed25519, Schnorr or any other
+// public-key signer have no secret signature to encrypt the root key
+// under, and AddPublicKeyThirdPartyCaveat rejects them. Their issuers
+// delegate with Emitter.DelegateAuthorization instead, and the third
+// party signs the discharge macaroon with a key of its own which the
+// verifier resolves by the caveat id.
+//
+// The caveat id has the following format. The encrypted part holds
+// packets as parsed by parsePacketV2: the root key and the condition.
+//
+// version [1 byte]
+// third party public key prefix [4 bytes]
+// one-time public key [32 bytes]
+// nonce [24 bytes]
+// encrypted part
+
+const thirdPartyCaveatVersion = 1
+
+const thirdPartyKeyPrefixLen = 4
+
+// Field constants as used in the encrypted part of a caveat id.
+const (
+	thirdPartyFieldRootKey   fieldType = 1
+	thirdPartyFieldCondition fieldType = 2
+)
+
+// ThirdPartyKeyPair holds the Curve25519 key pair of a discharge service.
+type ThirdPartyKeyPair struct {
+	Public  [32]byte
+	Private [32]byte
+}
+
+func GenerateThirdPartyKeyPair() (*ThirdPartyKeyPair, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate key pair: %v", err)
+	}
+	return &ThirdPartyKeyPair{Public: *pub, Private: *priv}, nil
+}
+
+// EncodeThirdPartyCaveatId seals the root key and the condition to the
+// public key of the third party.
+func EncodeThirdPartyCaveatId(thirdPartyKey *[32]byte, rootKey, condition []byte) ([]byte, error) {
+	return encodeThirdPartyCaveatId(thirdPartyKey, rootKey, condition, rand.Reader)
+}
+
+func encodeThirdPartyCaveatId(thirdPartyKey *[32]byte, rootKey, condition []byte, r io.Reader) ([]byte, error) {
+	if len(rootKey) == 0 {
+		return nil, fmt.Errorf("no root key was passed when encode third-party caveat id")
+	}
+	pub, priv, err := box.GenerateKey(r)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate key pair: %v", err)
+	}
+	nonce, err := newNonce(r)
+	if err != nil {
+		return nil, err
+	}
+	plain := appendPacketV2(nil, packetV2{
+		fieldType: thirdPartyFieldRootKey,
+		data:      rootKey,
+	})
+	plain = appendPacketV2(plain, packetV2{
+		fieldType: thirdPartyFieldCondition,
+		data:      condition,
+	})
+
+	data := []byte{thirdPartyCaveatVersion}
+	data = append(data, thirdPartyKey[:thirdPartyKeyPrefixLen]...)
+	data = append(data, pub[:]...)
+	data = append(data, nonce[:]...)
+	return box.Seal(data, plain, nonce, thirdPartyKey, priv), nil
+}
+
+// DecodeThirdPartyCaveatId opens a caveat id made by
+// EncodeThirdPartyCaveatId and returns the root key and the condition.
+// The root key is returned as sealed; the discharge macaroon must be
+// signed with the key MakeKey derives from it, not with the root key
+// itself.
+func DecodeThirdPartyCaveatId(key *ThirdPartyKeyPair, caveatId []byte) ([]byte, []byte, error) {
+	if len(caveatId) == 0 || caveatId[0] != thirdPartyCaveatVersion {
+		return nil, nil, fmt.Errorf("caveat id is not encrypted to a public key")
+	}
+	data := caveatId[1:]
+	if len(data) < thirdPartyKeyPrefixLen+32+nonceLen+box.Overhead {
+		return nil, nil, fmt.Errorf("caveat id too short")
+	}
+	if !bytes.Equal(data[:thirdPartyKeyPrefixLen], key.Public[:thirdPartyKeyPrefixLen]) {
+		return nil, nil, fmt.Errorf("caveat id is encrypted to another public key")
+	}
+	data = data[thirdPartyKeyPrefixLen:]
+	var pub [32]byte
+	copy(pub[:], data)
+	data = data[32:]
+	var nonce [nonceLen]byte
+	copy(nonce[:], data)
+	data = data[nonceLen:]
+
+	plain, ok := box.Open(nil, data, &nonce, &pub, &key.Private)
+	if !ok {
+		return nil, nil, fmt.Errorf("decryption failure")
+	}
+	plain, rootKey, err := parsePacketV2(plain)
+	if err != nil || rootKey.fieldType != thirdPartyFieldRootKey {
+		return nil, nil, fmt.Errorf("invalid caveat id: no root key")
+	}
+	plain, condition, err := parsePacketV2(plain)
+	if err != nil || condition.fieldType != thirdPartyFieldCondition || len(plain) > 0 {
+		return nil, nil, fmt.Errorf("invalid caveat id: no condition")
+	}
+	return rootKey.data, condition.data, nil
+}
+
+// AddPublicKeyThirdPartyCaveat adds a third-party caveat with the given
+// condition for the third party with the given public key. A fresh root
+// key is sealed in the caveat id. As with AddThirdPartyCaveat, the
+// macaroon must be signed with an HMAC SHA256 chain before the caveat
+// is added, and signed again after.
+func (m *Macaroon) AddPublicKeyThirdPartyCaveat(thirdPartyKey *[32]byte, condition []byte, loc string) error {
+	switch m.chainAlgorithm() {
+	case AlgorithmHmacSha256, AlgorithmHybrid:
+	default:
+		return fmt.Errorf("cannot add public-key third-party caveat to %s macaroon, it needs an HMAC-SHA256 chain", m.Algorithm())
+	}
+	rootKey, err := RandomKey(keyLen)
+	if err != nil {
+		return err
+	}
+	defer rootKey.Destroy()
+	caveatId, err := EncodeThirdPartyCaveatId(thirdPartyKey, rootKey.bytes(), condition)
+	if err != nil {
+		return err
+	}
+	return m.AddThirdPartyCaveat(rootKey.bytes(), caveatId, loc)
+}
@@ -0,0 +1,104 @@
+package macaroon_pass
+
+import (
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestThirdPartyCaveatId(t *testing.T) {
+	c := qt.New(t)
+	das, err := GenerateThirdPartyKeyPair()
+	c.Assert(err, qt.IsNil)
+	rootKey := []byte("discharge root key")
+
+	cid, err := EncodeThirdPartyCaveatId(&das.Public, rootKey, []byte("merchant 42"))
+	c.Assert(err, qt.IsNil)
+	key, condition, err := DecodeThirdPartyCaveatId(das, cid)
+	c.Assert(err, qt.IsNil)
+	c.Assert(key, qt.DeepEquals, rootKey)
+	c.Assert(condition, qt.DeepEquals, []byte("merchant 42"))
+
+	other, err := GenerateThirdPartyKeyPair()
+	c.Assert(err, qt.IsNil)
+	_, _, err = DecodeThirdPartyCaveatId(other, cid)
+	c.Assert(err, qt.ErrorMatches, "caveat id is encrypted to another public key")
+
+	cid[len(cid)-1] ^= 1
+	_, _, err = DecodeThirdPartyCaveatId(das, cid)
+	c.Assert(err, qt.ErrorMatches, "decryption failure")
+
+	_, _, err = DecodeThirdPartyCaveatId(das, []byte("merchant 42"))
+	c.Assert(err, qt.ErrorMatches, "caveat id is not encrypted to a public key")
+	_, _, err = DecodeThirdPartyCaveatId(das, cid[:40])
+	c.Assert(err, qt.ErrorMatches, "caveat id too short")
+
+	_, err = encodeThirdPartyCaveatId(&das.Public, rootKey, nil, &ErrorReader{})
+	c.Assert(err, qt.ErrorMatches, "cannot generate key pair: fail")
+}
+
+func TestPublicKeyThirdPartyCaveat(t *testing.T) {
+	c := qt.New(t)
+	das, err := GenerateThirdPartyKeyPair()
+	c.Assert(err, qt.IsNil)
+	rootKey := MakeKey([]byte("card key"))
+
+	emt := NewEmitter(mustHmacSha256Signer(c, rootKey), []byte("card 0001"))
+	c.Assert(emt.AuthorizeOperation([]byte("amount 100")), qt.IsNil)
+	err = emt.DelegateAuthorizationToPublicKey([]byte("merchant 42"), "das", &das.Public)
+	c.Assert(err, qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+
+	// The DAS recovers the discharge root key from the caveat alone.
+	cav := m.Caveats()[1]
+	c.Assert(cav.Location, qt.Equals, "das")
+	dischargeKey, condition, err := DecodeThirdPartyCaveatId(das, cav.Id)
+	c.Assert(err, qt.IsNil)
+	c.Assert(condition, qt.DeepEquals, []byte("merchant 42"))
+
+	// The discharge is signed with the key derived from the root key;
+	// the root key itself does not discharge the caveat.
+	emt = NewEmitter(mustHmacSha256Signer(c, NewSecretKey(dischargeKey)), cav.Id)
+	dm, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	dm.Bind(m.Signature())
+	err = HmacSha256DischargeVerify(rootKey, m, []*Macaroon{dm})
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	emt = NewEmitter(mustHmacSha256Signer(c, MakeKey(dischargeKey)), cav.Id)
+	c.Assert(emt.AuthorizeOperation([]byte("time < 2030")), qt.IsNil)
+	dm, err = emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	dm.Bind(m.Signature())
+
+	err = HmacSha256DischargeVerify(rootKey, m, []*Macaroon{dm})
+	c.Assert(err, qt.IsNil)
+}
+
+func TestPublicKeyThirdPartyCaveatNeedsHmacChain(t *testing.T) {
+	c := qt.New(t)
+	das, err := GenerateThirdPartyKeyPair()
+	c.Assert(err, qt.IsNil)
+	key, err := RandomKey(32)
+	c.Assert(err, qt.IsNil)
+	edSigner, err := NewEd25519Signer(key)
+	c.Assert(err, qt.IsNil)
+	schnorrSigner, err := NewSchnorrSigner(key)
+	c.Assert(err, qt.IsNil)
+
+	for _, signer := range []Signer{NewEcdsaSigner(key), edSigner, schnorrSigner} {
+		emt := NewEmitter(signer, []byte("card 0001"))
+		c.Assert(emt.DelegateAuthorizationToPublicKey([]byte("merchant 42"), "das", &das.Public), qt.IsNil)
+		_, err = emt.EmitMacaroon()
+		c.Assert(err, qt.ErrorMatches, `cannot add third-party caveat: cannot add public-key third-party caveat to .* macaroon, it needs an HMAC-SHA256 chain`)
+	}
+
+	// Public-key issuers delegate with a plain third-party caveat, and
+	// the third party signs the discharge macaroon with its own key.
+	emt := NewEmitter(NewEcdsaSigner(key), []byte("card 0001"))
+	c.Assert(emt.DelegateAuthorization([]byte("merchant 42"), "das", []byte("nonce")), qt.IsNil)
+	m, err := emt.EmitMacaroon()
+	c.Assert(err, qt.IsNil)
+	c.Assert(m.Caveats()[0].IsThirdParty(), qt.IsTrue)
+}
@@ -0,0 +1,517 @@
+package macaroon_pass
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"math/big"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+)
+
+// This file implements threshold ECDSA issuance. The issuing key is
+// shared between n nodes with a Feldman verifiable secret sharing of
+// degree k-1, dealt jointly by all nodes, so that any k nodes can sign
+// and any k-1 of them learn nothing about the key. No node ever holds
+// the whole key.
+//
+// Signing follows Gennaro and Goldfeder, "Fast Multiparty Threshold
+// ECDSA with Fast Trustless Setup": the signers turn their key shares
+// into additive shares and convert the products of their secret values
+// into additive shares with the Paillier encryption of every node. This
+// works for every threshold 1 <= k <= n, including 2-of-2 and 2-of-3
+// groups.
+//
+// The protocol is implemented here on the secp256k1 operations the
+// package already uses; github.com/dcpn-io/threshold is only used by the
+// tests to generate keys. The range proofs of the paper are not
+// implemented, so the nodes are trusted to follow the protocol, and the
+// math/big arithmetic is not constant-time.
+//
+// The signature is an ordinary secp256k1 ECDSA signature which
+// verifies with EcdsaSignatureVerify against the group public key.
+//
+// The nodes are simulated in-process: every node keeps its own share
+// and Paillier key, and the group only relays the values that a node
+// would broadcast or send to its peers over the network.
+
+// ThresholdNode is a single issuing node. It holds only its own
+// share of the issuing key.
+type ThresholdNode struct {
+	index    int
+	keyShare *big.Int
+	paillier *paillierKey
+}
+
+// Index returns the index of the node within its group, starting from 1.
+func (n *ThresholdNode) Index() int {
+	return n.index
+}
+
+// ThresholdGroup is a set of issuing nodes sharing one issuing key.
+type ThresholdGroup struct {
+	k      int
+	nodes  []*ThresholdNode
+	pubKey *secp256k1.PublicKey
+}
+
+// NewThresholdGroup runs a distributed key generation between n nodes
+// so that any k of them can sign and any k-1 of them learn nothing
+// about the issuing key.
+func NewThresholdGroup(k, n int) (*ThresholdGroup, error) {
+	if k < 1 {
+		return nil, fmt.Errorf("threshold %d is not supported", k)
+	}
+	if n < k {
+		return nil, fmt.Errorf("%d nodes are not enough for threshold %d", n, k)
+	}
+	g := &ThresholdGroup{
+		k:     k,
+		nodes: make([]*ThresholdNode, n),
+	}
+	for i := range g.nodes {
+		pk, err := newPaillierKey()
+		if err != nil {
+			return nil, err
+		}
+		g.nodes[i] = &ThresholdNode{index: i + 1, keyShare: new(big.Int), paillier: pk}
+	}
+
+	curve := secp256k1.S256()
+	var pubX, pubY *big.Int
+	for _, dealer := range g.nodes {
+		secret, err := randomScalar()
+		if err != nil {
+			return nil, err
+		}
+		d, err := newSharing(secret, k-1)
+		if err != nil {
+			return nil, err
+		}
+		commitments := d.commitments()
+		for _, node := range g.nodes {
+			share := d.eval(node.index)
+			if !verifyShare(commitments, node.index, share) {
+				return nil, fmt.Errorf("node %d dealt an inconsistent key share to node %d", dealer.index, node.index)
+			}
+			node.keyShare.Add(node.keyShare, share)
+			node.keyShare.Mod(node.keyShare, curve.N)
+		}
+		if pubX == nil {
+			pubX, pubY = commitments[0].x, commitments[0].y
+		} else {
+			pubX, pubY = curve.Add(pubX, pubY, commitments[0].x, commitments[0].y)
+		}
+	}
+	g.pubKey = secp256k1.NewPublicKey(pubX, pubY)
+	return g, nil
+}
+
+// PublicKey returns the serialized group public key.
+func (g *ThresholdGroup) PublicKey() []byte {
+	return g.pubKey.SerializeCompressed()
+}
+
+// Threshold returns the number of nodes needed to sign. Up to
+// Threshold()-1 colluding nodes learn nothing about the key.
+func (g *ThresholdGroup) Threshold() int {
+	return g.k
+}
+
+// Node returns the node with the given index.
+func (g *ThresholdGroup) Node(index int) (*ThresholdNode, error) {
+	if index < 1 || index > len(g.nodes) {
+		return nil, fmt.Errorf("no node with index %d", index)
+	}
+	return g.nodes[index-1], nil
+}
+
+type ThresholdSigner struct {
+	group   *ThresholdGroup
+	signers []*ThresholdNode
+}
+
+// NewThresholdSigner creates a signer in which the nodes with the given
+// indices jointly sign. At least Threshold() distinct nodes must take part.
+func NewThresholdSigner(g *ThresholdGroup, indices []int) (*ThresholdSigner, error) {
+	if g == nil {
+		return nil, fmt.Errorf("no group was passed when create threshold signer")
+	}
+	seen := make(map[int]bool)
+	signers := make([]*ThresholdNode, 0, len(indices))
+	for _, i := range indices {
+		if seen[i] {
+			return nil, fmt.Errorf("node %d is listed twice", i)
+		}
+		seen[i] = true
+		node, err := g.Node(i)
+		if err != nil {
+			return nil, err
+		}
+		signers = append(signers, node)
+	}
+	if len(signers) < g.k {
+		return nil, fmt.Errorf("%d nodes are not enough to sign, need at least %d", len(signers), g.k)
+	}
+	return &ThresholdSigner{group: g, signers: signers}, nil
+}
+
+func (s *ThresholdSigner) SignData(data []byte) ([]byte, error) {
+	hash := sha256.Sum256(data)
+	return s.sign(hash[:])
+}
+
+func (s *ThresholdSigner) SignMacaroon(m *Macaroon) error {
+	m.setAlgorithm(AlgorithmEcdsa)
+	hash := calcMacaroonHash(m)
+	sig, err := s.sign(hash[:])
+	if err != nil {
+		return err
+	}
+	m.sig = sig
+	return nil
+}
+
+// sign runs the signing protocol between the signer nodes and returns
+// the DER-encoded signature of hash.
+func (s *ThresholdSigner) sign(hash []byte) ([]byte, error) {
+	curve := secp256k1.S256()
+	indices := make([]int, len(s.signers))
+	for i, node := range s.signers {
+		indices[i] = node.index
+	}
+
+	for {
+		// Every node picks its share k_i of the nonce and gamma_i of
+		// a blinding value, broadcasts Gamma_i = gamma_i*G and turns
+		// its key share into an additive share w_i of the key, so
+		// that k = sum(k_i), gamma = sum(gamma_i) and x = sum(w_i).
+		kShares := make(map[int]*big.Int)
+		gammaShares := make(map[int]*big.Int)
+		wShares := make(map[int]*big.Int)
+		var gx, gy *big.Int
+		for _, node := range s.signers {
+			i := node.index
+			var err error
+			if kShares[i], err = randomScalar(); err != nil {
+				return nil, err
+			}
+			if gammaShares[i], err = randomScalar(); err != nil {
+				return nil, err
+			}
+			w := new(big.Int).Mul(node.keyShare, lagrangeCoefficient(i, indices))
+			wShares[i] = w.Mod(w, curve.N)
+			px, py := curve.ScalarBaseMult(scalarBytes(gammaShares[i]))
+			if gx == nil {
+				gx, gy = px, py
+			} else {
+				gx, gy = curve.Add(gx, gy, px, py)
+			}
+		}
+
+		// Every pair of nodes converts k_i*gamma_j and k_i*w_j into
+		// additive shares, so that every node ends up with its share
+		// delta_i of k*gamma and sigma_i of k*x.
+		deltaShares := make(map[int]*big.Int)
+		sigmaShares := make(map[int]*big.Int)
+		for _, node := range s.signers {
+			i := node.index
+			delta := new(big.Int).Mul(kShares[i], gammaShares[i])
+			deltaShares[i] = delta.Mod(delta, curve.N)
+			sigma := new(big.Int).Mul(kShares[i], wShares[i])
+			sigmaShares[i] = sigma.Mod(sigma, curve.N)
+		}
+		for _, alice := range s.signers {
+			for _, bob := range s.signers {
+				if alice == bob {
+					continue
+				}
+				i, j := alice.index, bob.index
+				alpha, beta, err := mtaConvert(alice.paillier, kShares[i], gammaShares[j])
+				if err != nil {
+					return nil, err
+				}
+				addMod(deltaShares[i], alpha)
+				addMod(deltaShares[j], beta)
+				mu, nu, err := mtaConvert(alice.paillier, kShares[i], wShares[j])
+				if err != nil {
+					return nil, err
+				}
+				addMod(sigmaShares[i], mu)
+				addMod(sigmaShares[j], nu)
+			}
+		}
+
+		// The nodes open delta = k*gamma, which reveals nothing about
+		// k, and compute R = delta^-1 * sum(Gamma_i) = k^-1 * G.
+		delta := new(big.Int)
+		for _, i := range indices {
+			addMod(delta, deltaShares[i])
+		}
+		if delta.Sign() == 0 {
+			continue
+		}
+		rx, _ := curve.ScalarMult(gx, gy, scalarBytes(new(big.Int).ModInverse(delta, curve.N)))
+		r := new(big.Int).Mod(rx, curve.N)
+		if r.Sign() == 0 {
+			continue
+		}
+
+		// Every node broadcasts s_i = e*k_i + r*sigma_i, so that
+		// s = sum(s_i) = k*(e + r*x).
+		e := hashToInt(hash)
+		sVal := new(big.Int)
+		for _, i := range indices {
+			addMod(sVal, new(big.Int).Mul(e, kShares[i]))
+			addMod(sVal, new(big.Int).Mul(r, sigmaShares[i]))
+		}
+		if sVal.Sign() == 0 {
+			continue
+		}
+		if sVal.Cmp(new(big.Int).Rsh(curve.N, 1)) > 0 {
+			sVal.Sub(curve.N, sVal)
+		}
+
+		sig := secp256k1.NewSignature(r, sVal)
+		if !sig.Verify(hash, s.group.pubKey) {
+			return nil, fmt.Errorf("cannot make threshold ECDSA signature: inconsistent shares")
+		}
+		return sig.Serialize(), nil
+	}
+}
+
+// addMod adds y to x modulo the order of secp256k1.
+func addMod(x, y *big.Int) {
+	x.Add(x, y)
+	x.Mod(x, secp256k1.S256().N)
+}
+
+// mtaConvert turns the product a*b of the secret a of Alice, whose
+// Paillier key is pk, and the secret b of Bob into additive shares
+// alpha of Alice and beta of Bob. Alice sends Enc(a) to Bob, who
+// returns Enc(a*b + beta') for a random beta' and keeps beta = -beta'.
+// Alice decrypts alpha = a*b + beta'. Neither learns the other secret.
+func mtaConvert(pk *paillierKey, a, b *big.Int) (alpha, beta *big.Int, err error) {
+	q := secp256k1.S256().N
+	ca, err := pk.encrypt(a)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// beta' < q^5 hides a*b < q^2, and a*b + beta' stays below the
+	// Paillier modulus.
+	betaPrime, err := rand.Int(rand.Reader, new(big.Int).Exp(q, big.NewInt(5), nil))
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot generate random bytes: %v", err)
+	}
+	cb, err := pk.encrypt(betaPrime)
+	if err != nil {
+		return nil, nil, err
+	}
+	cb = pk.add(pk.mul(ca, b), cb)
+	beta = new(big.Int).Neg(betaPrime)
+	beta.Mod(beta, q)
+
+	alpha = pk.decrypt(cb)
+	return alpha.Mod(alpha, q), beta, nil
+}
+
+// paillierPrimeBits is the size of the primes of a Paillier modulus,
+// which must exceed the q^5 masks of mtaConvert.
+const paillierPrimeBits = 1024
+
+// paillierKey is the Paillier key pair of a node, with generator n+1.
+type paillierKey struct {
+	n, n2  *big.Int
+	phi    *big.Int
+	phiInv *big.Int
+}
+
+func newPaillierKey() (*paillierKey, error) {
+	one := big.NewInt(1)
+	for {
+		p, err := rand.Prime(rand.Reader, paillierPrimeBits)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate Paillier key: %v", err)
+		}
+		q, err := rand.Prime(rand.Reader, paillierPrimeBits)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate Paillier key: %v", err)
+		}
+		n := new(big.Int).Mul(p, q)
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		phiInv := new(big.Int).ModInverse(phi, n)
+		if p.Cmp(q) == 0 || phiInv == nil {
+			continue
+		}
+		return &paillierKey{
+			n:      n,
+			n2:     new(big.Int).Mul(n, n),
+			phi:    phi,
+			phiInv: phiInv,
+		}, nil
+	}
+}
+
+// encrypt returns (1+n)^m * r^n mod n^2 for a random unit r.
+func (pk *paillierKey) encrypt(m *big.Int) (*big.Int, error) {
+	one := big.NewInt(1)
+	for {
+		r, err := rand.Int(rand.Reader, pk.n)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate random bytes: %v", err)
+		}
+		if r.Sign() == 0 || new(big.Int).GCD(nil, nil, r, pk.n).Cmp(one) != 0 {
+			continue
+		}
+		c := new(big.Int).Mul(m, pk.n)
+		c.Add(c, one)
+		c.Mul(c, new(big.Int).Exp(r, pk.n, pk.n2))
+		return c.Mod(c, pk.n2), nil
+	}
+}
+
+// decrypt returns L(c^phi mod n^2) * phi^-1 mod n, where
+// L(u) = (u-1)/n.
+func (pk *paillierKey) decrypt(c *big.Int) *big.Int {
+	u := new(big.Int).Exp(c, pk.phi, pk.n2)
+	u.Sub(u, big.NewInt(1))
+	u.Div(u, pk.n)
+	u.Mul(u, pk.phiInv)
+	return u.Mod(u, pk.n)
+}
+
+// add returns an encryption of the sum of the plaintexts of c1 and c2.
+func (pk *paillierKey) add(c1, c2 *big.Int) *big.Int {
+	c := new(big.Int).Mul(c1, c2)
+	return c.Mod(c, pk.n2)
+}
+
+// mul returns an encryption of the plaintext of c times k.
+func (pk *paillierKey) mul(c, k *big.Int) *big.Int {
+	return new(big.Int).Exp(c, k, pk.n2)
+}
+
+// sharing is a polynomial over the scalar field of secp256k1 whose
+// constant term is the shared secret.
+type sharing struct {
+	coefficients []*big.Int
+}
+
+func newSharing(secret *big.Int, degree int) (*sharing, error) {
+	d := &sharing{coefficients: make([]*big.Int, degree+1)}
+	d.coefficients[0] = new(big.Int).Set(secret)
+	for i := 1; i <= degree; i++ {
+		c, err := randomScalar()
+		if err != nil {
+			return nil, err
+		}
+		d.coefficients[i] = c
+	}
+	return d, nil
+}
+
+func (d *sharing) eval(index int) *big.Int {
+	n := secp256k1.S256().N
+	x := big.NewInt(int64(index))
+	res := new(big.Int)
+	for i := len(d.coefficients) - 1; i >= 0; i-- {
+		res.Mul(res, x)
+		res.Add(res, d.coefficients[i])
+		res.Mod(res, n)
+	}
+	return res
+}
+
+type curvePoint struct {
+	x, y *big.Int
+}
+
+// commitments returns the Feldman commitments to the coefficients.
+func (d *sharing) commitments() []curvePoint {
+	curve := secp256k1.S256()
+	res := make([]curvePoint, len(d.coefficients))
+	for i, c := range d.coefficients {
+		x, y := curve.ScalarBaseMult(scalarBytes(c))
+		res[i] = curvePoint{x, y}
+	}
+	return res
+}
+
+// verifyShare checks the share dealt to the node with the given index
+// against the dealer's Feldman commitments.
+func verifyShare(commitments []curvePoint, index int, share *big.Int) bool {
+	curve := secp256k1.S256()
+	x := big.NewInt(int64(index))
+	pow := big.NewInt(1)
+	var ex, ey *big.Int
+	for _, c := range commitments {
+		px, py := curve.ScalarMult(c.x, c.y, scalarBytes(pow))
+		if ex == nil {
+			ex, ey = px, py
+		} else {
+			ex, ey = curve.Add(ex, ey, px, py)
+		}
+		pow.Mul(pow, x)
+		pow.Mod(pow, curve.N)
+	}
+	sx, sy := curve.ScalarBaseMult(scalarBytes(share))
+	return sx.Cmp(ex) == 0 && sy.Cmp(ey) == 0
+}
+
+// lagrangeCoefficient returns the coefficient of the share at index i
+// when interpolating at zero over the given indices.
+func lagrangeCoefficient(i int, indices []int) *big.Int {
+	n := secp256k1.S256().N
+	num := big.NewInt(1)
+	den := big.NewInt(1)
+	for _, j := range indices {
+		if j == i {
+			continue
+		}
+		num.Mul(num, big.NewInt(int64(j)))
+		num.Mod(num, n)
+		den.Mul(den, big.NewInt(int64(j-i)))
+		den.Mod(den, n)
+	}
+	den.ModInverse(den, n)
+	return num.Mul(num, den).Mod(num, n)
+}
+
+func interpolateAtZero(shares map[int]*big.Int, indices []int) *big.Int {
+	n := secp256k1.S256().N
+	res := new(big.Int)
+	for _, i := range indices {
+		v := new(big.Int).Mul(shares[i], lagrangeCoefficient(i, indices))
+		res.Add(res, v)
+	}
+	return res.Mod(res, n)
+}
+
+// hashToInt converts a hash to an integer as ECDSA does.
+func hashToInt(hash []byte) *big.Int {
+	n := secp256k1.S256().N
+	orderBytes := (n.BitLen() + 7) / 8
+	if len(hash) > orderBytes {
+		hash = hash[:orderBytes]
+	}
+	res := new(big.Int).SetBytes(hash)
+	excess := len(hash)*8 - n.BitLen()
+	if excess > 0 {
+		res.Rsh(res, uint(excess))
+	}
+	return res
+}
+
+func randomScalar() (*big.Int, error) {
+	n := secp256k1.S256().N
+	for {
+		k, err := rand.Int(rand.Reader, n)
+		if err != nil {
+			return nil, fmt.Errorf("cannot generate random scalar: %v", err)
+		}
+		if k.Sign() != 0 {
+			return k, nil
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package macaroon_pass
+
+import (
+	"crypto/sha256"
+	"math/big"
+	"testing"
+
+	"github.com/decred/dcrd/dcrec/secp256k1"
+	qt "github.com/frankban/quicktest"
+)
+
+func TestThresholdSignature(t *testing.T) {
+	c := qt.New(t)
+	g, err := NewThresholdGroup(3, 4)
+	c.Assert(err, qt.IsNil)
+
+	m := MustNew([]byte("Threshold ECDSA"), "", V2)
+	err = m.AddFirstPartyCaveat([]byte("payment"))
+	c.Assert(err, qt.IsNil)
+
+	for _, indices := range [][]int{{1, 2, 3}, {2, 3, 4}, {1, 3, 4}, {1, 2, 3, 4}} {
+		signer, err := NewThresholdSigner(g, indices)
+		c.Assert(err, qt.IsNil)
+		err = m.Sign(signer)
+		c.Assert(err, qt.IsNil)
+		err = EcdsaSignatureVerify(g.PublicKey(), m)
+		c.Assert(err, qt.IsNil, qt.Commentf("signers %v", indices))
+	}
+
+	signer, err := NewThresholdSigner(g, []int{1, 2, 3})
+	c.Assert(err, qt.IsNil)
+	data := []byte("some data")
+	sigBytes, err := signer.SignData(data)
+	c.Assert(err, qt.IsNil)
+	sig, err := secp256k1.ParseSignature(sigBytes)
+	c.Assert(err, qt.IsNil)
+	pub, err := secp256k1.ParsePubKey(g.PublicKey())
+	c.Assert(err, qt.IsNil)
+	hash := sha256.Sum256(data)
+	c.Assert(sig.Verify(hash[:], pub), qt.IsTrue)
+}
+
+func TestThresholdSmallGroups(t *testing.T) {
+	c := qt.New(t)
+	for _, test := range []struct {
+		k, n    int
+		signers [][]int
+	}{
+		{1, 2, [][]int{{1}, {2}}},
+		{2, 2, [][]int{{1, 2}}},
+		{2, 3, [][]int{{1, 2}, {1, 3}, {3, 2}, {1, 2, 3}}},
+		{4, 5, [][]int{{1, 2, 3, 4}, {2, 3, 4, 5}}},
+	} {
+		g, err := NewThresholdGroup(test.k, test.n)
+		c.Assert(err, qt.IsNil)
+		for _, indices := range test.signers {
+			signer, err := NewThresholdSigner(g, indices)
+			c.Assert(err, qt.IsNil)
+			m := MustNew([]byte("Threshold ECDSA"), "", V2)
+			c.Assert(m.Sign(signer), qt.IsNil)
+			err = EcdsaSignatureVerify(g.PublicKey(), m)
+			c.Assert(err, qt.IsNil, qt.Commentf("%d-of-%d signers %v", test.k, test.n, indices))
+		}
+	}
+}
+
+func TestMtaConvert(t *testing.T) {
+	c := qt.New(t)
+	q := secp256k1.S256().N
+	pk, err := newPaillierKey()
+	c.Assert(err, qt.IsNil)
+	for _, v := range [][2]*big.Int{
+		{big.NewInt(6), big.NewInt(7)},
+		{new(big.Int).Sub(q, big.NewInt(1)), new(big.Int).Sub(q, big.NewInt(1))},
+	} {
+		alpha, beta, err := mtaConvert(pk, v[0], v[1])
+		c.Assert(err, qt.IsNil)
+		sum := new(big.Int).Add(alpha, beta)
+		prod := new(big.Int).Mul(v[0], v[1])
+		c.Assert(sum.Mod(sum, q).Cmp(prod.Mod(prod, q)), qt.Equals, 0)
+	}
+}
+
+func TestThresholdKeyIsShared(t *testing.T) {
+	c := qt.New(t)
+	g, err := NewThresholdGroup(5, 5)
+	c.Assert(err, qt.IsNil)
+
+	indices := []int{1, 2, 3, 4, 5}
+	shares := make(map[int]*big.Int)
+	for _, i := range indices {
+		node, err := g.Node(i)
+		c.Assert(err, qt.IsNil)
+		shares[i] = node.keyShare
+		_, pub := secp256k1.PrivKeyFromBytes(scalarBytes(node.keyShare))
+		c.Assert(pub.SerializeCompressed(), qt.Not(qt.DeepEquals), g.PublicKey())
+	}
+	key := interpolateAtZero(shares, indices)
+	_, pub := secp256k1.PrivKeyFromBytes(scalarBytes(key))
+	c.Assert(pub.SerializeCompressed(), qt.DeepEquals, g.PublicKey())
+}
+
+func TestThresholdSignerErrors(t *testing.T) {
+	c := qt.New(t)
+	_, err := NewThresholdGroup(5, 4)
+	c.Assert(err, qt.ErrorMatches, "4 nodes are not enough for threshold 5")
+	_, err = NewThresholdGroup(0, 3)
+	c.Assert(err, qt.ErrorMatches, "threshold 0 is not supported")
+
+	g, err := NewThresholdGroup(3, 3)
+	c.Assert(err, qt.IsNil)
+	c.Assert(g.Threshold(), qt.Equals, 3)
+	_, err = NewThresholdSigner(g, []int{1, 2})
+	c.Assert(err, qt.ErrorMatches, "2 nodes are not enough to sign, need at least 3")
+	_, err = NewThresholdSigner(g, []int{1, 2, 2})
+	c.Assert(err, qt.ErrorMatches, "node 2 is listed twice")
+	_, err = NewThresholdSigner(g, []int{1, 2, 4})
+	c.Assert(err, qt.ErrorMatches, "no node with index 4")
+}